@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/svc"
+	"strconv"
+	"time"
+)
+
+// ResyncReport tells how many diverging or failed keys a mirror resync repaired.
+type ResyncReport struct {
+	Repaired int `json:"repaired"`
+}
+
+// newAdminApi serves backup and restore of the whole store, on the backend like the CLI so archives hold
+// the objects encrypted and with their checksums, its usage, the state of the mirror,
+// the scrub, the janitor and the image cache, behind the token of the admin config.
+func newAdminApi(stack storeStack, logger *slog.Logger) http.Handler {
+	logger = logger.With("component", "admin")
+	router := http.NewServeMux()
+	router.HandleFunc("GET /backup", func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		name := fmt.Sprintf("backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		logger.InfoContext(r.Context(), "Backup started", "prefix", prefix)
+		manifest, err := storage.Backup(r.Context(), stack.backend, w, storage.BackupOptions{Prefix: prefix, Compress: true})
+		if err != nil {
+			// the archive is streamed already, cutting the connection keeps the client from taking it as complete
+			logger.ErrorContext(r.Context(), "Backup failed", "prefix", prefix, "Error:", err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		logger.InfoContext(r.Context(), "Backup finished", "prefix", prefix, "Objects", len(manifest.Objects), "Bytes", manifest.Bytes)
+	})
+	router.HandleFunc("POST /restore", func(w http.ResponseWriter, r *http.Request) {
+		// the item registry and the usage counters exist in every running store, empty is rarely the policy meant
+		value := r.URL.Query().Get("policy")
+		if value == "" {
+			svc.Error(w, r, fmt.Errorf("%w: policy is required, want empty, skip or overwrite", oops.ValidationError))
+			return
+		}
+		policy, err := storage.ParseConflictPolicy(value)
+		if err != nil {
+			svc.Error(w, r, err)
+			return
+		}
+		logger.InfoContext(r.Context(), "Restore started", "policy", policy)
+		report, err := storage.Restore(r.Context(), stack.backend, r.Body, policy)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Restore failed", "Restored", report.Restored, "Error:", err.Error())
+			svc.Error(w, r, err)
+			return
+		}
+		// the restore wrote below the quota, its counters have to catch up
+		if stack.quota != nil {
+			if _, err = stack.quota.Recompute(r.Context()); err != nil {
+				logger.ErrorContext(r.Context(), "Usage recount after restore failed", "Error:", err.Error())
+			}
+		}
+		logger.InfoContext(r.Context(), "Restore finished", "Restored", report.Restored, "Skipped", report.Skipped, "Bytes", report.Bytes)
+		svc.Data(w, r, report, http.StatusOK)
+	})
+	router.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+		if stack.quota == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no quota rules configured", oops.NotSupported))
+			return
+		}
+		svc.Data(w, r, stack.quota.Usage(), http.StatusOK)
+	})
+	router.HandleFunc("POST /usage/recompute", func(w http.ResponseWriter, r *http.Request) {
+		if stack.quota == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no quota rules configured", oops.NotSupported))
+			return
+		}
+		usage, err := stack.quota.Recompute(r.Context())
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Usage recount failed", "Error:", err.Error())
+			svc.Error(w, r, err)
+			return
+		}
+		svc.Data(w, r, usage, http.StatusOK)
+	})
+	router.HandleFunc("GET /mirror", func(w http.ResponseWriter, r *http.Request) {
+		if stack.mirror == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no mirror replicas configured", oops.NotSupported))
+			return
+		}
+		svc.Data(w, r, stack.mirror.Stats(), http.StatusOK)
+	})
+	router.HandleFunc("GET /mirror/divergence", func(w http.ResponseWriter, r *http.Request) {
+		if stack.mirror == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no mirror replicas configured", oops.NotSupported))
+			return
+		}
+		divergences, err := stack.mirror.Divergence(r.Context(), r.URL.Query().Get("prefix"))
+		if err != nil {
+			svc.Error(w, r, err)
+			return
+		}
+		svc.Data(w, r, divergences, http.StatusOK)
+	})
+	router.HandleFunc("POST /mirror/resync", func(w http.ResponseWriter, r *http.Request) {
+		if stack.mirror == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no mirror replicas configured", oops.NotSupported))
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		repaired, err := stack.mirror.Resync(r.Context(), prefix)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "Mirror resync failed", "prefix", prefix, "Repaired", repaired, "Error:", err.Error())
+			svc.Error(w, r, err)
+			return
+		}
+		logger.InfoContext(r.Context(), "Mirror resync finished", "prefix", prefix, "Repaired", repaired)
+		svc.Data(w, r, ResyncReport{Repaired: repaired}, http.StatusOK)
+	})
+	router.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		if stack.cache == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no image cache configured", oops.NotSupported))
+			return
+		}
+		svc.Data(w, r, stack.cache.Stats(), http.StatusOK)
+	})
+	router.HandleFunc("POST /scrub", func(w http.ResponseWriter, r *http.Request) {
+		if stack.checksums == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no checksums recorded", oops.NotSupported))
+			return
+		}
+		report, err := stack.checksums.Scrub(r.Context(), r.URL.Query().Get("prefix"))
+		if err != nil {
+			svc.Error(w, r, err)
+			return
+		}
+		svc.Data(w, r, report, http.StatusOK)
+	})
+	router.HandleFunc("GET /janitor", func(w http.ResponseWriter, r *http.Request) {
+		if stack.janitor == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no janitor rules configured", oops.NotSupported))
+			return
+		}
+		svc.Data(w, r, stack.janitor.Last(), http.StatusOK)
+	})
+	router.HandleFunc("POST /janitor", func(w http.ResponseWriter, r *http.Request) {
+		if stack.janitor == nil {
+			svc.Error(w, r, fmt.Errorf("%w: no janitor rules configured", oops.NotSupported))
+			return
+		}
+		dryRun := stack.janitor.DryRun()
+		if value := r.URL.Query().Get("dry_run"); value != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				svc.Error(w, r, fmt.Errorf("%w: invalid dry_run %q", oops.ValidationError, value))
+				return
+			}
+		}
+		report, err := stack.janitor.Run(r.Context(), dryRun)
+		if err != nil {
+			svc.Error(w, r, err)
+			return
+		}
+		svc.Data(w, r, report, http.StatusOK)
+	})
+	return router
+}
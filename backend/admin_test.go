@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"simplicity/config"
+	"simplicity/items"
+	"simplicity/oops"
+	"simplicity/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_adminBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}}
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}
+	newServer := func(backend storage.BlobStore) (*httptest.Server, storage.BlobStore) {
+		store, err := storage.NewEncryptingBlobStore(backend, keys, "k1")
+		require.NoError(t, err)
+		registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+		server := httptest.NewServer(setupServer(registry, storeStack{store: store, backend: backend}, conf, slog.Default()))
+		t.Cleanup(server.Close)
+		return server, store
+	}
+	request := func(method string, url string, body io.Reader, token string) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	server, src := newServer(storage.NewInMemoryBlobStore())
+	_, err := src.Put(ctx, "item/items.js", strings.NewReader(`{"plain":"text"}`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, server.URL+"/api/admin/backup", nil, "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, server.URL+"/api/admin/backup", nil, "wrong").StatusCode)
+
+	resp := request(http.MethodGet, server.URL+"/api/admin/backup", nil, "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/gzip", resp.Header.Get("Content-Type"))
+	archive, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	tarball, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(tarball)
+	require.NoError(t, err)
+	assert.NotContains(t, string(plain), `"plain":"text"`, "backups hold the objects as the backend stores them")
+
+	server, dst := newServer(storage.NewInMemoryBlobStore())
+	restoreURL := server.URL + "/api/admin/restore"
+	resp = request(http.MethodPost, restoreURL, bytes.NewReader(archive), "secret")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "a restore names its policy")
+	resp = request(http.MethodPost, restoreURL+"?policy=empty", bytes.NewReader(archive), "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report storage.RestoreReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Restored)
+	reader, _, err := dst.Get(ctx, "item/items.js")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, `{"plain":"text"}`, string(data), "restored objects decrypt once")
+
+	resp = request(http.MethodPost, restoreURL+"?policy=empty", bytes.NewReader(archive), "secret")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func Test_adminUsage(t *testing.T) {
+	ctx := context.Background()
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}}
+	backend := storage.NewInMemoryBlobStore()
+	quota, err := storage.NewQuotaBlobStore(ctx, backend, storage.QuotaOptions{
+		Rules: []storage.QuotaRule{{Prefix: "images/files/", HardBytes: 4}},
+	})
+	require.NoError(t, err)
+	registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+	server := httptest.NewServer(setupServer(registry, storeStack{store: quota, quota: quota}, conf, slog.Default()))
+	t.Cleanup(server.Close)
+	usage := func(method string, path string) []storage.Usage {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var usages []storage.Usage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&usages))
+		require.Len(t, usages, 1)
+		return usages
+	}
+
+	_, err = quota.Put(ctx, "images/files/1", strings.NewReader("123"), nil)
+	require.NoError(t, err)
+	_, err = quota.Put(ctx, "images/files/2", strings.NewReader("123"), nil)
+	assert.ErrorIs(t, err, oops.QuotaExceeded)
+	assert.Equal(t, int64(3), usage(http.MethodGet, "/api/admin/usage")[0].Bytes)
+
+	_, err = backend.Put(ctx, "images/files/2", strings.NewReader("1"), nil)
+	require.NoError(t, err)
+	recomputed := usage(http.MethodPost, "/api/admin/usage/recompute")[0]
+	assert.Equal(t, int64(2), recomputed.Objects)
+	assert.Equal(t, int64(4), recomputed.Bytes)
+}
+
+func Test_adminMirror(t *testing.T) {
+	ctx := context.Background()
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}}
+	primary, replica := storage.NewInMemoryBlobStore(), storage.NewInMemoryBlobStore()
+	mirror := storage.NewMirroredBlobStore(primary, []storage.BlobStore{replica}, storage.MirrorOptions{})
+	t.Cleanup(func() { mirror.Close() })
+	registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+	server := httptest.NewServer(setupServer(registry, storeStack{store: mirror, mirror: mirror}, conf, slog.Default()))
+	t.Cleanup(server.Close)
+	request := func(method string, path string, token string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	_, err := primary.Put(ctx, "images/files/1", strings.NewReader("123"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/admin/mirror", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/admin/mirror/divergence", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/api/storage/mirror/divergence", "").StatusCode)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/admin/mirror", "secret").StatusCode)
+	resp := request(http.MethodGet, "/api/admin/mirror/divergence?prefix=images/", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var divergences []storage.Divergence
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&divergences))
+	require.Len(t, divergences, 1)
+	assert.Equal(t, "images/files/1", divergences[0].Key)
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/admin/mirror/resync", "").StatusCode)
+	resp = request(http.MethodPost, "/api/admin/mirror/resync?prefix=images/", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report ResyncReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Repaired)
+	_, err = replica.Stat(ctx, "images/files/1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/admin/mirror/divergence", "secret").StatusCode)
+	assert.Zero(t, mirror.Stats().Replicas[0].Unrepaired)
+}
+
+func Test_adminScrub(t *testing.T) {
+	ctx := context.Background()
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}}
+	backend := storage.NewInMemoryBlobStore()
+	checksums := storage.NewChecksumBlobStore(backend)
+	_, err := checksums.Put(ctx, "images/files/1", strings.NewReader("123"), nil)
+	require.NoError(t, err)
+	registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+	server := httptest.NewServer(setupServer(registry, storeStack{store: checksums, checksums: checksums}, conf, slog.Default()))
+	t.Cleanup(server.Close)
+	post := func(path string, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("/api/admin/scrub", "").StatusCode)
+	assert.NotEqual(t, http.StatusOK, post("/api/storage/scrub", "").StatusCode)
+	resp := post("/api/admin/scrub?prefix=images/", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report storage.ScrubReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Checked)
+	assert.Empty(t, report.Corrupted)
+}
+
+func Test_adminJanitor(t *testing.T) {
+	ctx := context.Background()
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}}
+	store := storage.NewInMemoryBlobStore()
+	deletedAt := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	_, err := store.Put(ctx, "images/deleted-files/1/source.data", strings.NewReader("123"), map[string]string{storage.DeletedAtKey: deletedAt})
+	require.NoError(t, err)
+	janitor := storage.NewJanitor(store, storage.JanitorOptions{
+		Rules: []storage.LifecycleRule{{Prefix: "images/deleted-files/", MaxAge: 24 * time.Hour}},
+	}, slog.Default())
+	registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+	server := httptest.NewServer(setupServer(registry, storeStack{store: store, janitor: janitor}, conf, slog.Default()))
+	t.Cleanup(server.Close)
+	request := func(method string, path string, token string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/admin/janitor", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/admin/janitor", "").StatusCode)
+	assert.NotEqual(t, http.StatusOK, request(http.MethodPost, "/api/storage/janitor", "").StatusCode)
+	_, err = store.Stat(ctx, "images/deleted-files/1/source.data")
+	require.NoError(t, err, "unauthorized requests must not purge")
+
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/admin/janitor?dry_run=maybe", "secret").StatusCode)
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/api/admin/janitor", "secret").StatusCode)
+	_, err = store.Stat(ctx, "images/deleted-files/1/source.data")
+	assert.ErrorIs(t, err, oops.KeyNotFound)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/admin/janitor", "secret").StatusCode)
+}
+
+func Test_adminCache(t *testing.T) {
+	conf := &config.Config{Admin: config.Admin{Token: "secret"}, Cache: config.Cache{MaxBytes: 1024}}
+	registry := items.NewInMemoryRegistry(func() time.Time { return testTimestamp })
+	server := httptest.NewServer(setupServer(registry, storeStack{store: storage.NewInMemoryBlobStore()}, conf, slog.Default()))
+	t.Cleanup(server.Close)
+	get := func(path string, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/api/admin/cache", "").StatusCode)
+	assert.NotEqual(t, http.StatusOK, get("/api/storage/cache", "").StatusCode)
+	resp := get("/api/admin/cache", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats storage.CacheStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Zero(t, stats.Entries)
+
+	server = httptest.NewServer(setupServer(registry, storeStack{store: storage.NewInMemoryBlobStore()}, &config.Config{Admin: conf.Admin}, slog.Default()))
+	t.Cleanup(server.Close)
+	assert.Equal(t, http.StatusNotImplemented, get("/api/admin/cache", "secret").StatusCode)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"simplicity/config"
+	"simplicity/storage"
+	"strings"
+)
+
+// runBackup implements `backend backup [flags] <store> <archive>` and returns the exit code.
+// The archive is gzipped when its name ends in .gz or .tgz, - writes it to stdout.
+func runBackup(conf *config.Config, args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "only back up keys under this prefix")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backend backup [flags] <store> <archive.tar|archive.tar.gz|->")
+		fmt.Fprintln(flags.Output(), "Stores are disk:<path> or s3://<bucket>[/<prefix>]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	if isMemoryURI(flags.Arg(0)) {
+		fmt.Fprintf(os.Stderr, "cannot back up %s: memory stores do not outlive the command\n", flags.Arg(0))
+		return 2
+	}
+	compress, err := archiveCompression(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store, err := openStoreURI(conf, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open store: %v\n", err)
+		return 1
+	}
+	var out io.WriteCloser = os.Stdout
+	if flags.Arg(1) != "-" {
+		if out, err = os.Create(flags.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create archive: %v\n", err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	manifest, err := storage.Backup(ctx, store, out, storage.BackupOptions{Prefix: *prefix, Compress: compress})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d objects, %d bytes\n", len(manifest.Objects), manifest.Bytes)
+	return 0
+}
+
+// runRestore implements `backend restore [flags] <archive> <store>` and returns the exit code.
+func runRestore(conf *config.Config, args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	policyFlag := flags.String("policy", string(storage.RestoreEmpty), "existing keys: empty refuses a store with objects, skip keeps them, overwrite replaces them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backend restore [flags] <archive|-> <store>")
+		fmt.Fprintln(flags.Output(), "Stores are disk:<path> or s3://<bucket>[/<prefix>]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	if isMemoryURI(flags.Arg(1)) {
+		fmt.Fprintf(os.Stderr, "cannot restore into %s: memory stores do not outlive the command\n", flags.Arg(1))
+		return 2
+	}
+	policy, err := storage.ParseConflictPolicy(*policyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	store, err := openStoreURI(conf, flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open store: %v\n", err)
+		return 1
+	}
+	var in io.ReadCloser = os.Stdin
+	if flags.Arg(0) != "-" {
+		if in, err = os.Open(flags.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot open archive: %v\n", err)
+			return 1
+		}
+	}
+	defer in.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := storage.Restore(ctx, store, in, policy)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// archiveCompression tells from the name of an archive whether it is gzipped.
+func archiveCompression(name string) (bool, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return true, nil
+	case strings.HasSuffix(name, ".zst"):
+		return false, fmt.Errorf("zstd archives are not supported, use .tar.gz")
+	default:
+		return false, nil
+	}
+}
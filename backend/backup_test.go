@@ -0,0 +1,18 @@
+package main
+
+import (
+	"path/filepath"
+	"simplicity/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_runBackupRestoreRejectMemory(t *testing.T) {
+	conf := &config.Config{}
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	assert.Equal(t, 2, runBackup(conf, []string{"memory:", archive}))
+	assert.Equal(t, 0, runBackup(conf, []string{"disk:" + t.TempDir(), archive}))
+	assert.Equal(t, 2, runRestore(conf, []string{archive, "memory:"}))
+	assert.Equal(t, 0, runRestore(conf, []string{archive, "disk:" + t.TempDir()}))
+}
@@ -1,22 +1,130 @@
 package config
 
+import "os"
+
 type Config struct {
-	BackendName    string `json:"backend_name"`
-	BackendVersion string `json:"backend_version"`
-	AWS            AWS    `json:"aws"`
-	Server         Server `json:"server"`
-	EnableDebug    bool   `json:"debug"`
+	BackendName    string      `json:"backend_name"`
+	BackendVersion string      `json:"backend_version"`
+	AWS            AWS         `json:"aws"`
+	Storage        Storage     `json:"storage"`
+	Cache          Cache       `json:"cache"`
+	Retry          Retry       `json:"retry"`
+	Encryption     Encryption  `json:"encryption"`
+	Compression    Compression `json:"compression"`
+	Mirror         Mirror      `json:"mirror"`
+	Janitor        Janitor     `json:"janitor"`
+	Quota          Quota       `json:"quota"`
+	Admin          Admin       `json:"admin"`
+	Server         Server      `json:"server"`
+	EnableDebug    bool        `json:"debug"`
 }
 
 type Server struct {
 	Port string `json:"port"`
 }
 
-type AWS struct {
-	Profile string `json:"profile"`
+type Storage struct {
+	Backend       string `json:"backend"` // s3, disk or memory
+	Path          string `json:"path"`
+	SigningSecret string `json:"signing_secret"` // signed URLs of disk and memory, random when empty
+	// SignedPutMaxBytes bounds the bodies of signed PUT URLs of disk and memory, 64MB when 0.
+	SignedPutMaxBytes int64 `json:"signed_put_max_bytes"`
+	// Watch follows writes of other instances, the registry reloads and the image cache drops changed keys.
+	// Over S3 it lists the bucket every 10 seconds.
+	Watch bool `json:"watch"`
+}
+
+// Cache sits in front of the image store, it is off when MaxBytes is 0 and the disk tier is off without DiskPath.
+// Only keys under Prefixes are cached and watched for changes by other instances, every key when it is empty.
+type Cache struct {
+	MaxBytes       int64    `json:"max_bytes"`
+	MaxObjectBytes int64    `json:"max_object_bytes"`
+	MaxAgeSeconds  int      `json:"max_age_seconds"`
+	DiskPath       string   `json:"disk_path"`
+	DiskMaxBytes   int64    `json:"disk_max_bytes"`
+	Prefixes       []string `json:"prefixes"`
+}
+
+// Retry wraps the S3 store, zero values use the storage defaults.
+type Retry struct {
+	MaxAttempts        int `json:"max_attempts"`
+	BaseDelayMillis    int `json:"base_delay_millis"`
+	MaxDelayMillis     int `json:"max_delay_millis"`
+	FailureThreshold   int `json:"failure_threshold"`
+	OpenTimeoutSeconds int `json:"open_timeout_seconds"`
+}
+
+// Encryption is off without CurrentKeyID. Keys maps key IDs to base64 encoded 32 byte AES keys,
+// retired keys stay until RotateOnStart has resealed everything with the current one.
+type Encryption struct {
+	CurrentKeyID  string            `json:"current_key_id"`
+	Keys          map[string]string `json:"keys"`
+	RotateOnStart bool              `json:"rotate_on_start"`
+}
+
+// Compression gzips the objects of the registry store whose key matches one of the patterns, see storage.CompressingBlobStore.
+type Compression struct {
+	Patterns []string `json:"patterns"`
+}
+
+// Mirror copies everything written to the storage backend to the replicas, it is off without any.
+type Mirror struct {
+	Replicas  []Replica `json:"replicas"`
+	Async     bool      `json:"async"`
+	QueueSize int       `json:"queue_size"`
+}
+
+// Replica is a backend like Storage.Backend, Path is used by disk and Bucket by s3.
+type Replica struct {
+	Backend string `json:"backend"`
+	Path    string `json:"path"`
 	Bucket  string `json:"bucket"`
 }
 
+// Janitor purges objects some time after they were deleted, it is off without rules. Prefixes are keys of
+// the whole store and a zero interval runs it daily. The default rule only reports until DryRun is turned off.
+type Janitor struct {
+	Rules           []JanitorRule `json:"rules"`
+	IntervalMinutes int           `json:"interval_minutes"`
+	DryRun          bool          `json:"dry_run"`
+}
+
+type JanitorRule struct {
+	Prefix     string `json:"prefix"`
+	MaxAgeDays int    `json:"max_age_days"`
+}
+
+// Quota accounts the objects and bytes under the prefixes of its rules, it is off without rules. Limits
+// of 0 are unlimited, writes past HardBytes or MaxObjects fail and SoftBytes is only logged. The counters
+// are saved to StateKey, storage/usage.json when empty, every SaveIntervalSeconds or every minute.
+type Quota struct {
+	Rules               []QuotaRule `json:"rules"`
+	StateKey            string      `json:"state_key"`
+	SaveIntervalSeconds int         `json:"save_interval_seconds"`
+}
+
+type QuotaRule struct {
+	Prefix     string `json:"prefix"`
+	SoftBytes  int64  `json:"soft_bytes"`
+	HardBytes  int64  `json:"hard_bytes"`
+	MaxObjects int64  `json:"max_objects"`
+}
+
+// Admin endpoints take the Token as a bearer token, they are off without one. It is read from
+// SIMPLICITY_ADMIN_TOKEN so it stays out of the source.
+type Admin struct {
+	Token string `json:"token"`
+}
+
+// AWS selects the S3 account. An empty Profile uses the default credential chain, an Endpoint
+// points the client at an S3 compatible server instead of AWS, addressed path style.
+type AWS struct {
+	Profile  string `json:"profile"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"`
+}
+
 func LoadConfig() (*Config, error) {
 	config := &Config{
 		BackendName:    "Simplicity",
@@ -28,6 +136,29 @@ func LoadConfig() (*Config, error) {
 			Profile: "nick-aws-personal",
 			Bucket:  "simplicity-backend-storage",
 		},
+		Storage: Storage{
+			Backend: "s3",
+			Path:    "./data",
+		},
+		Cache: Cache{
+			MaxBytes:       64 * 1024 * 1024,
+			MaxObjectBytes: 1024 * 1024,
+			MaxAgeSeconds:  600,
+			Prefixes:       []string{"images/files/", "images/hashes/"},
+		},
+		Compression: Compression{
+			Patterns: []string{"*.js", "*.json", "*.txt"},
+		},
+		Janitor: Janitor{
+			Rules:  []JanitorRule{{Prefix: "images/deleted-files/", MaxAgeDays: 30}},
+			DryRun: true,
+		},
+		Quota: Quota{
+			Rules: []QuotaRule{{Prefix: "images/files/"}},
+		},
+		Admin: Admin{
+			Token: os.Getenv("SIMPLICITY_ADMIN_TOKEN"),
+		},
 		EnableDebug: false,
 	}
 	return config, nil
@@ -2,25 +2,29 @@ package images
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/http"
+	"path"
 	"simplicity/genid"
 	"simplicity/oops"
 	"simplicity/storage"
 	"simplicity/svc"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Api struct {
-	store        storage.BlobStore
-	deletedStore storage.BlobStore
-	idProvider   genid.Provider
-	logger       *slog.Logger
+	images     storage.BlobStore
+	store      storage.BlobStore
+	presigner  storage.Presigner
+	idProvider genid.Provider
+	logger     *slog.Logger
 }
 
 type Image struct {
@@ -28,20 +32,49 @@ type Image struct {
 	Location string `json:"location"`
 }
 
+// SignedURL lets the client transfer image bytes directly from or to the store.
+type SignedURL struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// UploadRequest asks for a presigned upload of Size bytes, the URL accepts no other length.
+type UploadRequest struct {
+	Size int64 `json:"size"`
+}
+
+type FinalizeRequest struct {
+	Filename string `json:"filename"`
+}
+
 const maxUploadSize = 48 * 1024 * 1024 // 48MB
 
+const signedURLTTL = 15 * time.Minute
+
+const filesPrefix = "files/"
+const deletedFilesPrefix = "deleted-files/"
+const uploadsPrefix = "uploads/"
+
 func NewApi(store storage.BlobStore, idProvider genid.Provider, logger *slog.Logger) *http.ServeMux {
 	router := http.NewServeMux()
+	images := storage.NewPrefixBlobStore(store, "images/")
 	api := &Api{
-		storage.NewPrefixBlobStore(store, "images/files/"),
-		storage.NewPrefixBlobStore(store, "images/deleted-files/"),
+		images,
+		storage.NewPrefixBlobStore(images, filesPrefix),
+		images,
 		idProvider,
 		logger.With("component", "images"),
 	}
 
 	router.HandleFunc("GET /files/", api.list)
 	router.HandleFunc("POST /upload", api.post)
+	router.HandleFunc("POST /uploads", api.presignUpload)
+	router.HandleFunc("POST /uploads/{id}/finalize", api.finalizeUpload)
 	router.HandleFunc("GET /files/{id}", api.get)
+	router.HandleFunc("GET /files/{id}/url", api.presignGet)
+	router.HandleFunc("GET /hashes/{hash}", api.getHash)
 	router.HandleFunc("DELETE /files/{id}", api.delete)
 
 	return router
@@ -64,38 +97,94 @@ func (api *Api) get(w http.ResponseWriter, r *http.Request) {
 	}
 	api.logger.DebugContext(r.Context(), "GET", "path", r.URL.Path)
 	path := storagePath(id, format)
-	reader, metadata, err := api.store.Get(r.Context(), path)
-	if err == oops.KeyNotFound {
-		err = api.createImageVariant(r.Context(), id, format)
-		if err == nil {
-			reader, metadata, err = api.store.Get(r.Context(), path)
-		}
-	}
+	info, err := api.statVariant(r.Context(), id, format)
 	if err != nil {
 		svc.Error(w, r, err)
 		return
 	}
-	defer reader.Close()
 	ext := format.Ext
 	if format == Source {
-		ext = MetadataReader{metadata}.Extension()
+		ext = MetadataReader{info.Metadata}.Extension()
 	}
 	header := w.Header()
 	header.Set("Content-Type", resolveMime(ext))
-	if metadata != nil {
-		for k, v := range metadata {
-			header.Set("metadata-"+k, v)
+	for k, v := range info.Metadata {
+		header.Set("metadata-"+k, v)
+	}
+	etag := quoteETag(info.ETag)
+	if etag != "" {
+		header.Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
 	}
+	if !info.LastModified.IsZero() {
+		header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Accept-Ranges", "bytes")
 
+	var byteRange svc.ByteRange
+	partial := false
+	if svc.IfRangeMatches(r, etag, info.LastModified) {
+		byteRange, partial, err = svc.ParseRange(r.Header.Get("Range"), info.Size)
+		if err != nil {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			svc.Error(w, r, err)
+			return
+		}
+	}
+	var reader io.ReadCloser
+	if partial {
+		reader, _, err = api.store.GetRange(r.Context(), path, byteRange.Start, byteRange.Length)
+	} else {
+		reader, _, err = api.store.Get(r.Context(), path)
+	}
+	if err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	defer reader.Close()
+	if partial {
+		header.Set("Content-Range", byteRange.ContentRange(info.Size))
+		header.Set("Content-Length", strconv.FormatInt(byteRange.Length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
 	if _, err = io.Copy(w, reader); err != nil {
+		if errors.Is(err, oops.Corrupted) {
+			// the headers are sent already, cutting the connection is the only way to tell the client
+			api.logger.ErrorContext(r.Context(), "Corrupted object", "path", path, "Error:", err.Error())
+			panic(http.ErrAbortHandler)
+		}
 		api.logger.ErrorContext(r.Context(), "Error during response writing", "method", "GET", "Error:", err.Error())
 		return
 	}
 }
 
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	return strconv.Quote(etag)
+}
+
+// statVariant creates the variant on first access.
+func (api *Api) statVariant(ctx context.Context, id string, format *Format) (storage.ObjectInfo, error) {
+	path := storagePath(id, format)
+	info, err := api.store.Stat(ctx, path)
+	if err == oops.KeyNotFound {
+		err = api.createImageVariant(ctx, id, format)
+		if err == nil {
+			info, err = api.store.Stat(ctx, path)
+		}
+	}
+	return info, err
+}
+
 func (api *Api) createImageVariant(ctx context.Context, id string, format *Format) error {
-	reader, metadata, err := api.store.Get(ctx, storagePath(id, Canonical))
+	reader, info, err := api.store.Get(ctx, storagePath(id, Canonical))
 	if err != nil {
 		return fmt.Errorf("failed to get canonical image: %w", err)
 	}
@@ -104,22 +193,39 @@ func (api *Api) createImageVariant(ctx context.Context, id string, format *Forma
 	if err != nil {
 		return fmt.Errorf("failed to transcode image: %w", err)
 	}
-	return api.store.Put(ctx, storagePath(id, format), tReader, metadata)
+	defer tReader.Close()
+	_, err = api.store.Put(ctx, storagePath(id, format), tReader, info.Metadata)
+	return err
 }
 
 func (api *Api) list(w http.ResponseWriter, r *http.Request) {
 	api.logger.DebugContext(r.Context(), "LIST", "path", r.URL.Path)
-	seq, err := api.store.List(r.Context(), "", storage.Delimiter)
+	opts := storage.ListOptions{
+		Delimiter:         storage.Delimiter,
+		ContinuationToken: r.URL.Query().Get("cursor"),
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		maxKeys, err := strconv.Atoi(limit)
+		if err != nil || maxKeys <= 0 {
+			svc.ErrorWithCode(w, r, fmt.Errorf("invalid limit: %s", limit), http.StatusBadRequest)
+			return
+		}
+		opts.MaxKeys = maxKeys
+	}
+	page, err := api.store.ListPage(r.Context(), opts)
 	if err != nil {
 		svc.Error(w, r, err)
 		return
 	}
-	images := make([]string, 0, len(seq))
-	for _, item := range seq {
+	images := make([]string, 0, len(page.Results))
+	for _, item := range page.Results {
 		if !item.IsObject {
-			images = append(images, strings.TrimSuffix(item.Key, "/"))
+			images = append(images, path.Base(strings.TrimSuffix(item.Key, storage.Delimiter)))
 		}
 	}
+	if page.NextToken != "" {
+		w.Header().Set("X-Next-Cursor", page.NextToken)
+	}
 	svc.Data(w, r, images, http.StatusOK)
 }
 
@@ -142,12 +248,27 @@ func (api *Api) post(w http.ResponseWriter, r *http.Request) {
 		svc.Error(w, r, errors.New("missing file field"))
 		return
 	}
+	hash, err := hashUpload(fileHeader)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to hash file: %w", err))
+		return
+	}
+	existing, err := api.lookupHash(r.Context(), hash)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to look up hash: %w", err))
+		return
+	}
+	if existing != "" {
+		api.existing(w, r, existing)
+		return
+	}
 	id := api.idProvider.Generate()
-	metadata, err := buildMetadata(id, fileHeader)
+	metadata, err := buildMetadata(id, fileHeader.Filename)
 	if err != nil {
 		svc.Error(w, r, fmt.Errorf("failed to build metadata: %w", err))
 		return
 	}
+	metadata.Hash = hash
 	api.logger.DebugContext(r.Context(), "Creating image", "method", "POST", "id", id, "metadata", metadata)
 	sourcePath := storagePath(metadata.ID, Source)
 	canonicalPath := storagePath(metadata.ID, Canonical)
@@ -159,37 +280,75 @@ func (api *Api) post(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	err = api.store.Put(r.Context(), sourcePath, file, metadata.Map())
+	_, err = api.store.Put(r.Context(), sourcePath, file, metadata.Map())
 	if err != nil {
+		// the write may have happened even though it failed
+		api.discard(r.Context(), metadata.ID)
 		svc.Error(w, r, fmt.Errorf("failed to store image: %w", err))
 		return
 	}
 
 	tFile, err := fileHeader.Open()
-	defer tFile.Close()
-	tFormat := &Format{
-		Name:   "",
-		Ext:    metadata.Extension,
-		Width:  0,
-		Height: 0,
+	if err == nil {
+		defer tFile.Close()
+		tFormat := &Format{
+			Name:   "",
+			Ext:    metadata.Extension,
+			Width:  0,
+			Height: 0,
+		}
+		var tr io.ReadCloser
+		if tr, err = transcodeFile(tFormat, Canonical, tFile); err == nil {
+			_, err = api.store.Put(r.Context(), canonicalPath, tr, metadata.Map())
+			tr.Close()
+		}
 	}
-	tr, err := transcodeFile(tFormat, Canonical, tFile)
 	if err != nil {
-		svc.Error(w, r, fmt.Errorf("failed to transcode file: %w", err))
+		api.discard(r.Context(), metadata.ID)
+		svc.Error(w, r, fmt.Errorf("failed to store transcoded image: %w", err))
 		return
 	}
+	api.created(w, r, metadata)
+}
+
+// discard removes what was stored of an image that could not be created completely,
+// so a source never stays behind without its canonical. It runs on when the client went away.
+func (api *Api) discard(ctx context.Context, id string) {
+	ctx = context.WithoutCancel(ctx)
+	if err := api.store.DeleteAll(ctx, id); err != nil {
+		api.logger.ErrorContext(ctx, "Failed to clean up incomplete image", "id", id, "Error:", err.Error())
+	}
+}
 
-	err = api.store.Put(r.Context(), canonicalPath, tr, metadata.Map())
+func hashUpload(fileHeader *multipart.FileHeader) (string, error) {
+	file, err := fileHeader.Open()
 	if err != nil {
-		svc.Error(w, r, fmt.Errorf("failed to store transcoded image: %w", err))
+		return "", err
+	}
+	defer file.Close()
+	return hashContent(file)
+}
+
+// created indexes the content hash of a newly stored image. If an identical upload finished first,
+// the new copy is dropped and the client gets the existing image.
+func (api *Api) created(w http.ResponseWriter, r *http.Request, metadata Metadata) {
+	id, err := api.indexHash(r.Context(), metadata.Hash, metadata.ID)
+	if err != nil {
+		api.logger.ErrorContext(r.Context(), "Failed to index image hash", "id", metadata.ID, "Error:", err.Error())
+	} else if id != metadata.ID {
+		if err = api.store.DeleteAll(r.Context(), metadata.ID); err != nil {
+			api.logger.ErrorContext(r.Context(), "Failed to drop duplicate image", "id", metadata.ID, "Error:", err.Error())
+		}
+		api.existing(w, r, id)
 		return
 	}
-	api.logger.InfoContext(r.Context(), "Image created", "method", "POST", "id", id, "metadata", metadata)
+	api.logger.InfoContext(r.Context(), "Image created", "method", "POST", "id", metadata.ID, "metadata", metadata)
 	w.Header().Set("Location", "images/files/"+metadata.ID)
 	svc.Data(w, r, Image{ID: metadata.ID}, http.StatusCreated)
 }
 
-func transcodeFile(in *Format, out *Format, r io.Reader) (io.Reader, error) {
+// transcodeFile streams the transcoded image, closing the reader stops a transcoding nobody reads.
+func transcodeFile(in *Format, out *Format, r io.Reader) (io.ReadCloser, error) {
 	pr, pw := io.Pipe()
 	go func() {
 		defer pw.Close()
@@ -202,8 +361,7 @@ func transcodeFile(in *Format, out *Format, r io.Reader) (io.Reader, error) {
 	return pr, nil
 }
 
-func buildMetadata(id string, fileHeader *multipart.FileHeader) (Metadata, error) {
-	originalName := fileHeader.Filename
+func buildMetadata(id string, originalName string) (Metadata, error) {
 	ext, err := resolveExtFromFileName(originalName)
 	if err != nil {
 		return Metadata{}, fmt.Errorf("failed to resolve extension: %w", err)
@@ -217,6 +375,143 @@ func buildMetadata(id string, fileHeader *multipart.FileHeader) (Metadata, error
 	}, nil
 }
 
+func (api *Api) presignUpload(w http.ResponseWriter, r *http.Request) {
+	var request UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	if request.Size <= 0 {
+		svc.Error(w, r, fmt.Errorf("%w: size of the upload is required", oops.ValidationError))
+		return
+	}
+	if request.Size > maxUploadSize {
+		svc.Error(w, r, fmt.Errorf("upload of %d bytes exceeds %d: %w", request.Size, maxUploadSize, oops.TooLarge))
+		return
+	}
+	id := api.idProvider.Generate()
+	url, err := api.presigner.PresignPut(r.Context(), uploadPath(id), request.Size, signedURLTTL)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to presign upload: %w", err))
+		return
+	}
+	api.logger.DebugContext(r.Context(), "Presigned upload", "method", "POST", "id", id, "size", request.Size)
+	svc.Data(w, r, SignedURL{ID: id, URL: url, Method: http.MethodPut, ExpiresAt: time.Now().Add(signedURLTTL)}, http.StatusCreated)
+}
+
+func uploadPath(id string) string {
+	return uploadsPrefix + storagePath(id, Source)
+}
+
+// dropUpload removes an upload that does not become an image.
+func (api *Api) dropUpload(ctx context.Context, id string) {
+	if err := api.images.Delete(ctx, uploadPath(id)); err != nil {
+		api.logger.ErrorContext(ctx, "Failed to remove upload", "id", id, "Error:", err.Error())
+	}
+}
+
+// finalizeUpload turns an object uploaded through a presigned URL into an image,
+// the same way post does for uploads that pass through the backend.
+func (api *Api) finalizeUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := api.idProvider.Validate(id); err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	var request FinalizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to decode request: %w", err))
+		return
+	}
+	metadata, err := buildMetadata(id, request.Filename)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to build metadata: %w", err))
+		return
+	}
+	info, err := api.images.Stat(r.Context(), uploadPath(id))
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to find upload: %w", err))
+		return
+	}
+	if info.Size > maxUploadSize {
+		api.dropUpload(r.Context(), id)
+		svc.Error(w, r, fmt.Errorf("upload of %d bytes exceeds %d: %w", info.Size, maxUploadSize, oops.TooLarge))
+		return
+	}
+	metadata.Hash, err = api.hashObject(r.Context(), uploadPath(id))
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to hash upload: %w", err))
+		return
+	}
+	existing, err := api.lookupHash(r.Context(), metadata.Hash)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to look up hash: %w", err))
+		return
+	}
+	if existing != "" {
+		api.dropUpload(r.Context(), id)
+		api.existing(w, r, existing)
+		return
+	}
+	sourcePath := storagePath(id, Source)
+	err = api.images.Move(r.Context(), uploadPath(id), filesPrefix+sourcePath, metadata.Map())
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to store image: %w", err))
+		return
+	}
+
+	reader, _, err := api.store.Get(r.Context(), sourcePath)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to read image: %w", err))
+		return
+	}
+	defer reader.Close()
+	tFormat := &Format{Ext: metadata.Extension}
+	tr, err := transcodeFile(tFormat, Canonical, reader)
+	if err == nil {
+		_, err = api.store.Put(r.Context(), storagePath(id, Canonical), tr, metadata.Map())
+		tr.Close()
+	}
+	if err != nil {
+		api.discard(r.Context(), id)
+		svc.Error(w, r, fmt.Errorf("failed to transcode file: %w", err))
+		return
+	}
+	api.created(w, r, metadata)
+}
+
+func (api *Api) hashObject(ctx context.Context, key string) (string, error) {
+	reader, _, err := api.images.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return hashContent(reader)
+}
+
+func (api *Api) presignGet(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := api.idProvider.Validate(id); err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	format, err := resolveFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	if _, err = api.statVariant(r.Context(), id, format); err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	url, err := api.presigner.PresignGet(r.Context(), filesPrefix+storagePath(id, format), signedURLTTL)
+	if err != nil {
+		svc.Error(w, r, fmt.Errorf("failed to presign download: %w", err))
+		return
+	}
+	svc.Data(w, r, SignedURL{ID: id, URL: url, Method: http.MethodGet, ExpiresAt: time.Now().Add(signedURLTTL)}, http.StatusOK)
+}
+
 func (api *Api) delete(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if err := api.idProvider.Validate(id); err != nil {
@@ -225,18 +520,27 @@ func (api *Api) delete(w http.ResponseWriter, r *http.Request) {
 	}
 	api.logger.InfoContext(r.Context(), "Deleting image", "method", "DELETE", "id", id)
 	sourcePath := storagePath(id, Source)
-	sourceFile, metadata, err := api.store.Get(r.Context(), sourcePath)
+	api.logger.DebugContext(r.Context(), "Moving source image to deleted files", "method", "DELETE", "path", sourcePath)
+	source, err := api.images.Stat(r.Context(), filesPrefix+sourcePath)
 	if err != nil {
-		svc.Error(w, r, fmt.Errorf("failed to get source image: %w", err))
+		svc.Error(w, r, fmt.Errorf("failed to move source image: %w", err))
 		return
 	}
-	defer sourceFile.Close()
-	api.logger.DebugContext(r.Context(), "Coping source image to deleted store", "method", "DELETE", "path", sourcePath)
-	err = api.deletedStore.Put(r.Context(), storagePath(id, Source), sourceFile, metadata)
+	metadata := make(map[string]string, len(source.Metadata)+1)
+	for k, v := range source.Metadata {
+		metadata[k] = v
+	}
+	metadata[storage.DeletedAtKey] = time.Now().UTC().Format(time.RFC3339)
+	err = api.images.Move(r.Context(), filesPrefix+sourcePath, deletedFilesPrefix+sourcePath, metadata)
 	if err != nil {
-		svc.Error(w, r, fmt.Errorf("failed to store deleted image: %w", err))
+		svc.Error(w, r, fmt.Errorf("failed to move source image: %w", err))
 		return
 	}
+	// the move keeps the content, so the hash recorded with the source still holds
+	err = api.forgetHash(r.Context(), MetadataReader{source.Metadata}.Hash(), id)
+	if err != nil {
+		api.logger.ErrorContext(r.Context(), "Failed to drop image hash", "method", "DELETE", "id", id, "Error:", err.Error())
+	}
 	api.logger.DebugContext(r.Context(), "Deleting image from store", "method", "DELETE", "id", id)
 	err = api.store.DeleteAll(r.Context(), id)
 	if err != nil {
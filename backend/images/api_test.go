@@ -2,17 +2,29 @@ package images
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"image"
+	"image/jpeg"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"simplicity/genid"
+	"simplicity/oops"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"simplicity/storage"
+	"simplicity/storage/storagetest"
 )
 
 func createMultipartFormFile(t *testing.T, fieldName, filename string, content []byte) (*bytes.Buffer, string) {
@@ -26,14 +38,21 @@ func createMultipartFormFile(t *testing.T, fieldName, filename string, content [
 	return body, writer.FormDataContentType()
 }
 
+func createJpeg(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, nil))
+	return buf.Bytes()
+}
+
 func TestImageApi_HappyPath(t *testing.T) {
 	store := storage.NewPrefixBlobStore(storage.NewInMemoryBlobStore(), "image/")
 	idProvider, err := genid.NewSnowflakeProvider(1)
 	require.NoError(t, err)
-	router := NewApi(store, idProvider)
+	router := NewApi(store, idProvider, slog.Default())
 
 	var imageID string
-	var imageData = []byte("\xFF\xD8\xFF\xE0" + "fake jpg data")
+	var imageData = createJpeg(t)
 
 	t.Run("POST /upload", func(t *testing.T) {
 		body, contentType := createMultipartFormFile(t, "file", "pic.jpg", imageData)
@@ -78,6 +97,22 @@ func TestImageApi_HappyPath(t *testing.T) {
 		assert.Equal(t, imageData, body)
 	})
 
+	t.Run("GET /files/{id} with If-None-Match", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+imageID+"?format=web-preview-100", nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+		etag := resp.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		req = httptest.NewRequest(http.MethodGet, "/files/"+imageID+"?format=web-preview-100", nil)
+		req.Header.Set("If-None-Match", etag)
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNotModified, resp.Code)
+		assert.Empty(t, resp.Body.Bytes())
+	})
+
 	t.Run("DELETE /files/{id}", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodDelete, "/files/"+imageID, nil)
 		resp := httptest.NewRecorder()
@@ -85,14 +120,291 @@ func TestImageApi_HappyPath(t *testing.T) {
 		router.ServeHTTP(resp, req)
 
 		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+
+		info, err := store.Stat(req.Context(), "images/deleted-files/"+imageID+"/source.data")
+		require.NoError(t, err)
+		deletedAt, err := time.Parse(time.RFC3339, info.Metadata[storage.DeletedAtKey])
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), deletedAt, time.Minute)
+		assert.Equal(t, "jpeg", info.Metadata["extension"])
+		files, err := store.List(req.Context(), "images/files/"+imageID+"/", "")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+func TestImageApi_ListPages(t *testing.T) {
+	store := storage.NewInMemoryBlobStore()
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+	for _, id := range []string{"1", "2", "3"} {
+		_, err = store.Put(context.Background(), "images/files/"+id+"/source.data", strings.NewReader(id), nil)
+		require.NoError(t, err)
+	}
+
+	var pages [][]string
+	cursor := ""
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/files/?limit=2&cursor="+cursor, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+
+		var files []string
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &files))
+		pages = append(pages, files)
+		cursor = resp.Header().Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, [][]string{{"1", "2"}, {"3"}}, pages)
+}
+
+func TestImageApi_Ranges(t *testing.T) {
+	store := storage.NewInMemoryBlobStore()
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+	id := idProvider.Generate()
+	_, err = store.Put(context.Background(), "images/files/"+id+"/source.data", strings.NewReader("0123456789"), map[string]string{"extension": "png"})
+	require.NoError(t, err)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+id+"?format=source", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := get(nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "bytes", resp.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "10", resp.Header().Get("Content-Length"))
+	etag := resp.Header().Get("ETag")
+
+	resp = get(map[string]string{"Range": "bytes=2-4"})
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "bytes 2-4/10", resp.Header().Get("Content-Range"))
+	assert.Equal(t, "234", resp.Body.String())
+
+	resp = get(map[string]string{"Range": "bytes=-3", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "789", resp.Body.String())
+
+	resp = get(map[string]string{"Range": "bytes=-3", "If-Range": `"stale"`})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "0123456789", resp.Body.String())
+
+	resp = get(map[string]string{"Range": "bytes=10-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.Code)
+	assert.Equal(t, "bytes */10", resp.Header().Get("Content-Range"))
+}
+
+func TestImageApi_SignedUpload(t *testing.T) {
+	signer := storage.NewURLSigner(storage.NewInMemoryBlobStore(), "/signed", []byte("secret"), 0)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(signer, idProvider, slog.Default())
+	signed := http.StripPrefix("/signed", signer)
+	imageData := createJpeg(t)
+
+	presign := func(size int) SignedURL {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(fmt.Sprintf(`{"size":%d}`, size))))
+		require.Equal(t, http.StatusCreated, resp.Code, "Response: %s", resp.Body.String())
+		var upload SignedURL
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &upload))
+		assert.Equal(t, http.MethodPut, upload.Method)
+		return upload
+	}
+	upload := func(target SignedURL, data []byte) {
+		resp := httptest.NewRecorder()
+		signed.ServeHTTP(resp, httptest.NewRequest(target.Method, target.URL, bytes.NewReader(data)))
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+	}
+	finalize := func(id string, filename string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/uploads/"+id+"/finalize", strings.NewReader(`{"filename":"`+filename+`"}`))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("upload, finalize and download", func(t *testing.T) {
+		target := presign(len(imageData))
+		upload(target, imageData)
+		resp := finalize(target.ID, "pic.jpg")
+		require.Equal(t, http.StatusCreated, resp.Code, "Response: %s", resp.Body.String())
+
+		info, err := signer.Stat(context.Background(), "images/files/"+target.ID+"/source.data")
+		require.NoError(t, err)
+		assert.Equal(t, "pic.jpg", info.Metadata["original_name"])
+		assert.Equal(t, JpegExt, info.Metadata["extension"])
+		_, err = signer.Stat(context.Background(), "images/files/"+target.ID+"/canonical.png")
+		assert.NoError(t, err)
+
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/files/"+target.ID+"/url?format=source", nil))
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+		var download SignedURL
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &download))
+		resp = httptest.NewRecorder()
+		signed.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, download.URL, nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, imageData, resp.Body.Bytes())
+	})
+
+	t.Run("finalize of known content returns the existing image", func(t *testing.T) {
+		first := presign(len(imageData))
+		upload(first, imageData)
+		resp := finalize(first.ID, "pic.jpg")
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+		var img Image
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &img))
+		assert.NotEqual(t, first.ID, img.ID)
+		_, err := signer.Stat(context.Background(), "images/uploads/"+first.ID+"/source.data")
+		assert.Equal(t, oops.KeyNotFound, err)
+	})
+
+	t.Run("finalize rejects what is not an image", func(t *testing.T) {
+		target := presign(len("not an image"))
+		upload(target, []byte("not an image"))
+		resp := finalize(target.ID, "pic.jpg")
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		files, err := signer.List(context.Background(), "images/files/"+target.ID+"/", "")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("finalize without upload", func(t *testing.T) {
+		resp := finalize(idProvider.Generate(), "pic.jpg")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("presigning needs the size of the upload", func(t *testing.T) {
+		for body, code := range map[string]int{
+			`{}`: http.StatusBadRequest,
+			fmt.Sprintf(`{"size":%d}`, maxUploadSize+1): http.StatusRequestEntityTooLarge,
+		} {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(body)))
+			assert.Equal(t, code, resp.Code, body)
+		}
+	})
+
+	t.Run("presigning needs a store that signs", func(t *testing.T) {
+		router := NewApi(storage.NewInMemoryBlobStore(), idProvider, slog.Default())
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(`{"size":4}`)))
+		assert.Equal(t, http.StatusNotImplemented, resp.Code)
 	})
 }
 
+func TestImageApi_Dedup(t *testing.T) {
+	store := storage.NewInMemoryBlobStore()
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+	imageData := createJpeg(t)
+	sum := sha256.Sum256(imageData)
+	hash := hex.EncodeToString(sum[:])
+
+	upload := func(filename string) (int, string) {
+		body, contentType := createMultipartFormFile(t, "file", filename, imageData)
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var img Image
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &img), "Response: %s", resp.Body.String())
+		return resp.Code, img.ID
+	}
+	lookup := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/hashes/"+hash, nil))
+		return resp
+	}
+
+	assert.Equal(t, http.StatusNotFound, lookup().Code)
+	code, id := upload("pic.jpg")
+	require.Equal(t, http.StatusCreated, code)
+	code, again := upload("copy.jpg")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, id, again)
+
+	files, err := store.List(context.Background(), "images/files/", storage.Delimiter)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	info, err := store.Stat(context.Background(), "images/files/"+id+"/source.data")
+	require.NoError(t, err)
+	assert.Equal(t, hash, info.Metadata["hash"])
+
+	resp := lookup()
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"id":"`+id+`","location":""}`, resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/files/"+id+"?format=web-preview-100", nil))
+	assert.Equal(t, hash, resp.Header().Get("metadata-hash"))
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/files/"+id, nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusNotFound, lookup().Code)
+	code, fresh := upload("pic.jpg")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, id, fresh)
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/hashes/not-a-hash", nil))
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestImageApi_EncryptedStore(t *testing.T) {
+	backend := storage.NewInMemoryBlobStore()
+	store, err := storage.NewEncryptingBlobStore(backend, map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}, "k1")
+	require.NoError(t, err)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+	imageData := createJpeg(t)
+
+	body, contentType := createMultipartFormFile(t, "file", "pic.jpg", imageData)
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code, "Response: %s", resp.Body.String())
+	var img Image
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &img))
+
+	reader, _, err := backend.Get(context.Background(), "images/files/"+img.ID+"/source.data")
+	require.NoError(t, err)
+	stored, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.NotEqual(t, imageData, stored)
+
+	for _, format := range []string{"source", "web-preview-100"} {
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/files/"+img.ID+"?format="+format, nil))
+		require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+		assert.Equal(t, resp.Header().Get("Content-Length"), strconv.Itoa(resp.Body.Len()))
+		assert.Empty(t, resp.Header().Get("metadata-enc_data_key"))
+	}
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/files/"+img.ID+"?format=source", nil))
+	assert.Equal(t, imageData, resp.Body.Bytes())
+}
+
 func TestImageApi_UnhappyPath(t *testing.T) {
 	store := storage.NewInMemoryBlobStore()
 	idProvider, err := genid.NewSnowflakeProvider(1)
 	require.NoError(t, err)
-	router := NewApi(store, idProvider)
+	router := NewApi(store, idProvider, slog.Default())
 
 	t.Run("POST /upload with no file", func(t *testing.T) {
 		body := &bytes.Buffer{}
@@ -131,3 +443,190 @@ func TestImageApi_UnhappyPath(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, resp.Code)
 	})
 }
+
+func TestImageApi_CorruptedSource(t *testing.T) {
+	backend := storage.NewInMemoryBlobStore()
+	store := storage.NewChecksumBlobStore(backend)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+	id := idProvider.Generate()
+	key := "images/files/" + id + "/source.data"
+	_, err = store.Put(context.Background(), key, strings.NewReader("0123456789"), map[string]string{"extension": "png"})
+	require.NoError(t, err)
+	info, err := backend.Stat(context.Background(), key)
+	require.NoError(t, err)
+	_, err = backend.Put(context.Background(), key, strings.NewReader("0123456788"), info.Metadata)
+	require.NoError(t, err)
+
+	resp := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/files/"+id+"?format=source", nil))
+	})
+	assert.Equal(t, "10", resp.Header().Get("Content-Length"))
+	assert.Less(t, resp.Body.Len(), 10)
+}
+
+func createShadedJpeg(t *testing.T, shade uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, nil))
+	return buf.Bytes()
+}
+
+// assertNoHalfWrittenImages checks that every stored image has its source and canonical
+// and that the hash index only points to stored images.
+func assertNoHalfWrittenImages(t *testing.T, store storage.BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+	files, err := store.List(ctx, "images/files/", "")
+	require.NoError(t, err)
+	variants := make(map[string][]string)
+	for _, file := range files {
+		id, name, _ := strings.Cut(strings.TrimPrefix(file.Key, "images/files/"), "/")
+		variants[id] = append(variants[id], name)
+	}
+	for id, names := range variants {
+		assert.Contains(t, names, Source.FileName(), "image %s has no source", id)
+		assert.Contains(t, names, Canonical.FileName(), "image %s has no canonical", id)
+	}
+	hashes, err := store.List(ctx, "images/hashes/", "")
+	require.NoError(t, err)
+	for _, hash := range hashes {
+		reader, _, err := store.Get(ctx, hash.Key)
+		require.NoError(t, err)
+		id, err := io.ReadAll(reader)
+		reader.Close()
+		require.NoError(t, err)
+		assert.Contains(t, variants, string(id), "hash %s points to a missing image", hash.Key)
+	}
+	uploads, err := store.List(ctx, "images/uploads/", "")
+	require.NoError(t, err)
+	assert.Empty(t, uploads, "uploads left behind")
+}
+
+func TestImageApi_PostFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault storagetest.Fault
+	}{
+		{"source fails", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/source.*", Action: storagetest.Fail}},
+		{"source reply lost", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/source.*", Action: storagetest.FailAfter}},
+		{"canonical fails", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/canonical.*", Action: storagetest.Fail}},
+		{"canonical reply lost", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/canonical.*", Action: storagetest.FailAfter}},
+		{"canonical truncated", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/canonical.*", Action: storagetest.Truncate, Bytes: 16}},
+		{"source unreadable", storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/source.*", Action: storagetest.Truncate}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := storage.NewInMemoryBlobStore()
+			store := storagetest.NewFaultyBlobStore(backend, int64(i))
+			idProvider, err := genid.NewSnowflakeProvider(1)
+			require.NoError(t, err)
+			router := NewApi(store, idProvider, slog.Default())
+			upload := func() *httptest.ResponseRecorder {
+				body, contentType := createMultipartFormFile(t, "file", "pic.jpg", createShadedJpeg(t, uint8(i)))
+				req := httptest.NewRequest(http.MethodPost, "/upload", body)
+				req.Header.Set("Content-Type", contentType)
+				resp := httptest.NewRecorder()
+				router.ServeHTTP(resp, req)
+				return resp
+			}
+
+			store.Inject(tt.fault)
+			resp := upload()
+			assert.GreaterOrEqual(t, resp.Code, http.StatusBadRequest, "Response: %s", resp.Body.String())
+			require.Len(t, store.Injected(), 1)
+			assertNoHalfWrittenImages(t, backend)
+			files, err := backend.List(context.Background(), "images/", "")
+			require.NoError(t, err)
+			assert.Empty(t, files)
+
+			store.Reset()
+			resp = upload()
+			require.Equal(t, http.StatusCreated, resp.Code, "Response: %s", resp.Body.String())
+			assertNoHalfWrittenImages(t, backend)
+		})
+	}
+}
+
+func TestImageApi_FinalizeFaults(t *testing.T) {
+	backend := storage.NewInMemoryBlobStore()
+	store := storagetest.NewFaultyBlobStore(backend, 1)
+	signer := storage.NewURLSigner(store, "/signed", []byte("secret"), 0)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(signer, idProvider, slog.Default())
+	signed := http.StripPrefix("/signed", signer)
+
+	imageData := createJpeg(t)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(fmt.Sprintf(`{"size":%d}`, len(imageData)))))
+	require.Equal(t, http.StatusCreated, resp.Code, "Response: %s", resp.Body.String())
+	var target SignedURL
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &target))
+	resp = httptest.NewRecorder()
+	signed.ServeHTTP(resp, httptest.NewRequest(target.Method, target.URL, bytes.NewReader(imageData)))
+	require.Equal(t, http.StatusOK, resp.Code, "Response: %s", resp.Body.String())
+
+	store.Inject(storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/canonical.*", Action: storagetest.Fail})
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/uploads/"+target.ID+"/finalize", strings.NewReader(`{"filename":"pic.jpg"}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code, "Response: %s", resp.Body.String())
+	assertNoHalfWrittenImages(t, backend)
+}
+
+func TestImageApi_PostCanceled(t *testing.T) {
+	backend := storage.NewInMemoryBlobStore()
+	store := storagetest.NewFaultyBlobStore(backend, 1).Inject(
+		storagetest.Fault{Op: storagetest.OpPut, Key: "images/files/*/canonical.*", Action: storagetest.Delay, Delay: time.Hour},
+		storagetest.Fault{Op: storagetest.OpDelete, Action: storagetest.Delay, Delay: time.Millisecond},
+	)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	body, contentType := createMultipartFormFile(t, "file", "pic.jpg", createJpeg(t))
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.GreaterOrEqual(t, resp.Code, http.StatusBadRequest, "Response: %s", resp.Body.String())
+	files, err := backend.List(context.Background(), "images/", "")
+	require.NoError(t, err)
+	assert.Empty(t, files, "the source of a canceled upload is cleaned up")
+}
+
+// TestImageApi_RandomFaults uploads images while writes fail at random, the seed is logged to replay a failure.
+func TestImageApi_RandomFaults(t *testing.T) {
+	const seed = 42
+	backend := storage.NewInMemoryBlobStore()
+	store := storagetest.NewFaultyBlobStore(backend, seed).Inject(
+		storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Fail, Probability: 0.2},
+		storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.FailAfter, Probability: 0.1},
+		storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Truncate, Bytes: 8, Probability: 0.1},
+	)
+	idProvider, err := genid.NewSnowflakeProvider(1)
+	require.NoError(t, err)
+	router := NewApi(store, idProvider, slog.Default())
+
+	created := 0
+	for i := 0; i < 40; i++ {
+		body, contentType := createMultipartFormFile(t, "file", "pic.jpg", createShadedJpeg(t, uint8(i*5)))
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code < http.StatusBadRequest {
+			created++
+		}
+	}
+	require.NotEmpty(t, store.Injected(), "seed %d injected no faults", seed)
+	assert.Positive(t, created, "seed %d", seed)
+	assertNoHalfWrittenImages(t, backend)
+}
@@ -0,0 +1,119 @@
+package images
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/svc"
+	"strings"
+)
+
+// hashesPrefix holds one small object per content hash, its body is the ID of the image with that content.
+const hashesPrefix = "hashes/"
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func hashContent(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// lookupHash returns the ID of the stored image with the content hash or "" if there is none.
+// Entries of images that were deleted since are ignored.
+func (api *Api) lookupHash(ctx context.Context, hash string) (string, error) {
+	reader, _, err := api.images.Get(ctx, hashesPrefix+hash)
+	if err == oops.KeyNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	id := string(data)
+	if err = api.idProvider.Validate(id); err != nil {
+		return "", nil
+	}
+	_, err = api.store.Stat(ctx, storagePath(id, Source))
+	if err == oops.KeyNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// indexHash records id as the image for hash. When a concurrent upload of the same content
+// claimed the hash first, the ID of that image is returned instead and the caller should drop its own.
+func (api *Api) indexHash(ctx context.Context, hash string, id string) (string, error) {
+	_, err := api.images.PutIf(ctx, hashesPrefix+hash, strings.NewReader(id), nil, storage.Precondition{IfNoneMatch: true})
+	if !errors.Is(err, oops.Conflict) {
+		return id, err
+	}
+	existing, err := api.lookupHash(ctx, hash)
+	if err != nil || existing != "" {
+		return existing, err
+	}
+	_, err = api.images.Put(ctx, hashesPrefix+hash, strings.NewReader(id), nil)
+	return id, err
+}
+
+// forgetHash drops the index entry of a deleted image, unless it already points to another image.
+func (api *Api) forgetHash(ctx context.Context, hash string, id string) error {
+	if hash == "" {
+		return nil
+	}
+	reader, _, err := api.images.Get(ctx, hashesPrefix+hash)
+	if err == oops.KeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != id {
+		return err
+	}
+	return api.images.Delete(ctx, hashesPrefix+hash)
+}
+
+// existing answers an upload whose content is already stored as image id.
+func (api *Api) existing(w http.ResponseWriter, r *http.Request, id string) {
+	api.logger.InfoContext(r.Context(), "Image already exists", "method", "POST", "id", id)
+	w.Header().Set("Location", "images/files/"+id)
+	svc.Data(w, r, Image{ID: id}, http.StatusOK)
+}
+
+func (api *Api) getHash(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !hashPattern.MatchString(hash) {
+		svc.Error(w, r, fmt.Errorf("invalid hash: %s", hash))
+		return
+	}
+	id, err := api.lookupHash(r.Context(), hash)
+	if err != nil {
+		svc.Error(w, r, err)
+		return
+	}
+	if id == "" {
+		svc.Error(w, r, oops.KeyNotFound)
+		return
+	}
+	w.Header().Set("Location", "images/files/"+id)
+	svc.Data(w, r, Image{ID: id}, http.StatusOK)
+}
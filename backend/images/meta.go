@@ -6,6 +6,7 @@ type Metadata struct {
 	Timestamp    string `json:"timestamp"`
 	OriginalName string `json:"original_name"`
 	Extension    string `json:"extension"`
+	Hash         string `json:"hash"` // hex SHA-256 of the source content
 }
 
 func (t Metadata) Map() map[string]string {
@@ -15,6 +16,7 @@ func (t Metadata) Map() map[string]string {
 		"timestamp":     t.Timestamp,
 		"original_name": t.OriginalName,
 		"extension":     t.Extension,
+		"hash":          t.Hash,
 	}
 }
 
@@ -25,3 +27,7 @@ type MetadataReader struct {
 func (m MetadataReader) Extension() string {
 	return m.source["extension"]
 }
+
+func (m MetadataReader) Hash() string {
+	return m.source["hash"]
+}
@@ -4,28 +4,42 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"simplicity/oops"
 	"simplicity/storage"
+	"sync"
 	"time"
 )
 
 type StoreRegistry struct {
+	mu       sync.RWMutex
 	store    storage.BlobStore
 	key      string
+	etag     string
 	registry *InMemoryRegistry
 }
 
 func NewPersistentRegistry(store storage.BlobStore, key string) *StoreRegistry {
-	return &StoreRegistry{store, key, NewInMemoryRegistry(func() time.Time {
+	return &StoreRegistry{store: store, key: key, registry: NewInMemoryRegistry(func() time.Time {
 		return time.Now()
 	})}
 }
 
 func (r *StoreRegistry) Init() error {
-	reader, _, err := r.store.Get(context.Background(), r.key)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load(context.Background())
+}
+
+func (r *StoreRegistry) load(ctx context.Context) error {
+	reader, info, err := r.store.Get(ctx, r.key)
 	if err != nil {
 		if err == oops.KeyNotFound {
+			r.registry.store = make(map[string]Item)
+			r.etag = ""
 			return nil
 		}
 		return err
@@ -40,43 +54,97 @@ func (r *StoreRegistry) Init() error {
 	if err != nil {
 		return fmt.Errorf("failed to decode blob: %w", err)
 	}
+	if items == nil {
+		items = make(map[string]Item)
+	}
 
 	r.registry.store = items
+	r.etag = info.ETag
 	return nil
 }
 
-func (r *StoreRegistry) Create(ctx context.Context, id string, value ItemData) error {
-	err := r.registry.Create(ctx, id, value)
+// ReloadOnChange reloads the registry whenever its blob is written by someone else, so instances
+// sharing a store see each other's changes without a conflict first. It fails with oops.NotSupported
+// when the store cannot watch and runs until ctx is done otherwise, failed reloads go to logger.
+func (r *StoreRegistry) ReloadOnChange(ctx context.Context, logger *slog.Logger) error {
+	watcher, ok := r.store.(storage.Watcher)
+	if !ok {
+		return oops.NotSupported
+	}
+	events, err := watcher.Watch(ctx, r.key)
 	if err != nil {
 		return err
 	}
-	return r.flush(ctx)
+	go func() {
+		for event := range events {
+			if event.Key != r.key && event.Type != storage.EventOverflow {
+				continue
+			}
+			r.mu.Lock()
+			if event.Type != storage.EventPut || event.ETag != r.etag {
+				if err := r.load(ctx); err != nil {
+					logger.ErrorContext(ctx, "Failed to reload registry", "key", r.key, "Error", err.Error())
+				}
+			}
+			r.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (r *StoreRegistry) Create(ctx context.Context, id string, value ItemData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.apply(ctx, func() error {
+		return r.registry.Create(ctx, id, value)
+	})
 }
 
 func (r *StoreRegistry) Read(ctx context.Context, id string) (Item, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.registry.Read(ctx, id)
 }
 
 func (r *StoreRegistry) List(ctx context.Context) ([]Item, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.registry.List(ctx)
 }
 
 func (r *StoreRegistry) Update(ctx context.Context, id string, value ItemData) error {
-	err := r.registry.Update(ctx, id, value)
-	if err != nil {
-		return err
-	}
-	return r.flush(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.apply(ctx, func() error {
+		return r.registry.Update(ctx, id, value)
+	})
 }
 
 func (r *StoreRegistry) Delete(ctx context.Context, id string) error {
-	err := r.registry.Delete(ctx, id)
-	if err != nil {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.apply(ctx, func() error {
+		return r.registry.Delete(ctx, id)
+	})
+}
+
+// apply runs mutate and flushes the result. When the flush fails the registry is rolled back,
+// so it never holds changes the store does not have.
+func (r *StoreRegistry) apply(ctx context.Context, mutate func() error) error {
+	snapshot := maps.Clone(r.registry.store)
+	if err := mutate(); err != nil {
 		return err
 	}
-	return r.flush(ctx)
+	err := r.flush(ctx)
+	if err != nil && !errors.Is(err, oops.Conflict) {
+		r.registry.store = snapshot
+	}
+	return err
 }
 
+// flush writes the registry only if the blob is still the version that was loaded last.
+// When another instance got there first the local change is dropped in favour of the stored state,
+// and the caller gets oops.Conflict to retry against it.
 func (r *StoreRegistry) flush(ctx context.Context) error {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(r.registry.store)
@@ -84,5 +152,17 @@ func (r *StoreRegistry) flush(ctx context.Context) error {
 		return fmt.Errorf("failed to encode blob: %w", err)
 	}
 
-	return r.store.Put(ctx, r.key, &buf, nil)
+	cond := storage.Precondition{IfMatch: r.etag, IfNoneMatch: r.etag == ""}
+	etag, err := r.store.PutIf(ctx, r.key, &buf, nil, cond)
+	if errors.Is(err, oops.Conflict) {
+		if loadErr := r.load(ctx); loadErr != nil {
+			return errors.Join(err, loadErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	r.etag = etag
+	return nil
 }
@@ -0,0 +1,167 @@
+package items
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/storage/storagetest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreRegistry_ConcurrentInstances(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryBlobStore()
+	first := NewPersistentRegistry(store, "item/items.js")
+	second := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, first.Init())
+	require.NoError(t, second.Init())
+
+	require.NoError(t, first.Create(ctx, "id1", newImageData()))
+
+	err := second.Create(ctx, "id2", newImageData())
+	assert.ErrorIs(t, err, oops.Conflict)
+
+	items, err := second.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "id1", items[0].ID)
+
+	require.NoError(t, second.Create(ctx, "id2", newImageData()))
+	assert.ErrorIs(t, first.Delete(ctx, "id1"), oops.Conflict)
+
+	reloaded := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, reloaded.Init())
+	items, err = reloaded.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func TestStoreRegistry_RollsBackFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	store := storagetest.NewFaultyBlobStore(storage.NewInMemoryBlobStore(), 1)
+	registry := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, registry.Init())
+	require.NoError(t, registry.Create(ctx, "id1", newImageData()))
+
+	store.Inject(storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Fail})
+	assert.ErrorIs(t, registry.Create(ctx, "id2", newImageData()), oops.Unavailable)
+	assert.ErrorIs(t, registry.Delete(ctx, "id1"), oops.Unavailable)
+	items, err := registry.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "id1", items[0].ID)
+
+	store.Reset()
+	require.NoError(t, registry.Create(ctx, "id2", newImageData()))
+	items, err = registry.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func TestStoreRegistry_Compressed(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewInMemoryBlobStore()
+	store, err := storage.NewCompressingBlobStore(backend, []string{"*.js"})
+	require.NoError(t, err)
+	registry := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, registry.Init())
+	for i := range 20 {
+		require.NoError(t, registry.Create(ctx, fmt.Sprintf("id%d", i), newImageData()))
+	}
+
+	stored, err := backend.Stat(ctx, "item/items.js")
+	require.NoError(t, err)
+	info, err := store.Stat(ctx, "item/items.js")
+	require.NoError(t, err)
+	assert.Less(t, stored.Size, info.Size/2)
+
+	reloaded := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, reloaded.Init())
+	items, err := reloaded.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, items, 20)
+}
+
+func TestStoreRegistry_ReloadOnChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := storage.NewInMemoryBlobStore()
+	first := NewPersistentRegistry(store, "item/items.js")
+	second := NewPersistentRegistry(store, "item/items.js")
+	require.NoError(t, first.Init())
+	require.NoError(t, second.Init())
+	require.NoError(t, second.ReloadOnChange(ctx, slog.Default()))
+
+	require.NoError(t, first.Create(ctx, "id1", newImageData()))
+	assert.Eventually(t, func() bool {
+		_, err := second.Read(ctx, "id1")
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.NoError(t, second.Create(ctx, "id2", newImageData()), "a reloaded registry writes without a conflict")
+
+	unwatched := NewPersistentRegistry(&struct{ storage.BlobStore }{store}, "item/items.js")
+	assert.ErrorIs(t, unwatched.ReloadOnChange(ctx, slog.Default()), oops.NotSupported)
+}
+
+func registryIDs(t *testing.T, registry Registry) []string {
+	t.Helper()
+	items, err := registry.List(context.Background())
+	require.NoError(t, err)
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestStoreRegistry_FlushFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		fault  storagetest.Fault
+		stored []string
+	}{
+		{"write fails", storagetest.Fault{Action: storagetest.Fail}, []string{"id1"}},
+		{"write truncated", storagetest.Fault{Action: storagetest.Truncate, Bytes: 10}, []string{"id1"}},
+		{"write times out", storagetest.Fault{Action: storagetest.Delay, Delay: time.Second}, []string{"id1"}},
+		{"reply lost", storagetest.Fault{Action: storagetest.FailAfter}, []string{"id1", "id2"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := storage.NewInMemoryBlobStore()
+			store := storagetest.NewFaultyBlobStore(backend, int64(i))
+			registry := NewPersistentRegistry(store, "item/items.js")
+			require.NoError(t, registry.Init())
+			require.NoError(t, registry.Create(ctx, "id1", newImageData()))
+
+			tt.fault.Op, tt.fault.Key, tt.fault.Times = storagetest.OpPut, "item/items.js", 1
+			store.Inject(tt.fault)
+			timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			require.Error(t, registry.Create(timeout, "id2", newImageData()))
+			assert.Equal(t, []string{"id1"}, registryIDs(t, registry), "a failed flush is rolled back")
+			stored := NewPersistentRegistry(backend, "item/items.js")
+			require.NoError(t, stored.Init(), "the stored registry is readable")
+			assert.Equal(t, tt.stored, registryIDs(t, stored))
+
+			// the next write either succeeds or conflicts with and adopts what was stored
+			err := registry.Create(ctx, "id3", newImageData())
+			if errors.Is(err, oops.Conflict) {
+				err = registry.Create(ctx, "id3", newImageData())
+			}
+			require.NoError(t, err)
+			require.NoError(t, stored.Init())
+			assert.Equal(t, registryIDs(t, stored), registryIDs(t, registry))
+			assert.Contains(t, registryIDs(t, registry), "id3")
+		})
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime/debug"
 	"simplicity/config"
 	"simplicity/genid"
@@ -16,6 +21,8 @@ import (
 	"simplicity/loggers"
 	"simplicity/storage"
 	"simplicity/svc"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -25,6 +32,16 @@ func main() {
 	}
 	logger := loggers.NewLogger(conf)
 	slog.SetDefault(logger)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(conf, os.Args[2:]))
+		case "backup":
+			os.Exit(runBackup(conf, os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(conf, os.Args[2:]))
+		}
+	}
 	if conf.EnableDebug {
 		go func() {
 			logger.Debug("Starting pprof server", "Port", "6060")
@@ -36,27 +53,56 @@ func main() {
 	buildInfo, _ := debug.ReadBuildInfo()
 	logger.Debug("Build info", "Version", buildInfo.Main.Version, "Path", buildInfo.Main.Path, "GoVersion", buildInfo.GoVersion, "Settings", buildInfo.Settings)
 
-	//store := storage.NewInMemoryBlobStore()
-	s3Client, err := setupS3Client(conf)
+	stack, err := setupStore(conf)
+	if err != nil {
+		panic(fmt.Errorf("cannot create storage: %w", err))
+	}
+	registryStore, err := storage.NewCompressingBlobStore(stack.store, conf.Compression.Patterns)
 	if err != nil {
-		panic(fmt.Errorf("cannot create S3 client: %w", err))
+		panic(fmt.Errorf("cannot create storage: %w", err))
 	}
-	store := storage.NewS3BlobStore(s3Client, conf.AWS.Bucket)
-	registry := items.NewPersistentRegistry(store, "item/items.js")
+	registry := items.NewPersistentRegistry(registryStore, "item/items.js")
 	err = registry.Init()
 	if err != nil {
 		panic(fmt.Errorf("cannot init registry: %w", err))
 	}
+	if conf.Storage.Watch {
+		if err = registry.ReloadOnChange(context.Background(), logger); err != nil {
+			logger.Warn("Registry cannot follow changes", "Error", err.Error())
+		}
+	}
 
-	handler := svc.NewLoggingMiddleware(setupServer(registry, store, conf, logger), logger)
+	if stack.janitor != nil {
+		stack.janitor.Start()
+	}
+	if stack.quota != nil {
+		stack.quota.Start()
+	}
+	handler := svc.NewLoggingMiddleware(setupServer(registry, stack, conf, logger), logger)
 
 	//populateWithMockData(registry, mux)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":" + conf.Server.Port, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
 	logger.Info("Starting backend service", "Port", conf.Server.Port)
-	http.ListenAndServe(":"+conf.Server.Port, handler)
+	if err = server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Backend service failed", "Error", err.Error())
+	}
+	stack.close(logger)
 }
 
-func setupServer(registry items.Registry, store storage.BlobStore, conf *config.Config, logger *slog.Logger) http.Handler {
+// shutdownTimeout bounds how long requests in flight may finish once the service is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+func setupServer(registry items.Registry, stack storeStack, conf *config.Config, logger *slog.Logger) http.Handler {
+	store := stack.store
 	idProvider, err := genid.NewSnowflakeProvider(1)
 	if err != nil {
 		panic(err)
@@ -64,7 +110,34 @@ func setupServer(registry items.Registry, store storage.BlobStore, conf *config.
 	mux := http.NewServeMux()
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("../ui/"))))
 	mux.Handle("/api/item/", http.StripPrefix("/api/item", items.NewApi(registry, idProvider, logger)))
-	mux.Handle("/api/image/", http.StripPrefix("/api/image", images.NewApi(store, idProvider, logger)))
+	imageStore := store
+	if conf.Cache.MaxBytes > 0 {
+		cache, err := storage.NewCachingBlobStore(store, storage.CacheOptions{
+			MaxBytes:       conf.Cache.MaxBytes,
+			MaxObjectBytes: conf.Cache.MaxObjectBytes,
+			MaxAge:         time.Duration(conf.Cache.MaxAgeSeconds) * time.Second,
+			DiskPath:       conf.Cache.DiskPath,
+			DiskMaxBytes:   conf.Cache.DiskMaxBytes,
+			Prefixes:       conf.Cache.Prefixes,
+		})
+		if err != nil {
+			panic(err)
+		}
+		imageStore = cache
+		if conf.Storage.Watch {
+			if err = cache.InvalidateOnChange(context.Background()); err != nil {
+				logger.Warn("Image cache cannot follow changes", "Error", err.Error())
+			}
+		}
+		stack.cache = cache
+	}
+	mux.Handle("/api/image/", http.StripPrefix("/api/image", images.NewApi(imageStore, idProvider, logger)))
+	if signer, ok := store.(*storage.URLSigner); ok {
+		mux.Handle(signedURLPath+"/", http.StripPrefix(signedURLPath, signer))
+	}
+	if conf.Admin.Token != "" {
+		mux.Handle("/api/admin/", svc.NewTokenMiddleware(http.StripPrefix("/api/admin", newAdminApi(stack, logger)), conf.Admin.Token))
+	}
 	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
 		svc.Data(w, r, conf.BackendVersion, http.StatusOK)
 	})
@@ -72,13 +145,201 @@ func setupServer(registry items.Registry, store storage.BlobStore, conf *config.
 	return mux
 }
 
+// signedURLPath serves the presigned URLs of stores that S3 does not sign for.
+const signedURLPath = "/api/storage/signed"
+
+// storeStack is the store the services use and the parts of it that have admin endpoints,
+// the mirror is nil without replicas, the quota and janitor without rules and the image cache when it is off.
+// The backend is the store below the decorators, the mirror when there is one, which backups read and restores
+// write like the CLI does.
+type storeStack struct {
+	store     storage.BlobStore
+	backend   storage.BlobStore
+	mirror    *storage.MirroredBlobStore
+	quota     *storage.QuotaBlobStore
+	checksums *storage.ChecksumBlobStore
+	janitor   *storage.Janitor
+	cache     *storage.CachingBlobStore
+}
+
+// close stops the janitor, saves the usage counters and lets the mirror apply its queued writes,
+// in this order since the counters are saved through the mirror.
+func (s storeStack) close(logger *slog.Logger) {
+	if s.janitor != nil {
+		s.janitor.Close()
+	}
+	if s.quota != nil {
+		if err := s.quota.Close(); err != nil {
+			logger.Error("Saving storage usage failed", "Error", err.Error())
+		}
+	}
+	if s.mirror != nil {
+		s.mirror.Close()
+		for i, replica := range s.mirror.Stats().Replicas {
+			if replica.Unrepaired > 0 {
+				logger.Warn("Replica keys left unrepaired", "Replica", i, "Unrepaired", replica.Unrepaired)
+			}
+		}
+	}
+}
+
+// setupStore stacks the store: backend, mirror, quota, checksums, encryption and, when the result cannot presign itself,
+// signed URLs served here.
+func setupStore(conf *config.Config) (storeStack, error) {
+	var stack storeStack
+	store, err := setupBackend(conf, conf.Storage.Backend, conf.Storage.Path, conf.AWS.Bucket)
+	if err != nil {
+		return stack, err
+	}
+	if len(conf.Mirror.Replicas) > 0 {
+		if stack.mirror, err = setupMirror(store, conf); err != nil {
+			return stack, err
+		}
+		store = stack.mirror
+	}
+	stack.backend = store
+	if len(conf.Quota.Rules) > 0 {
+		if stack.quota, err = setupQuota(store, conf); err != nil {
+			return stack, err
+		}
+		store = stack.quota
+	}
+	stack.checksums = storage.NewChecksumBlobStore(store)
+	store = stack.checksums
+	if conf.Encryption.CurrentKeyID != "" {
+		if store, err = setupEncryption(store, conf); err != nil {
+			return stack, err
+		}
+	}
+	if _, ok := store.(storage.Presigner); !ok {
+		store = storage.NewURLSigner(store, signedURLPath, []byte(conf.Storage.SigningSecret), conf.Storage.SignedPutMaxBytes)
+	}
+	stack.store = store
+	if len(conf.Janitor.Rules) > 0 {
+		stack.janitor = setupJanitor(store, conf)
+	}
+	return stack, nil
+}
+
+func setupQuota(store storage.BlobStore, conf *config.Config) (*storage.QuotaBlobStore, error) {
+	rules := make([]storage.QuotaRule, 0, len(conf.Quota.Rules))
+	for _, rule := range conf.Quota.Rules {
+		rules = append(rules, storage.QuotaRule{
+			Prefix:     rule.Prefix,
+			SoftBytes:  rule.SoftBytes,
+			HardBytes:  rule.HardBytes,
+			MaxObjects: rule.MaxObjects,
+		})
+	}
+	quota, err := storage.NewQuotaBlobStore(context.Background(), store, storage.QuotaOptions{
+		Rules:        rules,
+		StateKey:     conf.Quota.StateKey,
+		SaveInterval: time.Duration(conf.Quota.SaveIntervalSeconds) * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot account storage usage: %w", err)
+	}
+	return quota, nil
+}
+
+func setupJanitor(store storage.BlobStore, conf *config.Config) *storage.Janitor {
+	rules := make([]storage.LifecycleRule, 0, len(conf.Janitor.Rules))
+	for _, rule := range conf.Janitor.Rules {
+		rules = append(rules, storage.LifecycleRule{
+			Prefix: rule.Prefix,
+			MaxAge: time.Duration(rule.MaxAgeDays) * 24 * time.Hour,
+		})
+	}
+	return storage.NewJanitor(store, storage.JanitorOptions{
+		Rules:    rules,
+		Interval: time.Duration(conf.Janitor.IntervalMinutes) * time.Minute,
+		DryRun:   conf.Janitor.DryRun,
+	}, slog.Default())
+}
+
+func setupBackend(conf *config.Config, backend string, path string, bucket string) (storage.BlobStore, error) {
+	switch backend {
+	case "memory":
+		return storage.NewInMemoryBlobStore(), nil
+	case "disk":
+		return storage.NewDiskBlobStore(path)
+	case "s3", "":
+		s3Client, err := setupS3Client(conf)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create S3 client: %w", err)
+		}
+		return storage.NewResilientBlobStore(storage.NewS3BlobStore(s3Client, bucket), storage.RetryOptions{
+			MaxAttempts:      conf.Retry.MaxAttempts,
+			BaseDelay:        time.Duration(conf.Retry.BaseDelayMillis) * time.Millisecond,
+			MaxDelay:         time.Duration(conf.Retry.MaxDelayMillis) * time.Millisecond,
+			FailureThreshold: conf.Retry.FailureThreshold,
+			OpenTimeout:      time.Duration(conf.Retry.OpenTimeoutSeconds) * time.Second,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+func setupMirror(primary storage.BlobStore, conf *config.Config) (*storage.MirroredBlobStore, error) {
+	replicas := make([]storage.BlobStore, 0, len(conf.Mirror.Replicas))
+	for i, replica := range conf.Mirror.Replicas {
+		store, err := setupBackend(conf, replica.Backend, replica.Path, replica.Bucket)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create replica %d: %w", i, err)
+		}
+		replicas = append(replicas, store)
+	}
+	return storage.NewMirroredBlobStore(primary, replicas, storage.MirrorOptions{
+		Async:     conf.Mirror.Async,
+		QueueSize: conf.Mirror.QueueSize,
+	}), nil
+}
+
+func setupEncryption(store storage.BlobStore, conf *config.Config) (storage.BlobStore, error) {
+	keys := make(map[string][]byte, len(conf.Encryption.Keys))
+	for id, encoded := range conf.Encryption.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode encryption key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	encrypting, err := storage.NewEncryptingBlobStore(store, keys, conf.Encryption.CurrentKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Encryption.RotateOnStart {
+		go func() {
+			rotated, err := encrypting.Rotate(context.Background(), "")
+			if err != nil {
+				slog.Default().Error("Key rotation failed", "Rotated", rotated, "Error", err.Error())
+				return
+			}
+			slog.Default().Info("Key rotation finished", "Rotated", rotated)
+		}()
+	}
+	return encrypting, nil
+}
+
 func setupS3Client(conf *config.Config) (*s3.Client, error) {
-	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(),
-		awsconfig.WithSharedConfigProfile(conf.AWS.Profile),
-	)
+	var opts []func(*awsconfig.LoadOptions) error
+	if conf.AWS.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(conf.AWS.Profile))
+	}
+	if conf.AWS.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(conf.AWS.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return s3.NewFromConfig(cfg), nil
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// retries happen in storage.ResilientBlobStore, SDK retries below it would multiply the attempts
+		o.Retryer = aws.NopRetryer{}
+		if conf.AWS.Endpoint != "" {
+			o.BaseEndpoint = aws.String(conf.AWS.Endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
 }
@@ -26,7 +26,7 @@ func runTestServer() *httptest.Server {
 	registry := items.NewInMemoryRegistry(func() time.Time {
 		return testTimestamp
 	})
-	return httptest.NewServer(setupServer(registry, storage.NewInMemoryBlobStore(), &config.Config{}, slog.Default()))
+	return httptest.NewServer(setupServer(registry, storeStack{store: storage.NewInMemoryBlobStore()}, &config.Config{}, slog.Default()))
 }
 
 type Request struct {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"simplicity/config"
+	"simplicity/storage"
+	"strings"
+)
+
+// runMigrate implements `backend migrate [flags] <source> <destination>` and returns the exit code.
+// An interrupted migration is resumed by running it again with the same -journal, source and destination.
+func runMigrate(conf *config.Config, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "only migrate keys under this prefix")
+	workers := flags.Int("workers", 4, "objects copied in parallel")
+	dryRun := flags.Bool("dry-run", false, "list what would be copied without writing")
+	journal := flags.String("journal", "migrate.journal", "file recording migrated keys, empty to copy everything again")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: backend migrate [flags] <source> <destination>")
+		fmt.Fprintln(flags.Output(), "Stores are disk:<path> or s3://<bucket>[/<prefix>]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	for _, uri := range flags.Args() {
+		if isMemoryURI(uri) {
+			fmt.Fprintf(os.Stderr, "cannot migrate %s: memory stores do not outlive the command\n", uri)
+			return 2
+		}
+	}
+	src, err := openStoreURI(conf, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open source: %v\n", err)
+		return 1
+	}
+	dst, err := openStoreURI(conf, flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open destination: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := storage.Migrate(ctx, src, dst, storage.MigrateOptions{
+		Prefix:      *prefix,
+		Workers:     *workers,
+		DryRun:      *dryRun,
+		Journal:     *journal,
+		Source:      flags.Arg(0),
+		Destination: flags.Arg(1),
+	})
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// openStoreURI opens the store a URI names, the schemes are the Storage.Backend names of the config.
+// A disk path may be written disk:./data, disk://data or disk:///var/data. The path of an s3 URI
+// is a key prefix inside the bucket.
+func openStoreURI(conf *config.Config, uri string) (storage.BlobStore, error) {
+	backend, path, bucket, prefix, err := parseStoreURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	store, err := setupBackend(conf, backend, path, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		namespaced, err := storage.NewNamespacedBlobStore(store, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid store URI %q: %w", uri, err)
+		}
+		return namespaced, nil
+	}
+	return store, nil
+}
+
+// isMemoryURI tells whether uri names a memory store, which is empty when a command starts and gone when it exits.
+func isMemoryURI(uri string) bool {
+	backend, _, _, _, err := parseStoreURI(uri)
+	return err == nil && backend == "memory"
+}
+
+func parseStoreURI(uri string) (backend string, path string, bucket string, prefix string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("invalid store URI %q: %w", uri, err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return "memory", "", "", "", nil
+	case "disk":
+		path = u.Opaque
+		if path == "" {
+			path = u.Host + u.Path
+		}
+		if path == "" {
+			return "", "", "", "", fmt.Errorf("store URI %q has no path", uri)
+		}
+		return "disk", path, "", "", nil
+	case "s3":
+		if u.Host == "" {
+			return "", "", "", "", fmt.Errorf("store URI %q has no bucket", uri)
+		}
+		prefix = strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return "s3", "", u.Host, prefix, nil
+	default:
+		return "", "", "", "", fmt.Errorf("unknown store URI scheme %q, want memory, disk or s3", u.Scheme)
+	}
+}
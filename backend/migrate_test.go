@@ -0,0 +1,44 @@
+package main
+
+import (
+	"simplicity/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseStoreURI(t *testing.T) {
+	tests := []struct {
+		uri     string
+		backend string
+		path    string
+		bucket  string
+		prefix  string
+	}{
+		{"memory:", "memory", "", "", ""},
+		{"disk:./data", "disk", "./data", "", ""},
+		{"disk://data/images", "disk", "data/images", "", ""},
+		{"disk:///var/data", "disk", "/var/data", "", ""},
+		{"s3://bucket", "s3", "", "bucket", ""},
+		{"s3://bucket/backup", "s3", "", "bucket", "backup/"},
+	}
+	for _, tt := range tests {
+		backend, path, bucket, prefix, err := parseStoreURI(tt.uri)
+		if assert.NoError(t, err, tt.uri) {
+			assert.Equal(t, []string{tt.backend, tt.path, tt.bucket, tt.prefix}, []string{backend, path, bucket, prefix}, tt.uri)
+		}
+	}
+
+	for _, uri := range []string{"disk:", "s3:///prefix", "ftp://host", "::"} {
+		_, _, _, _, err := parseStoreURI(uri)
+		assert.Error(t, err, uri)
+	}
+}
+
+func Test_runMigrateRejectsMemory(t *testing.T) {
+	conf := &config.Config{}
+	disk := "disk:" + t.TempDir()
+	assert.Equal(t, 2, runMigrate(conf, []string{"-journal", "", "memory:", disk}))
+	assert.Equal(t, 2, runMigrate(conf, []string{"-journal", "", disk, "memory:"}))
+	assert.Equal(t, 0, runMigrate(conf, []string{"-journal", "", disk, "disk:" + t.TempDir()}))
+}
@@ -6,3 +6,11 @@ var InvalidKey = errors.New("invalid key")
 var KeyNotFound = errors.New("key not found")
 var KeyAlreadyExists = errors.New("key already exists")
 var ValidationError = errors.New("validation error")
+var Conflict = errors.New("conflict")
+var InvalidRange = errors.New("invalid range")
+var NotSupported = errors.New("not supported")
+var TooLarge = errors.New("too large")
+var Unavailable = errors.New("unavailable")
+var Corrupted = errors.New("corrupted")
+var Unauthorized = errors.New("unauthorized")
+var QuotaExceeded = errors.New("quota exceeded")
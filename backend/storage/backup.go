@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"simplicity/oops"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is a tar archive, gzipped or not. Every object is an entry under objectsDir whose PAX records
+// hold its metadata, the content type is sniffed again on restore. The manifest comes last because
+// it holds the checksums of the objects streamed before it, so Restore spools the archive to a temp
+// file and checks it against the manifest before it writes anything.
+const (
+	backupVersion     = 1
+	objectsDir        = "objects/"
+	manifestName      = "manifest.json"
+	paxMetadataPrefix = "SIMPLICITY.meta."
+)
+
+// BackupOptions select the objects under Prefix, Compress gzips the archive.
+type BackupOptions struct {
+	Prefix   string
+	Compress bool
+}
+
+type BackupManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Prefix    string         `json:"prefix"`
+	Objects   []BackupObject `json:"objects"`
+	Bytes     int64          `json:"bytes"`
+}
+
+type BackupObject struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ConflictPolicy decides what Restore does with keys the destination already has.
+type ConflictPolicy string
+
+const (
+	// RestoreEmpty refuses to restore into a store that has any object.
+	RestoreEmpty ConflictPolicy = "empty"
+	// RestoreSkip keeps the objects of the destination.
+	RestoreSkip ConflictPolicy = "skip"
+	// RestoreOverwrite replaces them with the backed up ones.
+	RestoreOverwrite ConflictPolicy = "overwrite"
+)
+
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(value); policy {
+	case RestoreEmpty, RestoreSkip, RestoreOverwrite:
+		return policy, nil
+	case "":
+		return RestoreEmpty, nil
+	default:
+		return "", fmt.Errorf("%w: unknown conflict policy %q, want empty, skip or overwrite", oops.ValidationError, value)
+	}
+}
+
+// RestoreReport counts what Restore did. Corrupted objects do not match the manifest and Missing ones
+// are in the manifest but not in the archive, with any of them nothing is restored.
+type RestoreReport struct {
+	Restored  int      `json:"restored"`
+	Skipped   int      `json:"skipped"`
+	Bytes     int64    `json:"bytes"`
+	Corrupted []string `json:"corrupted"`
+	Missing   []string `json:"missing"`
+}
+
+// Backup streams every object under opts.Prefix into w. Objects are read one after the other,
+// so each is consistent but the archive is not a snapshot of a store that is being written.
+func Backup(ctx context.Context, store BlobStore, w io.Writer, opts BackupOptions) (BackupManifest, error) {
+	manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now().UTC(), Prefix: opts.Prefix, Objects: make([]BackupObject, 0)}
+	var compressed *gzip.Writer
+	if opts.Compress {
+		compressed = gzip.NewWriter(w)
+		w = compressed
+	}
+	archive := tar.NewWriter(w)
+
+	err := listObjects(ctx, store, opts.Prefix, func(result ListResult) error {
+		object, err := backupObject(ctx, store, archive, result.Key, manifest.CreatedAt)
+		if errors.Is(err, oops.KeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", result.Key, err)
+		}
+		manifest.Objects = append(manifest.Objects, object)
+		manifest.Bytes += object.Size
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	header := &tar.Header{Name: manifestName, Mode: 0o644, Size: int64(len(data)), ModTime: manifest.CreatedAt, Format: tar.FormatPAX}
+	if err = archive.WriteHeader(header); err != nil {
+		return manifest, err
+	}
+	if _, err = archive.Write(data); err != nil {
+		return manifest, err
+	}
+	if err = archive.Close(); err != nil {
+		return manifest, err
+	}
+	if compressed != nil {
+		err = compressed.Close()
+	}
+	return manifest, err
+}
+
+func backupObject(ctx context.Context, store BlobStore, archive *tar.Writer, key string, now time.Time) (BackupObject, error) {
+	reader, info, err := store.Get(ctx, key)
+	if err != nil {
+		return BackupObject{}, err
+	}
+	defer reader.Close()
+	records := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		records[paxMetadataPrefix+k] = v
+	}
+	modTime := info.LastModified
+	if modTime.IsZero() {
+		modTime = now
+	}
+	header := &tar.Header{
+		Name:       objectsDir + key,
+		Mode:       0o644,
+		Size:       info.Size,
+		ModTime:    modTime,
+		PAXRecords: records,
+		Format:     tar.FormatPAX,
+	}
+	if err = archive.WriteHeader(header); err != nil {
+		return BackupObject{}, err
+	}
+	hashing := newHashingReader(reader)
+	if _, err = io.Copy(archive, hashing); err != nil {
+		return BackupObject{}, err
+	}
+	return BackupObject{Key: key, Size: hashing.size, SHA256: hex.EncodeToString(hashing.hash.Sum(nil))}, nil
+}
+
+// Restore writes the objects of a backup, gzipped or not, into store. The archive is read to the end and
+// checked against its manifest first, an archive that is cut off, lacks the manifest or disagrees with it
+// fails without writing anything. It is spooled to a file of the temp directory meanwhile.
+func Restore(ctx context.Context, store BlobStore, r io.Reader, policy ConflictPolicy) (RestoreReport, error) {
+	report := RestoreReport{Corrupted: make([]string, 0), Missing: make([]string, 0)}
+	tarball, err := openArchive(r)
+	if err != nil {
+		return report, err
+	}
+	spool, err := os.CreateTemp("", "restore-*.tar")
+	if err != nil {
+		return report, fmt.Errorf("failed to spool archive: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if err = verifyArchive(tar.NewReader(io.TeeReader(tarball, spool)), &report); err != nil {
+		return report, err
+	}
+	if policy == RestoreEmpty {
+		if err = requireEmpty(ctx, store); err != nil {
+			return report, err
+		}
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return report, fmt.Errorf("failed to read spooled archive: %w", err)
+	}
+	archive := tar.NewReader(spool)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read spooled archive: %w", err)
+		}
+		key, ok := strings.CutPrefix(header.Name, objectsDir)
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		object, skipped, err := restoreObject(ctx, store, archive, key, header, policy)
+		if err != nil {
+			return report, fmt.Errorf("failed to restore %s: %w", key, err)
+		}
+		if skipped {
+			report.Skipped++
+		} else {
+			report.Restored++
+			report.Bytes += object.Size
+		}
+	}
+}
+
+// verifyArchive reads archive to its end and compares the checksums of its objects with the manifest.
+func verifyArchive(archive *tar.Reader, report *RestoreReport) error {
+	sums := make(map[string]BackupObject)
+	var manifest *BackupManifest
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Name == manifestName {
+			if manifest, err = readManifest(archive); err != nil {
+				return err
+			}
+			continue
+		}
+		key, ok := strings.CutPrefix(header.Name, objectsDir)
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		hashing := newHashingReader(archive)
+		if _, err = io.Copy(io.Discard, hashing); err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		sums[key] = BackupObject{Key: key, Size: hashing.size, SHA256: hex.EncodeToString(hashing.hash.Sum(nil))}
+	}
+	if manifest == nil {
+		return fmt.Errorf("%w: archive has no manifest", oops.ValidationError)
+	}
+	for _, want := range manifest.Objects {
+		got, ok := sums[want.Key]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, want.Key)
+		case got != want:
+			report.Corrupted = append(report.Corrupted, want.Key)
+		}
+		delete(sums, want.Key)
+	}
+	for key := range sums {
+		report.Corrupted = append(report.Corrupted, key)
+	}
+	sort.Strings(report.Corrupted)
+	if len(report.Corrupted) > 0 || len(report.Missing) > 0 {
+		return fmt.Errorf("%w: %d objects differ from the manifest, %d are missing", oops.Corrupted, len(report.Corrupted), len(report.Missing))
+	}
+	return nil
+}
+
+// openArchive returns the tar stream of a plain or gzipped archive.
+func openArchive(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		return decompressed, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("%w: zstd compressed archives, decompress it first", oops.NotSupported)
+	default:
+		return buffered, nil
+	}
+}
+
+func readManifest(r io.Reader) (*BackupManifest, error) {
+	var manifest BackupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest: %w", oops.ValidationError, err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%w: backup version %d", oops.NotSupported, manifest.Version)
+	}
+	return &manifest, nil
+}
+
+func requireEmpty(ctx context.Context, store BlobStore) error {
+	page, err := store.ListPage(ctx, ListOptions{MaxKeys: 1})
+	if err != nil {
+		return err
+	}
+	if len(page.Results) > 0 {
+		return fmt.Errorf("%w: the destination is not empty, restore with the skip or overwrite policy", oops.Conflict)
+	}
+	return nil
+}
+
+// restoreObject writes one entry, a skipped one is only read for its checksum.
+func restoreObject(ctx context.Context, store BlobStore, r io.Reader, key string, header *tar.Header, policy ConflictPolicy) (BackupObject, bool, error) {
+	hashing := newHashingReader(r)
+	skipped := false
+	if policy == RestoreSkip {
+		_, err := store.Stat(ctx, key)
+		if err != nil && !errors.Is(err, oops.KeyNotFound) {
+			return BackupObject{}, false, err
+		}
+		skipped = err == nil
+	}
+	if skipped {
+		if _, err := io.Copy(io.Discard, hashing); err != nil {
+			return BackupObject{}, false, err
+		}
+	} else {
+		metadata := make(map[string]string)
+		for k, v := range header.PAXRecords {
+			if name, ok := strings.CutPrefix(k, paxMetadataPrefix); ok {
+				metadata[name] = v
+			}
+		}
+		if _, err := store.Put(ctx, key, hashing, metadata); err != nil {
+			return BackupObject{}, false, err
+		}
+	}
+	return BackupObject{Key: key, Size: hashing.size, SHA256: hex.EncodeToString(hashing.hash.Sum(nil))}, skipped, nil
+}
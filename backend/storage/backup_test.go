@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"simplicity/oops"
+	"strings"
+	"testing"
+)
+
+func newBackupSource(t *testing.T) BlobStore {
+	t.Helper()
+	store := NewInMemoryBlobStore()
+	objects := map[string]string{
+		"item/items.js":                      `{"items":[]}`,
+		"images/files/1/source.data":         "png data",
+		"images/deleted-files/2/source.data": "old data",
+	}
+	for key, data := range objects {
+		metadata := map[string]string{"extension": "png", "original_name": "ünïcode name.png"}
+		if _, err := store.Put(context.Background(), key, strings.NewReader(data), metadata); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	return store
+}
+
+func backup(t *testing.T, store BlobStore, opts BackupOptions) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	if _, err := Backup(context.Background(), store, &archive, opts); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	return archive.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	src := newBackupSource(t)
+	for _, compress := range []bool{false, true} {
+		var archive bytes.Buffer
+		manifest, err := Backup(ctx, src, &archive, BackupOptions{Compress: compress})
+		if err != nil || len(manifest.Objects) != 3 || manifest.Bytes != 28 || len(manifest.Objects[0].SHA256) != 64 {
+			t.Fatalf("Backup() = %+v, %v, want 3 objects", manifest, err)
+		}
+
+		dst, err := NewDiskBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewDiskBlobStore() error = %v", err)
+		}
+		report, err := Restore(ctx, dst, &archive, RestoreEmpty)
+		if err != nil || report.Restored != 3 || report.Bytes != 28 {
+			t.Fatalf("Restore() compressed %v = %+v, %v, want 3 objects", compress, report, err)
+		}
+		for _, object := range manifest.Objects {
+			want, _ := src.Stat(ctx, object.Key)
+			got, err := dst.Stat(ctx, object.Key)
+			if err != nil || !reflect.DeepEqual(got.Metadata, want.Metadata) || readString(t, dst, object.Key) != readString(t, src, object.Key) {
+				t.Errorf("restored %q = %+v, %v, want %+v", object.Key, got, err, want)
+			}
+		}
+	}
+}
+
+func TestBackup_Prefix(t *testing.T) {
+	archive := backup(t, newBackupSource(t), BackupOptions{Prefix: "images/files/"})
+	dst := NewInMemoryBlobStore()
+	if report, err := Restore(context.Background(), dst, bytes.NewReader(archive), RestoreEmpty); err != nil || report.Restored != 1 {
+		t.Errorf("Restore() = %+v, %v, want the prefix only", report, err)
+	}
+}
+
+func TestRestore_Policies(t *testing.T) {
+	ctx := context.Background()
+	archive := backup(t, newBackupSource(t), BackupOptions{})
+	newDestination := func() BlobStore {
+		dst := NewInMemoryBlobStore()
+		dst.Put(ctx, "item/items.js", strings.NewReader("newer"), nil)
+		return dst
+	}
+
+	dst := newDestination()
+	if _, err := Restore(ctx, dst, bytes.NewReader(archive), RestoreEmpty); !errors.Is(err, oops.Conflict) {
+		t.Errorf("Restore() into a store with objects error = %v, want %v", err, oops.Conflict)
+	}
+	if results, _ := dst.List(ctx, "", ""); len(results) != 1 {
+		t.Errorf("refused Restore() wrote %v", results)
+	}
+
+	dst = newDestination()
+	report, err := Restore(ctx, dst, bytes.NewReader(archive), RestoreSkip)
+	if err != nil || report.Restored != 2 || report.Skipped != 1 || readString(t, dst, "item/items.js") != "newer" {
+		t.Errorf("Restore() skipping = %+v, %v, want the existing object kept", report, err)
+	}
+
+	dst = newDestination()
+	report, err = Restore(ctx, dst, bytes.NewReader(archive), RestoreOverwrite)
+	if err != nil || report.Restored != 3 || readString(t, dst, "item/items.js") != `{"items":[]}` {
+		t.Errorf("Restore() overwriting = %+v, %v, want the backed up object", report, err)
+	}
+
+	if _, err := ParseConflictPolicy("merge"); !errors.Is(err, oops.ValidationError) {
+		t.Errorf("ParseConflictPolicy() of an unknown policy error = %v", err)
+	}
+}
+
+// rewriteArchive copies a plain archive, changing the body of every object entry with edit
+// and leaving out the entries edit drops.
+func rewriteArchive(t *testing.T, archive []byte, edit func(name string, data []byte) ([]byte, bool)) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	reader, writer := tar.NewReader(bytes.NewReader(archive)), tar.NewWriter(&out)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		data, keep := edit(header.Name, data)
+		if !keep {
+			continue
+		}
+		header.Size = int64(len(data))
+		writer.WriteHeader(header)
+		writer.Write(data)
+	}
+	writer.Close()
+	return out.Bytes()
+}
+
+func TestRestore_Verification(t *testing.T) {
+	ctx := context.Background()
+	archive := backup(t, newBackupSource(t), BackupOptions{})
+	restore := func(archive []byte) (RestoreReport, error) {
+		t.Helper()
+		dst := NewInMemoryBlobStore()
+		report, err := Restore(ctx, dst, bytes.NewReader(archive), RestoreEmpty)
+		if results, _ := dst.List(ctx, "", ""); len(results) != 0 {
+			t.Errorf("Restore() of a broken archive wrote %v", results)
+		}
+		return report, err
+	}
+
+	corrupted := rewriteArchive(t, archive, func(name string, data []byte) ([]byte, bool) {
+		if name == objectsDir+"images/files/1/source.data" {
+			data[0] ^= 1
+		}
+		return data, true
+	})
+	report, err := restore(corrupted)
+	if !errors.Is(err, oops.Corrupted) || !reflect.DeepEqual(report.Corrupted, []string{"images/files/1/source.data"}) {
+		t.Errorf("Restore() of a corrupted archive = %+v, %v, want the object reported", report, err)
+	}
+
+	missing := rewriteArchive(t, archive, func(name string, data []byte) ([]byte, bool) {
+		return data, name != objectsDir+"item/items.js"
+	})
+	report, err = restore(missing)
+	if !errors.Is(err, oops.Corrupted) || !reflect.DeepEqual(report.Missing, []string{"item/items.js"}) {
+		t.Errorf("Restore() of an archive without an object = %+v, %v, want it reported missing", report, err)
+	}
+
+	withoutManifest := rewriteArchive(t, archive, func(name string, data []byte) ([]byte, bool) {
+		return data, name != manifestName
+	})
+	if _, err = restore(withoutManifest); !errors.Is(err, oops.ValidationError) {
+		t.Errorf("Restore() without a manifest error = %v, want %v", err, oops.ValidationError)
+	}
+
+	// an upload cut off in the middle ends within an object, long before the manifest
+	if _, err = restore(archive[:len(archive)/3]); err == nil {
+		t.Error("Restore() of a truncated archive error = nil")
+	}
+	compressed := backup(t, newBackupSource(t), BackupOptions{Compress: true})
+	if _, err = restore(compressed[:len(compressed)/2]); err == nil {
+		t.Error("Restore() of a truncated gzipped archive error = nil")
+	}
+
+	zstd := []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}
+	if _, err = restore(zstd); !errors.Is(err, oops.NotSupported) {
+		t.Errorf("Restore() of a zstd archive error = %v, want %v", err, oops.NotSupported)
+	}
+}
@@ -2,8 +2,15 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"simplicity/oops"
+	"sort"
 	"strings"
+	"time"
 )
 
 type ListResult struct {
@@ -12,19 +19,302 @@ type ListResult struct {
 	Size     int
 }
 
+// ObjectInfo describes a stored object. ETag is an opaque version token, it changes whenever
+// the object content changes and is what PutIf compares against.
+// ContentType is sniffed from the first bytes of the content when the object is stored.
+type ObjectInfo struct {
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+	ETag         string
+	Metadata     map[string]string
+}
+
+// Precondition guards PutIf. IfMatch replaces the object only while its current ETag is the given one
+// (compare-and-swap), IfNoneMatch only creates the object when the key is not taken yet.
+// A failed precondition is reported as oops.Conflict.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch bool
+}
+
+// ListOptions selects one page of a listing. Keys come back in lexicographic order,
+// starting after StartAfter or the position encoded in ContinuationToken, whichever is further.
+type ListOptions struct {
+	Prefix            string
+	Delimiter         string
+	StartAfter        string
+	ContinuationToken string
+	MaxKeys           int
+}
+
+// ListPage holds objects and common prefixes of one page in key order.
+// NextToken is empty on the last page.
+type ListPage struct {
+	Results   []ListResult
+	NextToken string
+}
+
 const Delimiter = "/"
 
+const DefaultMaxKeys = 1000
+
 type BlobStore interface {
 	List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error)
-	Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error)
-	Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error
+	ListPage(ctx context.Context, opts ListOptions) (ListPage, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error)
+	PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error)
+	Copy(ctx context.Context, src string, dst string, metadata map[string]string) error
+	Move(ctx context.Context, src string, dst string, metadata map[string]string) error
 	Delete(ctx context.Context, key string) error
+	DeleteMany(ctx context.Context, keys []string) error
 	DeleteAll(ctx context.Context, prefix string) error
 }
 
+// Presigner hands out URLs that allow a single GET or PUT of key without further credentials
+// until the ttl runs out, so clients can move object bytes without passing them through the backend.
+// A PUT URL is signed for a body of size bytes: S3 refuses any other length, the URLSigner larger ones.
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+	PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error)
+}
+
+// DeleteError is returned by DeleteMany when some of the keys could not be removed,
+// every other key of the batch is gone. Missing keys are not an error.
+type DeleteError struct {
+	Failed map[string]error
+}
+
+func (e *DeleteError) Error() string {
+	keys := make([]string, 0, len(e.Failed))
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("failed to delete %d keys, first %s: %v", len(keys), keys[0], e.Failed[keys[0]])
+}
+
+// deleteBatchSize matches the most keys S3 accepts in one DeleteObjects call.
+const deleteBatchSize = 1000
+
 func JoinPath(elem ...string) string {
 	if len(elem) == 0 {
 		return ""
 	}
 	return strings.Join(elem, Delimiter)
 }
+
+// checkPrecondition validates cond against the ETag of the current object, exists tells whether there is one.
+func checkPrecondition(cond Precondition, etag string, exists bool) error {
+	if cond.IfNoneMatch && exists {
+		return oops.Conflict
+	}
+	if cond.IfMatch != "" && (!exists || cond.IfMatch != etag) {
+		return oops.Conflict
+	}
+	return nil
+}
+
+// deleteAll removes every object under prefix page by page through DeleteMany.
+// Failures of single keys are collected, the rest of the prefix is still removed.
+func deleteAll(ctx context.Context, store BlobStore, prefix string) error {
+	if prefix == "" {
+		return oops.InvalidKey
+	}
+	if !strings.HasSuffix(prefix, Delimiter) {
+		prefix += Delimiter
+	}
+	failed := make(map[string]error)
+	opts := ListOptions{Prefix: prefix, MaxKeys: deleteBatchSize}
+	for {
+		page, err := store.ListPage(ctx, opts)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(page.Results))
+		for _, result := range page.Results {
+			keys = append(keys, result.Key)
+		}
+		var deleteErr *DeleteError
+		if err = store.DeleteMany(ctx, keys); errors.As(err, &deleteErr) {
+			for key, keyErr := range deleteErr.Failed {
+				failed[key] = keyErr
+			}
+		} else if err != nil {
+			return err
+		}
+		if page.NextToken == "" {
+			break
+		}
+		opts.ContinuationToken = page.NextToken
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
+	}
+	return nil
+}
+
+// CopyBetween streams an object with its metadata from one store into another.
+// It is the fallback when the data has to pass through the backend.
+func CopyBetween(ctx context.Context, src BlobStore, srcKey string, dst BlobStore, dstKey string) error {
+	reader, info, err := src.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = dst.Put(ctx, dstKey, reader, info.Metadata)
+	return err
+}
+
+// resolveRange clamps a GetRange request to an object of the given size. A length of zero
+// or less reads to the end. Only an empty object can be read from offset zero onwards.
+func resolveRange(offset int64, length int64, size int64) (int64, error) {
+	if offset < 0 || offset > size || offset == size && size > 0 {
+		return 0, oops.InvalidRange
+	}
+	if length <= 0 || offset+length > size {
+		length = size - offset
+	}
+	return length, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sniffWriter keeps the first bytes written through it for content type detection.
+type sniffWriter struct {
+	head []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(w.head); n > 0 {
+		w.head = append(w.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (w *sniffWriter) ContentType() string {
+	return http.DetectContentType(w.head)
+}
+
+// sniffLen is the most http.DetectContentType looks at.
+const sniffLen = 512
+
+// paginate cuts one page out of results that are already grouped and sorted by key.
+// The continuation token is the last returned key, so it stays valid while objects come and go.
+func paginate(results []ListResult, opts ListOptions) (ListPage, error) {
+	marker, err := listMarker(opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	start := sort.Search(len(results), func(i int) bool {
+		return results[i].Key > marker
+	})
+	results = results[start:]
+	limit := opts.MaxKeys
+	if limit <= 0 {
+		limit = DefaultMaxKeys
+	}
+	if len(results) <= limit {
+		return ListPage{Results: results}, nil
+	}
+	return ListPage{
+		Results:   results[:limit],
+		NextToken: continuationToken(results[limit-1].Key),
+	}, nil
+}
+
+// listMarker returns the key a page starts after, the later of StartAfter and the continuation token.
+func listMarker(opts ListOptions) (string, error) {
+	marker := opts.StartAfter
+	if opts.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(opts.ContinuationToken)
+		if err != nil {
+			return "", errors.Join(oops.ValidationError, fmt.Errorf("invalid continuation token: %w", err))
+		}
+		marker = max(marker, string(token))
+	}
+	return marker, nil
+}
+
+func continuationToken(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// listAll collects every page of a listing.
+func listAll(ctx context.Context, store BlobStore, prefix string, delimiter string) ([]ListResult, error) {
+	results := make([]ListResult, 0)
+	opts := ListOptions{Prefix: prefix, Delimiter: delimiter}
+	for {
+		page, err := store.ListPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, page.Results...)
+		if page.NextToken == "" {
+			return results, nil
+		}
+		opts.ContinuationToken = page.NextToken
+	}
+}
+
+// groupByDelimiter folds objects sorted by key into the S3 listing shape:
+// keys containing the delimiter after the prefix collapse into a single
+// common prefix entry carrying the full prefix up to and including the delimiter.
+func groupByDelimiter(objects []ListResult, prefix string, delimiter string) []ListResult {
+	result := make([]ListResult, 0, len(objects))
+	lastDir := ""
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			base := strings.TrimPrefix(object.Key, prefix)
+			if index := strings.Index(base, delimiter); index != -1 {
+				dir := prefix + base[:index+len(delimiter)]
+				if dir != lastDir {
+					result = append(result, ListResult{IsObject: false, Key: dir, Size: 0})
+					lastDir = dir
+				}
+				continue
+			}
+		}
+		result = append(result, object)
+	}
+	return result
+}
+
+// withoutReserved copies metadata without the keys a decorator reserves for itself.
+func withoutReserved(metadata map[string]string, prefix string) map[string]string {
+	copied := make(map[string]string, len(metadata)+4)
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, prefix) {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// carryReserved keeps the reserved keys of src when a Copy or Move replaces its metadata,
+// they describe the stored bytes, which do not change.
+func carryReserved(ctx context.Context, store BlobStore, src string, metadata map[string]string, prefix string) (map[string]string, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+	info, err := store.Stat(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	replaced := withoutReserved(metadata, prefix)
+	for k, v := range info.Metadata {
+		if strings.HasPrefix(k, prefix) {
+			replaced[k] = v
+		}
+	}
+	return replaced, nil
+}
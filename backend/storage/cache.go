@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"simplicity/oops"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions bound a CachingBlobStore. Objects larger than MaxObjectBytes are always streamed
+// from the wrapped store. Entries older than MaxAge are refetched, zero keeps them until evicted or invalidated.
+// An empty DiskPath disables the disk tier. Prefixes limit the cache to the keys under them, the others
+// are always read from the wrapped store, and are what InvalidateOnChange watches. Without Prefixes every key is cached.
+type CacheOptions struct {
+	MaxBytes       int64
+	MaxObjectBytes int64
+	MaxAge         time.Duration
+	DiskPath       string
+	DiskMaxBytes   int64
+	Prefixes       []string
+}
+
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	DiskHits      int64 `json:"disk_hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	DiskFiles     int   `json:"disk_files"`
+	DiskBytes     int64 `json:"disk_bytes"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// CachingBlobStore keeps Get bodies and Stat results of small objects in a memory LRU, and full
+// objects in an optional disk LRU below it. Writes through the cache invalidate the keys they touch,
+// writes by other processes are only seen once MaxAge passes, unless InvalidateOnChange follows them.
+type CachingBlobStore struct {
+	store  BlobStore
+	opts   CacheOptions
+	mu     sync.Mutex
+	memory *lru
+	disk   *lru
+	// generation changes on every invalidation, a fill that raced with one is dropped
+	generation int64
+	stats      CacheStats
+}
+
+type cacheEntry struct {
+	info    ObjectInfo
+	data    []byte
+	hasData bool
+	stored  time.Time
+}
+
+// diskCacheHeader is the first line of a disk tier file, the object content follows it.
+type diskCacheHeader struct {
+	Info   ObjectInfo
+	Stored time.Time
+}
+
+const diskCacheExt = ".cache"
+
+func NewCachingBlobStore(store BlobStore, opts CacheOptions) (*CachingBlobStore, error) {
+	if opts.MaxObjectBytes <= 0 || opts.MaxObjectBytes > opts.MaxBytes {
+		opts.MaxObjectBytes = opts.MaxBytes
+	}
+	s := &CachingBlobStore{store: store, opts: opts, memory: newLRU(opts.MaxBytes)}
+	if opts.DiskPath != "" {
+		s.disk = newLRU(opts.DiskMaxBytes)
+		if err := s.loadDisk(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadDisk indexes the files a previous run left behind, the most recently stored are kept longest.
+func (s *CachingBlobStore) loadDisk() error {
+	if err := os.MkdirAll(s.opts.DiskPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	entries, err := os.ReadDir(s.opts.DiskPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		key, err := url.PathUnescape(strings.TrimSuffix(name, diskCacheExt))
+		info, infoErr := entry.Info()
+		if !strings.HasSuffix(name, diskCacheExt) || err != nil || infoErr != nil {
+			os.Remove(filepath.Join(s.opts.DiskPath, name))
+			continue
+		}
+		files = append(files, file{key, info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		s.dropFiles(s.disk.add(f.key, f.size, nil))
+	}
+	return nil
+}
+
+func (s *CachingBlobStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Entries = s.memory.len()
+	stats.Bytes = s.memory.bytes
+	if s.disk != nil {
+		stats.DiskFiles = s.disk.len()
+		stats.DiskBytes = s.disk.bytes
+	}
+	return stats
+}
+
+// InvalidateOnChange drops the entries of keys the wrapped store reports as changed under the cached prefixes,
+// so writes by other processes are seen before MaxAge passes. It fails with oops.NotSupported when the store
+// cannot watch and runs until ctx is done otherwise.
+func (s *CachingBlobStore) InvalidateOnChange(ctx context.Context) error {
+	prefixes := s.opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		events, err := watchStore(ctx, s.store, prefix)
+		if err != nil {
+			return err
+		}
+		go func() {
+			for event := range events {
+				if event.Type == EventOverflow {
+					s.invalidatePrefix(event.Key)
+				} else {
+					s.invalidate(event.Key)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// caches tells whether key is under one of the cached prefixes.
+func (s *CachingBlobStore) caches(key string) bool {
+	if len(s.opts.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.opts.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CachingBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	return s.store.List(ctx, prefix, delimiter)
+}
+
+func (s *CachingBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return s.store.ListPage(ctx, opts)
+}
+
+func (s *CachingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	if !s.caches(key) {
+		return s.store.Get(ctx, key)
+	}
+	if entry, ok := s.lookup(key, true); ok {
+		return io.NopCloser(bytes.NewReader(entry.data)), entry.info, nil
+	}
+	generation := s.currentGeneration()
+	reader, info, err := s.store.Get(ctx, key)
+	if err != nil || info.Size > s.opts.MaxObjectBytes {
+		return reader, info, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	s.fill(key, &cacheEntry{info: info, data: data, hasData: true, stored: time.Now()}, generation)
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+func (s *CachingBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	if !s.caches(key) {
+		return s.store.GetRange(ctx, key, offset, length)
+	}
+	entry, ok := s.lookup(key, true)
+	if !ok {
+		return s.store.GetRange(ctx, key, offset, length)
+	}
+	length, err := resolveRange(offset, length, int64(len(entry.data)))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return io.NopCloser(bytes.NewReader(entry.data[offset : offset+length])), entry.info, nil
+}
+
+func (s *CachingBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if !s.caches(key) {
+		return s.store.Stat(ctx, key)
+	}
+	if entry, ok := s.lookup(key, false); ok {
+		return entry.info, nil
+	}
+	generation := s.currentGeneration()
+	info, err := s.store.Stat(ctx, key)
+	if err != nil || info.Size > s.opts.MaxObjectBytes {
+		return info, err
+	}
+	s.fill(key, &cacheEntry{info: info, stored: time.Now()}, generation)
+	return info, nil
+}
+
+func (s *CachingBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	defer s.invalidate(key)
+	return s.store.Put(ctx, key, reader, metadata)
+}
+
+func (s *CachingBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	defer s.invalidate(key)
+	return s.store.PutIf(ctx, key, reader, metadata, cond)
+}
+
+func (s *CachingBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	defer s.invalidate(dst)
+	return s.store.Copy(ctx, src, dst, metadata)
+}
+
+func (s *CachingBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	defer s.invalidate(src, dst)
+	return s.store.Move(ctx, src, dst, metadata)
+}
+
+func (s *CachingBlobStore) Delete(ctx context.Context, key string) error {
+	defer s.invalidate(key)
+	return s.store.Delete(ctx, key)
+}
+
+func (s *CachingBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	defer s.invalidate(keys...)
+	return s.store.DeleteMany(ctx, keys)
+}
+
+func (s *CachingBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	defer s.invalidatePrefix(prefix)
+	return s.store.DeleteAll(ctx, prefix)
+}
+
+func (s *CachingBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+// PresignPut invalidates right away, the upload itself bypasses the cache.
+func (s *CachingBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	s.invalidate(key)
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+func (s *CachingBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.store, prefix)
+}
+
+// lookup finds a fresh entry, with content if needData is set, in memory first and on disk second.
+func (s *CachingBlobStore) lookup(key string, needData bool) (*cacheEntry, bool) {
+	s.mu.Lock()
+	if value, ok := s.memory.get(key); ok {
+		entry := value.(*cacheEntry)
+		if !s.fresh(entry.stored) {
+			s.memory.remove(key)
+		} else if entry.hasData || !needData {
+			s.stats.Hits++
+			s.mu.Unlock()
+			return entry, true
+		}
+	}
+	_, onDisk := s.diskGet(key)
+	generation := s.generation
+	s.mu.Unlock()
+
+	if onDisk {
+		if entry, err := s.readDisk(key); err == nil && s.fresh(entry.stored) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.stats.Hits++
+			s.stats.DiskHits++
+			if s.generation == generation {
+				s.stats.Evictions += int64(len(s.memory.add(key, entrySize(key, entry), entry)))
+			}
+			return entry, true
+		}
+	}
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+	return nil, false
+}
+
+func (s *CachingBlobStore) diskGet(key string) (any, bool) {
+	if s.disk == nil {
+		return nil, false
+	}
+	return s.disk.get(key)
+}
+
+func (s *CachingBlobStore) fresh(stored time.Time) bool {
+	return s.opts.MaxAge <= 0 || time.Since(stored) < s.opts.MaxAge
+}
+
+func (s *CachingBlobStore) currentGeneration() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// fill stores what was fetched from the wrapped store, unless a write invalidated keys since the fetch started.
+func (s *CachingBlobStore) fill(key string, entry *cacheEntry, generation int64) {
+	var temp string
+	var size int64
+	if entry.hasData && s.disk != nil {
+		temp, size, _ = s.writeDisk(entry)
+		defer os.Remove(temp)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return
+	}
+	s.stats.Evictions += int64(len(s.memory.add(key, entrySize(key, entry), entry)))
+	if temp == "" {
+		return
+	}
+	if err := os.Rename(temp, s.diskPath(key)); err == nil {
+		s.dropFiles(s.disk.add(key, size, nil))
+	}
+}
+
+func (s *CachingBlobStore) invalidate(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.stats.Invalidations++
+	for _, key := range keys {
+		s.memory.remove(key)
+		if s.disk != nil && s.disk.remove(key) {
+			os.Remove(s.diskPath(key))
+		}
+	}
+}
+
+func (s *CachingBlobStore) invalidatePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.stats.Invalidations++
+	s.memory.removePrefix(prefix)
+	if s.disk != nil {
+		s.dropFiles(s.disk.removePrefix(prefix))
+	}
+}
+
+func (s *CachingBlobStore) dropFiles(keys []string) {
+	for _, key := range keys {
+		os.Remove(s.diskPath(key))
+	}
+}
+
+func (s *CachingBlobStore) diskPath(key string) string {
+	return filepath.Join(s.opts.DiskPath, url.PathEscape(key)+diskCacheExt)
+}
+
+// writeDisk returns a temp file with the entry and its size, the caller renames it into place.
+func (s *CachingBlobStore) writeDisk(entry *cacheEntry) (string, int64, error) {
+	header, err := json.Marshal(diskCacheHeader{Info: entry.info, Stored: entry.stored})
+	if err != nil {
+		return "", 0, err
+	}
+	file, err := os.CreateTemp(s.opts.DiskPath, "fill-*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = file.Write(append(header, '\n'))
+	if err == nil {
+		_, err = file.Write(entry.data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+	return file.Name(), int64(len(header) + 1 + len(entry.data)), nil
+}
+
+func (s *CachingBlobStore) readDisk(key string) (*cacheEntry, error) {
+	file, err := os.Open(s.diskPath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var header diskCacheHeader
+	if err = json.Unmarshal(line, &header); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != header.Info.Size {
+		return nil, fmt.Errorf("cached object %s is truncated", key)
+	}
+	return &cacheEntry{info: header.Info, data: data, hasData: true, stored: header.Stored}, nil
+}
+
+// entrySize is what an entry is charged against MaxBytes, Stat results are not free either.
+func entrySize(key string, entry *cacheEntry) int64 {
+	return int64(len(key)+len(entry.data)) + 128
+}
+
+// lru tracks entries by size, adding beyond max evicts the least recently used ones.
+type lru struct {
+	max     int64
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	value any
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (l *lru) len() int {
+	return len(l.entries)
+}
+
+func (l *lru) get(key string) (any, bool) {
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruItem).value, true
+}
+
+// add returns the keys evicted to make room. Items larger than max are not kept at all.
+func (l *lru) add(key string, size int64, value any) []string {
+	l.remove(key)
+	if size > l.max {
+		return []string{key}
+	}
+	l.entries[key] = l.order.PushFront(&lruItem{key, size, value})
+	l.bytes += size
+	var evicted []string
+	for l.bytes > l.max {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	element, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(element)
+	delete(l.entries, key)
+	l.bytes -= element.Value.(*lruItem).size
+	return true
+}
+
+func (l *lru) removePrefix(prefix string) []string {
+	var removed []string
+	for key := range l.entries {
+		if strings.HasPrefix(key, prefix) {
+			removed = append(removed, key)
+		}
+	}
+	for _, key := range removed {
+		l.remove(key)
+	}
+	return removed
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingBlobStore counts the reads that reach the wrapped store.
+type countingBlobStore struct {
+	BlobStore
+	gets  int
+	stats int
+	pages int
+}
+
+func (s *countingBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	s.pages++
+	return s.BlobStore.ListPage(ctx, opts)
+}
+
+func (s *countingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	s.gets++
+	return s.BlobStore.Get(ctx, key)
+}
+
+func (s *countingBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.stats++
+	return s.BlobStore.Stat(ctx, key)
+}
+
+func readString(t *testing.T, store BlobStore, key string) string {
+	t.Helper()
+	reader, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q) error = %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return string(data)
+}
+
+func TestCachingBlobStore_HitsAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	cache, err := NewCachingBlobStore(backend, CacheOptions{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	if _, err = cache.Put(ctx, "images/1/preview", strings.NewReader("v1"), map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	info, err := cache.Stat(ctx, "images/1/preview")
+	if err != nil || info.Metadata["k"] != "v" {
+		t.Fatalf("Stat() = %+v, %v", info, err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := readString(t, cache, "images/1/preview"); got != "v1" {
+			t.Fatalf("Get() = %q, want %q", got, "v1")
+		}
+		cache.Stat(ctx, "images/1/preview")
+	}
+	if backend.gets != 1 || backend.stats != 1 {
+		t.Errorf("backend reads = %d gets, %d stats, want 1 each", backend.gets, backend.stats)
+	}
+	stats := cache.Stats()
+	if stats.Misses != 2 || stats.Hits != 5 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want 2 misses, 5 hits and 1 entry", stats)
+	}
+	reader, _, err := cache.GetRange(ctx, "images/1/preview", 1, 1)
+	if err != nil {
+		t.Fatalf("GetRange() error = %v", err)
+	}
+	if data, _ := io.ReadAll(reader); string(data) != "1" {
+		t.Errorf("GetRange() = %q, want %q", data, "1")
+	}
+
+	if _, err = cache.Put(ctx, "images/1/preview", strings.NewReader("v2"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := readString(t, cache, "images/1/preview"); got != "v2" {
+		t.Errorf("Get() after Put = %q, want %q", got, "v2")
+	}
+	if err = cache.Delete(ctx, "images/1/preview"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, _, err = cache.Get(ctx, "images/1/preview"); err == nil {
+		t.Errorf("Get() after Delete error = nil, want an error")
+	}
+
+	cache.Put(ctx, "images/2/a", strings.NewReader("a"), nil)
+	cache.Put(ctx, "images/2/b", strings.NewReader("b"), nil)
+	readString(t, cache, "images/2/a")
+	readString(t, cache, "images/2/b")
+	if err = cache.DeleteAll(ctx, "images/2"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if stats = cache.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() after DeleteAll = %+v, want no entries", stats)
+	}
+}
+
+func TestCachingBlobStore_Bounds(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	cache, err := NewCachingBlobStore(backend, CacheOptions{MaxBytes: 3 * 256, MaxObjectBytes: 100, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		backend.Put(ctx, key, strings.NewReader(strings.Repeat(key, 100)), nil)
+		readString(t, cache, key)
+	}
+	if stats := cache.Stats(); stats.Entries != 3 || stats.Evictions != 1 || stats.Bytes > 3*256 {
+		t.Errorf("Stats() = %+v, want 3 entries within the bound after 1 eviction", cache.Stats())
+	}
+	backend.gets = 0
+	readString(t, cache, "a")
+	readString(t, cache, "d")
+	if backend.gets != 1 {
+		t.Errorf("backend gets = %d, want only the evicted key refetched", backend.gets)
+	}
+
+	backend.Put(ctx, "large", strings.NewReader(strings.Repeat("x", 101)), nil)
+	readString(t, cache, "large")
+	readString(t, cache, "large")
+	if backend.gets != 3 {
+		t.Errorf("backend gets = %d, want objects above MaxObjectBytes read every time", backend.gets)
+	}
+}
+
+func TestCachingBlobStore_DiskTier(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	backend.Put(ctx, "images/files/1/web-preview-100.jpeg", strings.NewReader("thumbnail"), map[string]string{"extension": "jpeg"})
+	opts := CacheOptions{MaxBytes: 1 << 20, DiskPath: dir, DiskMaxBytes: 1 << 20}
+	cache, err := NewCachingBlobStore(backend, opts)
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	_, want, _ := backend.BlobStore.Get(ctx, "images/files/1/web-preview-100.jpeg")
+	readString(t, cache, "images/files/1/web-preview-100.jpeg")
+
+	restarted, err := NewCachingBlobStore(backend, opts)
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	reader, info, err := restarted.Get(ctx, "images/files/1/web-preview-100.jpeg")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	if string(data) != "thumbnail" || info.ETag != want.ETag || info.Metadata["extension"] != "jpeg" {
+		t.Errorf("Get() from disk = %q %+v, want the cached content and info", data, info)
+	}
+	if stats := restarted.Stats(); backend.gets != 1 || stats.DiskHits != 1 || stats.DiskFiles != 1 {
+		t.Errorf("backend gets = %d, Stats() = %+v, want the restart served from disk", backend.gets, stats)
+	}
+
+	if err = restarted.DeleteAll(ctx, "images/files/1"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	if stats := restarted.Stats(); stats.DiskFiles != 0 {
+		t.Errorf("Stats() after DeleteAll = %+v, want no disk files", stats)
+	}
+	again, err := NewCachingBlobStore(backend, opts)
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	if stats := again.Stats(); stats.DiskFiles != 0 {
+		t.Errorf("Stats() after reopening = %+v, want the invalidated file gone", stats)
+	}
+}
+
+func TestCachingBlobStore_Prefixes(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	cache, err := NewCachingBlobStore(backend, CacheOptions{MaxBytes: 1 << 20, Prefixes: []string{"images/files/"}})
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	cache.Put(ctx, "images/files/1", strings.NewReader("1"), nil)
+	cache.Put(ctx, "item/items.js", strings.NewReader("{}"), nil)
+	for i := 0; i < 3; i++ {
+		readString(t, cache, "images/files/1")
+		readString(t, cache, "item/items.js")
+		cache.Stat(ctx, "item/items.js")
+	}
+	if backend.gets != 4 || backend.stats != 3 {
+		t.Errorf("backend gets = %d, stats = %d, want the cached key read once and the other every time", backend.gets, backend.stats)
+	}
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"simplicity/oops"
+	"strconv"
+	"time"
+)
+
+const (
+	sumMetaPrefix = "sum_"
+	sumMetaSHA256 = "sum_sha256"
+	sumMetaSize   = "sum_size"
+	// spoolMemoryBytes is how much of a body that cannot seek is held in memory while it is hashed,
+	// the rest goes to a temporary file
+	spoolMemoryBytes = 1024 * 1024
+)
+
+// ChecksumBlobStore stores the SHA-256 and size of every object in its metadata and verifies them
+// while Get streams the object. A mismatch is reported as oops.Corrupted instead of the end of the stream,
+// and the bytes of the read that completed the object are held back, so a client streaming the response
+// never receives it whole. Objects stored without a checksum are read unverified, ranges cannot be verified.
+type ChecksumBlobStore struct {
+	store BlobStore
+}
+
+// ScrubReport lists the objects under a prefix that no longer match their checksum. Unverified objects
+// have no checksum, Failed ones could not be read.
+type ScrubReport struct {
+	Checked    int               `json:"checked"`
+	Unverified int               `json:"unverified"`
+	Corrupted  []string          `json:"corrupted"`
+	Failed     map[string]string `json:"failed,omitempty"`
+}
+
+func NewChecksumBlobStore(store BlobStore) *ChecksumBlobStore {
+	return &ChecksumBlobStore{store: store}
+}
+
+// Scrub reads every object under prefix and compares it with its checksum.
+func (s *ChecksumBlobStore) Scrub(ctx context.Context, prefix string) (ScrubReport, error) {
+	report := ScrubReport{Corrupted: make([]string, 0), Failed: make(map[string]string)}
+	err := listObjects(ctx, s.store, prefix, func(result ListResult) error {
+		reader, info, err := s.store.Get(ctx, result.Key)
+		if errors.Is(err, oops.KeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			report.Failed[result.Key] = err.Error()
+			return nil
+		}
+		defer reader.Close()
+		verifying, ok := verifyReader(reader, info)
+		if !ok {
+			report.Unverified++
+			return nil
+		}
+		report.Checked++
+		_, err = io.Copy(io.Discard, verifying)
+		switch {
+		case errors.Is(err, oops.Corrupted):
+			report.Corrupted = append(report.Corrupted, result.Key)
+		case err != nil:
+			report.Failed[result.Key] = err.Error()
+		}
+		return ctx.Err()
+	})
+	return report, err
+}
+
+func (s *ChecksumBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	return s.store.List(ctx, prefix, delimiter)
+}
+
+func (s *ChecksumBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return s.store.ListPage(ctx, opts)
+}
+
+func (s *ChecksumBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	reader, info, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if verifying, ok := verifyReader(reader, info); ok {
+		reader = readCloser{verifying, reader}
+	}
+	return reader, withoutSums(info), nil
+}
+
+func (s *ChecksumBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	reader, info, err := s.store.GetRange(ctx, key, offset, length)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return reader, withoutSums(info), nil
+}
+
+func (s *ChecksumBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return withoutSums(info), nil
+}
+
+func (s *ChecksumBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+// PutIf has to know the checksum before the body is sent, it reads a body that can seek twice
+// and spools any other body first.
+func (s *ChecksumBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	if key == "" {
+		return "", oops.InvalidKey
+	}
+	body, cleanup, sum, size, err := hashBody(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum %s: %w", key, err)
+	}
+	defer cleanup.Close()
+	stored := withoutReserved(metadata, sumMetaPrefix)
+	stored[sumMetaSHA256] = sum
+	stored[sumMetaSize] = strconv.FormatInt(size, 10)
+	return s.store.PutIf(ctx, key, body, stored, cond)
+}
+
+func (s *ChecksumBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := carryReserved(ctx, s.store, src, metadata, sumMetaPrefix)
+	if err != nil {
+		return err
+	}
+	return s.store.Copy(ctx, src, dst, metadata)
+}
+
+func (s *ChecksumBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := carryReserved(ctx, s.store, src, metadata, sumMetaPrefix)
+	if err != nil {
+		return err
+	}
+	return s.store.Move(ctx, src, dst, metadata)
+}
+
+func (s *ChecksumBlobStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, key)
+}
+
+func (s *ChecksumBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	return s.store.DeleteMany(ctx, keys)
+}
+
+func (s *ChecksumBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return s.store.DeleteAll(ctx, prefix)
+}
+
+// PresignGet and PresignPut bypass the checksums, objects uploaded that way are read unverified.
+func (s *ChecksumBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *ChecksumBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+func (s *ChecksumBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.store, prefix)
+}
+
+func withoutSums(info ObjectInfo) ObjectInfo {
+	info.Metadata = withoutReserved(info.Metadata, sumMetaPrefix)
+	return info
+}
+
+// hashBody returns a reader over the whole body with its checksum and size, a seekable one when it can
+// so the store does not have to buffer it again. Closing cleanup removes the spool file if there is one.
+func hashBody(reader io.Reader) (io.Reader, io.Closer, string, int64, error) {
+	hasher := sha256.New()
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			size, err := io.Copy(hasher, seeker)
+			if err != nil {
+				return nil, nil, "", 0, err
+			}
+			if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, nil, "", 0, err
+			}
+			return seeker, closers{}, hex.EncodeToString(hasher.Sum(nil)), size, nil
+		}
+	}
+
+	var head bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(&head, hasher), io.LimitReader(reader, spoolMemoryBytes))
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+	if size < spoolMemoryBytes {
+		return bytes.NewReader(head.Bytes()), closers{}, hex.EncodeToString(hasher.Sum(nil)), size, nil
+	}
+	spool, err := os.CreateTemp("", "checksum-*")
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+	cleanup := closers{spool, removeFile(spool.Name())}
+	rest, err := io.Copy(io.MultiWriter(spool, hasher), reader)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup.Close()
+		return nil, nil, "", 0, err
+	}
+	return io.MultiReader(&head, spool), cleanup, hex.EncodeToString(hasher.Sum(nil)), size + rest, nil
+}
+
+type removeFile string
+
+func (f removeFile) Close() error {
+	return os.Remove(string(f))
+}
+
+// verifyingReader hashes what it passes on and checks it when the object is complete.
+type verifyingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	sum    string
+	size   int64
+	read   int64
+	err    error
+}
+
+// verifyReader wraps reader when info carries a checksum.
+func verifyReader(reader io.Reader, info ObjectInfo) (io.Reader, bool) {
+	sum := info.Metadata[sumMetaSHA256]
+	size, err := strconv.ParseInt(info.Metadata[sumMetaSize], 10, 64)
+	if sum == "" || err != nil {
+		return reader, false
+	}
+	return &verifyingReader{reader: reader, hash: sha256.New(), sum: sum, size: size}, true
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	r.hash.Write(p[:n])
+	switch {
+	case r.read > r.size:
+		r.err = fmt.Errorf("%w: more than the %d bytes stored", oops.Corrupted, r.size)
+		return 0, r.err
+	case r.read == r.size && n > 0 || r.read == 0 && r.size == 0 && err == io.EOF:
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.sum {
+			r.err = fmt.Errorf("%w: checksum %s, want %s", oops.Corrupted, got, r.sum)
+			return 0, r.err
+		}
+	case err == io.EOF && r.read < r.size:
+		r.err = fmt.Errorf("%w: %d of %d bytes", oops.Corrupted, r.read, r.size)
+		return n, r.err
+	}
+	return n, err
+}
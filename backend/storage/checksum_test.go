@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"simplicity/oops"
+	"strings"
+	"testing"
+)
+
+// tamper overwrites the stored body of key and keeps its metadata, checksum included.
+func tamper(t *testing.T, backend BlobStore, key string, data []byte) {
+	t.Helper()
+	info, err := backend.Stat(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Stat(%q) error = %v", key, err)
+	}
+	if _, err := backend.Put(context.Background(), key, bytes.NewReader(data), info.Metadata); err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+}
+
+func TestChecksumBlobStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := NewChecksumBlobStore(backend)
+	large := patterned(spoolMemoryBytes + 1000)
+
+	bodies := map[string]io.Reader{
+		"images/seeker": bytes.NewReader([]byte("seekable")),
+		"images/stream": io.MultiReader(strings.NewReader("streamed")),
+		"images/large":  io.MultiReader(bytes.NewReader(large)),
+		"images/empty":  io.MultiReader(),
+	}
+	want := map[string]string{"images/seeker": "seekable", "images/stream": "streamed", "images/large": string(large), "images/empty": ""}
+	for key, body := range bodies {
+		if _, err := store.Put(ctx, key, body, map[string]string{"owner": "me", sumMetaSHA256: "bogus"}); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+		if got := readString(t, store, key); got != want[key] {
+			t.Errorf("Get(%q) returned %d different bytes", key, len(got))
+		}
+		info, err := store.Stat(ctx, key)
+		if err != nil || info.Size != int64(len(want[key])) || info.Metadata["owner"] != "me" || info.Metadata[sumMetaSHA256] != "" {
+			t.Errorf("Stat(%q) = %+v, %v, want only the user metadata", key, info, err)
+		}
+		raw, err := backend.Stat(ctx, key)
+		if err != nil || len(raw.Metadata[sumMetaSHA256]) != 64 {
+			t.Errorf("stored %q = %+v, %v, want a checksum", key, raw, err)
+		}
+	}
+}
+
+func TestChecksumBlobStore_Corrupted(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := NewChecksumBlobStore(backend)
+	original := patterned(4096)
+	stored := map[string][]byte{
+		"flipped":   append([]byte{original[0] ^ 1}, original[1:]...),
+		"truncated": original[:4000],
+		"extended":  append(append([]byte{}, original...), 'x'),
+	}
+	for key, data := range stored {
+		if _, err := store.Put(ctx, key, bytes.NewReader(original), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+		tamper(t, backend, key, data)
+
+		reader, _, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%q) error = %v", key, err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if !errors.Is(err, oops.Corrupted) {
+			t.Errorf("reading %q error = %v, want oops.Corrupted", key, err)
+		}
+		if len(got) >= len(original) {
+			t.Errorf("reading %q returned %d bytes, want the object held back", key, len(got))
+		}
+	}
+
+	if reader, _, err := store.GetRange(ctx, "flipped", 100, 10); err != nil {
+		t.Errorf("GetRange() error = %v, want ranges unverified", err)
+	} else {
+		reader.Close()
+	}
+}
+
+func TestChecksumBlobStore_Legacy(t *testing.T) {
+	backend := NewInMemoryBlobStore()
+	backend.Put(context.Background(), "images/old", strings.NewReader("old"), map[string]string{"extension": "png"})
+	if got := readString(t, NewChecksumBlobStore(backend), "images/old"); got != "old" {
+		t.Errorf("Get() of an object without checksum = %q", got)
+	}
+}
+
+func TestChecksumBlobStore_CopyMove(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := NewChecksumBlobStore(backend)
+	testCopyMove(t, store)
+
+	store.Put(ctx, "src", strings.NewReader("data"), nil)
+	if err := store.Copy(ctx, "src", "dst", map[string]string{"owner": "me"}); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	tamper(t, backend, "dst", []byte("date"))
+	if _, err := io.ReadAll(mustGet(t, store, "dst")); !errors.Is(err, oops.Corrupted) {
+		t.Errorf("reading a corrupted copy error = %v, want the checksum carried over", err)
+	}
+}
+
+func TestChecksumBlobStore_Scrub(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := NewChecksumBlobStore(backend)
+	for _, key := range []string{"images/1", "images/2", "images/3", "item/items.js"} {
+		store.Put(ctx, key, strings.NewReader(key), nil)
+	}
+	backend.Put(ctx, "images/legacy", strings.NewReader("legacy"), nil)
+	tamper(t, backend, "images/2", []byte("images/X"))
+
+	report, err := store.Scrub(ctx, "images/")
+	if err != nil {
+		t.Fatalf("Scrub() error = %v", err)
+	}
+	if report.Checked != 3 || report.Unverified != 1 || len(report.Failed) != 0 ||
+		len(report.Corrupted) != 1 || report.Corrupted[0] != "images/2" {
+		t.Errorf("Scrub() = %+v, want images/2 corrupted", report)
+	}
+}
+
+func mustGet(t *testing.T, store BlobStore, key string) io.Reader {
+	t.Helper()
+	reader, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q) error = %v", key, err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
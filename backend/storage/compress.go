@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"simplicity/oops"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	compMetaPrefix = "comp_"
+	compMetaCodec  = "comp_codec"
+	compMetaSize   = "comp_size"
+	compMetaType   = "comp_content_type"
+	codecGzip      = "gzip"
+)
+
+type codec struct {
+	compress   func(w io.Writer) io.WriteCloser
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	codecGzip: {
+		compress: func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// CompressingBlobStore compresses objects whose key matches one of the patterns, the codec and the
+// uncompressed size and content type go into the metadata so reads can undo it. Objects without them,
+// stored before or not matching, are read as they are. Patterns are path.Match patterns, matched against
+// the whole key when they contain a slash and against the last element of the key otherwise.
+// Matching objects are compressed in memory, patterns should select documents rather than media.
+type CompressingBlobStore struct {
+	store    BlobStore
+	patterns []string
+	codec    string
+}
+
+func NewCompressingBlobStore(store BlobStore, patterns []string) (*CompressingBlobStore, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid compression pattern %q: %w", pattern, err)
+		}
+	}
+	return &CompressingBlobStore{store: store, patterns: patterns, codec: codecGzip}, nil
+}
+
+func (s *CompressingBlobStore) matches(key string) bool {
+	for _, pattern := range s.patterns {
+		name := key
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// List reports uncompressed sizes like Stat, it costs a Stat of every listed object whose key matches.
+func (s *CompressingBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	results, err := s.store.List(ctx, prefix, delimiter)
+	if err != nil {
+		return nil, err
+	}
+	return s.uncompressedSizes(ctx, results)
+}
+
+func (s *CompressingBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := s.store.ListPage(ctx, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	page.Results, err = s.uncompressedSizes(ctx, page.Results)
+	return page, err
+}
+
+func (s *CompressingBlobStore) uncompressedSizes(ctx context.Context, results []ListResult) ([]ListResult, error) {
+	for i, result := range results {
+		if !result.IsObject || !s.matches(result.Key) {
+			continue
+		}
+		info, err := s.Stat(ctx, result.Key)
+		if errors.Is(err, oops.KeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i].Size = int(info.Size)
+	}
+	return results, nil
+}
+
+func (s *CompressingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	reader, info, err := s.store.Get(ctx, key)
+	if err != nil || info.Metadata[compMetaCodec] == "" {
+		return reader, info, err
+	}
+	decompressed, err := s.decompress(info, reader)
+	if err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("failed to decompress %s: %w", key, err)
+	}
+	return decompressed, uncompressedInfo(info), nil
+}
+
+// GetRange of a compressed object reads it from the start, compressed streams cannot be entered midway.
+func (s *CompressingBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if info.Metadata[compMetaCodec] == "" {
+		return s.store.GetRange(ctx, key, offset, length)
+	}
+	length, err = resolveRange(offset, length, uncompressedInfo(info).Size)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	reader, info, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if _, err = io.CopyN(io.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return readCloser{io.LimitReader(reader, length), reader}, info, nil
+}
+
+func (s *CompressingBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil || info.Metadata[compMetaCodec] == "" {
+		return info, err
+	}
+	return uncompressedInfo(info), nil
+}
+
+func (s *CompressingBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *CompressingBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	if !s.matches(key) {
+		return s.store.PutIf(ctx, key, reader, withoutReserved(metadata, compMetaPrefix), cond)
+	}
+	var compressed bytes.Buffer
+	writer := codecs[s.codec].compress(&compressed)
+	sniff := &sniffWriter{}
+	size, err := io.Copy(io.MultiWriter(writer, sniff), reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to compress %s: %w", key, err)
+	}
+	stored := withoutReserved(metadata, compMetaPrefix)
+	stored[compMetaCodec] = s.codec
+	stored[compMetaSize] = strconv.FormatInt(size, 10)
+	stored[compMetaType] = sniff.ContentType()
+	return s.store.PutIf(ctx, key, &compressed, stored, cond)
+}
+
+func (s *CompressingBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := carryReserved(ctx, s.store, src, metadata, compMetaPrefix)
+	if err != nil {
+		return err
+	}
+	return s.store.Copy(ctx, src, dst, metadata)
+}
+
+func (s *CompressingBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := carryReserved(ctx, s.store, src, metadata, compMetaPrefix)
+	if err != nil {
+		return err
+	}
+	return s.store.Move(ctx, src, dst, metadata)
+}
+
+func (s *CompressingBlobStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, key)
+}
+
+func (s *CompressingBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	return s.store.DeleteMany(ctx, keys)
+}
+
+func (s *CompressingBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return s.store.DeleteAll(ctx, prefix)
+}
+
+// PresignGet and PresignPut only work for keys that are not compressed, the client would see
+// the compressed bytes or store uncompressed ones.
+func (s *CompressingBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok || s.matches(key) {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *CompressingBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok || s.matches(key) {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+func (s *CompressingBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.store, prefix)
+}
+
+func (s *CompressingBlobStore) decompress(info ObjectInfo, reader io.ReadCloser) (io.ReadCloser, error) {
+	codec, ok := codecs[info.Metadata[compMetaCodec]]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", info.Metadata[compMetaCodec])
+	}
+	decompressed, err := codec.decompress(reader)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{decompressed, closers{decompressed, reader}}, nil
+}
+
+func uncompressedInfo(info ObjectInfo) ObjectInfo {
+	if size, err := strconv.ParseInt(info.Metadata[compMetaSize], 10, 64); err == nil {
+		info.Size = size
+	}
+	info.ContentType = info.Metadata[compMetaType]
+	info.Metadata = withoutReserved(info.Metadata, compMetaPrefix)
+	return info
+}
+
+// closers closes all of them and reports the first failure.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newTestCompressing(t *testing.T, store BlobStore, patterns ...string) *CompressingBlobStore {
+	t.Helper()
+	compressing, err := NewCompressingBlobStore(store, patterns)
+	if err != nil {
+		t.Fatalf("NewCompressingBlobStore() error = %v", err)
+	}
+	return compressing
+}
+
+func TestNewCompressingBlobStore_InvalidPattern(t *testing.T) {
+	if _, err := NewCompressingBlobStore(NewInMemoryBlobStore(), []string{"[*.js"}); err == nil {
+		t.Errorf("NewCompressingBlobStore() with a malformed pattern error = nil")
+	}
+}
+
+func TestCompressingBlobStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := newTestCompressing(t, backend, "*.js", "docs/*")
+	document := `{"items":[` + strings.Repeat(`{"id":"1234567890","name":"image"},`, 200) + `{}]}`
+
+	for _, key := range []string{"item/items.js", "docs/readme"} {
+		if _, err := store.Put(ctx, key, strings.NewReader(document), map[string]string{"owner": "me"}); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+		if got := readString(t, store, key); got != document {
+			t.Errorf("Get(%q) returned %d different bytes", key, len(got))
+		}
+		info, err := store.Stat(ctx, key)
+		if err != nil || info.Size != int64(len(document)) || info.ContentType != "text/plain; charset=utf-8" ||
+			info.Metadata["owner"] != "me" || info.Metadata[compMetaCodec] != "" {
+			t.Errorf("Stat(%q) = %+v, %v, want the uncompressed size and only the user metadata", key, info, err)
+		}
+		raw, err := backend.Stat(ctx, key)
+		if err != nil || raw.Size >= int64(len(document))/4 || raw.Metadata[compMetaCodec] != codecGzip {
+			t.Errorf("stored %q = %+v, %v, want it compressed", key, raw, err)
+		}
+	}
+
+	store.Put(ctx, "images/1.png", strings.NewReader(document), nil)
+	if raw, _ := backend.Stat(ctx, "images/1.png"); raw.Size != int64(len(document)) || raw.Metadata[compMetaCodec] != "" {
+		t.Errorf("stored non matching key = %+v, want it as it was written", raw)
+	}
+	store.Put(ctx, "item/evil.js", strings.NewReader("{}"), map[string]string{compMetaCodec: "bogus"})
+	if got := readString(t, store, "item/evil.js"); got != "{}" {
+		t.Errorf("Get() after a Put with reserved metadata = %q", got)
+	}
+}
+
+func TestCompressingBlobStore_Legacy(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	backend.Put(ctx, "item/items.js", strings.NewReader(`{"items":[]}`), nil)
+	store := newTestCompressing(t, backend, "*.js")
+	if got := readString(t, store, "item/items.js"); got != `{"items":[]}` {
+		t.Errorf("Get() of an uncompressed object = %q", got)
+	}
+	if info, err := store.Stat(ctx, "item/items.js"); err != nil || info.Size != 12 {
+		t.Errorf("Stat() of an uncompressed object = %+v, %v", info, err)
+	}
+}
+
+func TestCompressingBlobStore_GetRange(t *testing.T) {
+	store := newTestCompressing(t, NewInMemoryBlobStore(), "key")
+	if _, err := store.Put(context.Background(), "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	testGetRange(t, store)
+}
+
+func TestCompressingBlobStore_CopyMove(t *testing.T) {
+	testCopyMove(t, newTestCompressing(t, NewInMemoryBlobStore(), "*.data"))
+}
+
+func TestCompressingBlobStore_OverEncryption(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := newTestCompressing(t, newTestEncrypting(t, backend, "k1", "k1"), "*.js")
+	document := strings.Repeat(`{"id":"1"},`, 500)
+	if _, err := store.Put(ctx, "item/items.js", strings.NewReader(document), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := readString(t, store, "item/items.js"); got != document {
+		t.Errorf("Get() returned %d different bytes", len(got))
+	}
+	raw, err := backend.Stat(ctx, "item/items.js")
+	if err != nil || raw.Size >= int64(len(document))/4 || raw.Metadata[encMetaKeyID] != "k1" {
+		t.Errorf("stored object = %+v, %v, want it compressed then encrypted", raw, err)
+	}
+}
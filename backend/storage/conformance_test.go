@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"context"
+	"simplicity/storage"
+	"simplicity/storage/storagetest"
+	"testing"
+)
+
+func newDisk(t *testing.T) storage.BlobStore {
+	store, err := storage.NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	return store
+}
+
+func newMemory(t *testing.T) storage.BlobStore {
+	return storage.NewInMemoryBlobStore()
+}
+
+func newS3(t *testing.T) storage.BlobStore {
+	return storage.NewFakeS3BlobStore(t)
+}
+
+func TestConformance(t *testing.T) {
+	stores := map[string]storagetest.Factory{
+		"InMemory": newMemory,
+		"Disk":     newDisk,
+		"S3":       newS3,
+		"StripPrefix": func(t *testing.T) storage.BlobStore {
+			return storage.NewPrefixBlobStore(newMemory(t), "images/")
+		},
+		"StripPrefixOverS3": func(t *testing.T) storage.BlobStore {
+			return storage.NewPrefixBlobStore(newS3(t), "images/")
+		},
+		"Caching": func(t *testing.T) storage.BlobStore {
+			store, err := storage.NewCachingBlobStore(newMemory(t), storage.CacheOptions{MaxBytes: 1 << 20, MaxObjectBytes: 1 << 10, DiskPath: t.TempDir(), DiskMaxBytes: 1 << 20})
+			if err != nil {
+				t.Fatalf("NewCachingBlobStore() error = %v", err)
+			}
+			return store
+		},
+		"Resilient": func(t *testing.T) storage.BlobStore {
+			return storage.NewResilientBlobStore(newS3(t), storage.RetryOptions{})
+		},
+		"Mirrored": func(t *testing.T) storage.BlobStore {
+			return storage.NewMirroredBlobStore(newMemory(t), []storage.BlobStore{newDisk(t)}, storage.MirrorOptions{})
+		},
+		"Encrypting": func(t *testing.T) storage.BlobStore {
+			store, err := storage.NewEncryptingBlobStore(newMemory(t), map[string][]byte{"k1": make([]byte, 32)}, "k1")
+			if err != nil {
+				t.Fatalf("NewEncryptingBlobStore() error = %v", err)
+			}
+			return store
+		},
+		"Compressing": func(t *testing.T) storage.BlobStore {
+			store, err := storage.NewCompressingBlobStore(newMemory(t), []string{"*"})
+			if err != nil {
+				t.Fatalf("NewCompressingBlobStore() error = %v", err)
+			}
+			return store
+		},
+		"Checksum": func(t *testing.T) storage.BlobStore {
+			return storage.NewChecksumBlobStore(newS3(t))
+		},
+		"Quota": func(t *testing.T) storage.BlobStore {
+			store, err := storage.NewQuotaBlobStore(context.Background(), newMemory(t), storage.QuotaOptions{
+				Rules: []storage.QuotaRule{{Prefix: "", HardBytes: 1 << 30}},
+			})
+			if err != nil {
+				t.Fatalf("NewQuotaBlobStore() error = %v", err)
+			}
+			return store
+		},
+		"Faulty": func(t *testing.T) storage.BlobStore {
+			return storagetest.NewFaultyBlobStore(newDisk(t), 1)
+		},
+		"URLSigner": func(t *testing.T) storage.BlobStore {
+			return storage.NewURLSigner(newDisk(t), "/signed", []byte("secret"), 0)
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, newStore)
+		})
+	}
+}
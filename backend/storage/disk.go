@@ -0,0 +1,659 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"simplicity/oops"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskDataExt = ".data"
+	diskMetaExt = ".meta"
+	diskTempDir = ".tmp"
+	// diskTempMaxAge is the age after which opening a store removes a temp file, younger ones may
+	// belong to a write in flight of another process on the same root.
+	diskTempMaxAge = time.Hour
+	// diskMaxMetaLen bounds the sidecar read back, a larger one means the file is damaged.
+	diskMaxMetaLen = 1 << 20
+	// diskMaxNameLen is the file name limit of the common file systems, ext4, XFS, APFS and NTFS alike.
+	diskMaxNameLen = 255
+)
+
+// DiskBlobStore keeps every object as two flat files under root, named after the path-escaped key,
+// so "/" never creates directories: the data and a JSON sidecar with its size, ETag, content type and metadata.
+// A write stages both in the temp directory, commits by staging the sidecar last and then moves them into
+// the root, data first. Opening the store finishes the commits a crash interrupted, so a crash leaves either
+// the old or the new object, never a mix of both, and removes the temp files of the writes that were not committed.
+// Data files are never changed once written, Copy and Move link them instead of copying where the file system can.
+//
+// Escaping keeps keys apart only on case-sensitive file systems: on the default macOS and Windows ones
+// "a.png" and "A.png" are the same object. Keys whose escaped name exceeds 250 bytes fail with
+// oops.InvalidKey, every byte outside ASCII takes three, so 28 CJK characters are already too long.
+//
+// Listings are served from a sorted index of the directory, kept up to date by the writes of this store
+// and read again when the directory changes under it, so paging through N keys does not scan it per page.
+type DiskBlobStore struct {
+	root     string
+	mu       sync.RWMutex
+	watchers watchHub
+	// index is nil until the first listing
+	index *diskIndex
+}
+
+// diskMeta is the content of a sidecar file.
+type diskMeta struct {
+	Size        int64             `json:"size"`
+	ETag        string            `json:"etag"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// diskIndex lists the objects of the root sorted by key as of modTime of the directory.
+type diskIndex struct {
+	modTime time.Time
+	objects []ListResult
+}
+
+func NewDiskBlobStore(root string) (*DiskBlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, diskTempDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage root: %w", err)
+	}
+	store := &DiskBlobStore{root: root}
+	if err := store.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover storage root: %w", err)
+	}
+	return store, nil
+}
+
+// recover publishes the staged writes that were committed when the last process stopped,
+// then removes the temp files older than diskTempMaxAge.
+func (s *DiskBlobStore) recover() error {
+	temp := filepath.Join(s.root, diskTempDir)
+	entries, err := os.ReadDir(temp)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), diskMetaExt); ok {
+			if err = s.publish(name); err != nil {
+				return err
+			}
+		}
+	}
+	if entries, err = os.ReadDir(temp); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < diskTempMaxAge {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(temp, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DiskBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	if err := s.refreshIndex(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results, _ := s.index.page(prefix, delimiter, "", 0)
+	return results, nil
+}
+
+func (s *DiskBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	marker, err := listMarker(opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	limit := opts.MaxKeys
+	if limit <= 0 {
+		limit = DefaultMaxKeys
+	}
+	if err = s.refreshIndex(); err != nil {
+		return ListPage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results, more := s.index.page(opts.Prefix, opts.Delimiter, marker, limit)
+	if !more {
+		return ListPage{Results: results}, nil
+	}
+	return ListPage{Results: results, NextToken: continuationToken(results[len(results)-1].Key)}, nil
+}
+
+// refreshIndex reads the directory again when it changed since the index was built.
+func (s *DiskBlobStore) refreshIndex() error {
+	stat, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	fresh := s.index != nil && s.index.modTime.Equal(stat.ModTime())
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the stat is taken before reading, so a change made meanwhile is picked up by the next listing
+	stat, err = os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	objects := make([]ListResult, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), diskMetaExt)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		meta, _, err := s.readMeta(name)
+		if err != nil {
+			// a damaged sidecar fails on its own reads instead of breaking every listing
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, oops.Corrupted) {
+				continue
+			}
+			return err
+		}
+		objects = append(objects, ListResult{IsObject: true, Key: key, Size: int(meta.Size)})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	s.index = &diskIndex{modTime: stat.ModTime(), objects: objects}
+	return nil
+}
+
+// page returns up to limit grouped results after marker, all of them when limit is 0, and whether more follow.
+// It walks the index from the first key after the marker and jumps over the keys of a common prefix at once,
+// so a page costs its own length and not that of the listing.
+func (idx *diskIndex) page(prefix string, delimiter string, marker string, limit int) ([]ListResult, bool) {
+	objects := idx.objects
+	first := sort.Search(len(objects), func(i int) bool { return objects[i].Key >= prefix })
+	if marker >= prefix {
+		first = sort.Search(len(objects), func(i int) bool { return objects[i].Key > marker })
+	}
+	results := make([]ListResult, 0)
+	for i := first; i < len(objects) && strings.HasPrefix(objects[i].Key, prefix); {
+		result := objects[i]
+		i++
+		if delimiter != "" {
+			if n := strings.Index(result.Key[len(prefix):], delimiter); n >= 0 {
+				common := result.Key[:len(prefix)+n+len(delimiter)]
+				result = ListResult{Key: common}
+				i = sort.Search(len(objects), func(j int) bool {
+					return objects[j].Key >= common && !strings.HasPrefix(objects[j].Key, common)
+				})
+				// the marker can fall within the common prefix or name it, as the last key of a page
+				if common <= marker {
+					continue
+				}
+			}
+		}
+		if limit > 0 && len(results) == limit {
+			return results, true
+		}
+		results = append(results, result)
+	}
+	return results, false
+}
+
+// indexPut records key in the index, unless no listing built it yet.
+func (s *DiskBlobStore) indexPut(key string, size int64) {
+	if s.index == nil {
+		return
+	}
+	objects := s.index.objects
+	i := sort.Search(len(objects), func(i int) bool { return objects[i].Key >= key })
+	entry := ListResult{IsObject: true, Key: key, Size: int(size)}
+	if i < len(objects) && objects[i].Key == key {
+		objects[i] = entry
+	} else {
+		objects = append(objects, ListResult{})
+		copy(objects[i+1:], objects[i:])
+		objects[i] = entry
+	}
+	s.index.objects = objects
+	s.indexTouched()
+}
+
+func (s *DiskBlobStore) indexRemove(key string) {
+	if s.index == nil {
+		return
+	}
+	objects := s.index.objects
+	i := sort.Search(len(objects), func(i int) bool { return objects[i].Key >= key })
+	if i < len(objects) && objects[i].Key == key {
+		s.index.objects = append(objects[:i], objects[i+1:]...)
+	}
+	s.indexTouched()
+}
+
+// indexTouched takes the change of the directory made by this store into the index.
+func (s *DiskBlobStore) indexTouched() {
+	if stat, err := os.Stat(s.root); err == nil {
+		s.index.modTime = stat.ModTime()
+	} else {
+		s.index = nil
+	}
+}
+
+func (s *DiskBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+func (s *DiskBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	file, info, err := s.open(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	length, err = resolveRange(offset, length, info.Size)
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return readCloser{io.NewSectionReader(file, offset, length), file}, info, nil
+}
+
+// open returns the data file of key with the info from its sidecar.
+// The open file keeps the object readable as it was even if it is replaced meanwhile.
+func (s *DiskBlobStore) open(key string) (*os.File, ObjectInfo, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	meta, modTime, err := s.readMeta(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, oops.KeyNotFound
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	file, err := os.Open(s.file(name, diskDataExt))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, fmt.Errorf("%w: %s has no data file", oops.Corrupted, key)
+		}
+		return nil, ObjectInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err == nil && stat.Size() != meta.Size {
+		err = fmt.Errorf("%w: %s holds %d bytes, its sidecar %d", oops.Corrupted, key, stat.Size(), meta.Size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return file, ObjectInfo{
+		Size:         meta.Size,
+		LastModified: modTime.UTC(),
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+func (s *DiskBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	file, info, err := s.open(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	file.Close()
+	return info, nil
+}
+
+// readMeta reads the sidecar of name and returns it with its modification time, the time the object was written.
+func (s *DiskBlobStore) readMeta(name string) (diskMeta, time.Time, error) {
+	file, err := os.Open(s.file(name, diskMetaExt))
+	if err != nil {
+		return diskMeta{}, time.Time{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return diskMeta{}, time.Time{}, err
+	}
+	if stat.Size() > diskMaxMetaLen {
+		return diskMeta{}, time.Time{}, fmt.Errorf("%w: sidecar of %d bytes", oops.Corrupted, stat.Size())
+	}
+	meta := diskMeta{}
+	if err = json.NewDecoder(file).Decode(&meta); err != nil {
+		return diskMeta{}, time.Time{}, fmt.Errorf("%w: undecodable sidecar: %v", oops.Corrupted, err)
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = make(map[string]string)
+	}
+	return meta, stat.ModTime(), nil
+}
+
+func (s *DiskBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *DiskBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return "", err
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	hash := md5.New()
+	sniff := &sniffWriter{}
+	data, size, err := s.writeTemp(func(w io.Writer) (int64, error) {
+		return io.Copy(w, io.TeeReader(reader, io.MultiWriter(hash, sniff)))
+	})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(data)
+	meta := diskMeta{Size: size, ETag: hex.EncodeToString(hash.Sum(nil)), ContentType: sniff.ContentType(), Metadata: metadata}
+	sidecar, err := s.writeMeta(meta)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(sidecar)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cond != (Precondition{}) {
+		current, exists, err := s.currentETag(name)
+		if err != nil {
+			return "", err
+		}
+		if err = checkPrecondition(cond, current, exists); err != nil {
+			return "", err
+		}
+	}
+	if err = s.commit(name, data, sidecar); err != nil {
+		return "", err
+	}
+	s.indexPut(key, size)
+	s.watchers.emit(Event{Type: EventPut, Key: key, ETag: meta.ETag})
+	return meta.ETag, nil
+}
+
+func (s *DiskBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	dstName, err := s.name(dst)
+	if err != nil {
+		return err
+	}
+	data, sidecar, meta, err := s.duplicate(src, metadata)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data)
+	defer os.Remove(sidecar)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.commit(dstName, data, sidecar); err != nil {
+		return err
+	}
+	s.indexPut(dst, meta.Size)
+	s.watchers.emit(Event{Type: EventPut, Key: dst, ETag: meta.ETag})
+	return nil
+}
+
+// duplicate writes temp files with the data of src, as it was when opened, and a sidecar with
+// its metadata replaced unless metadata is nil.
+func (s *DiskBlobStore) duplicate(src string, metadata map[string]string) (string, string, diskMeta, error) {
+	srcName, err := s.name(src)
+	if err != nil {
+		return "", "", diskMeta{}, err
+	}
+	file, info, err := s.open(src)
+	if err != nil {
+		return "", "", diskMeta{}, err
+	}
+	defer file.Close()
+	if metadata == nil {
+		metadata = info.Metadata
+	}
+	meta := diskMeta{Size: info.Size, ETag: info.ETag, ContentType: info.ContentType, Metadata: metadata}
+	data, err := s.linkTemp(s.file(srcName, diskDataExt), file)
+	if err != nil {
+		data, _, err = s.writeTemp(func(w io.Writer) (int64, error) {
+			return io.Copy(w, io.NewSectionReader(file, 0, info.Size))
+		})
+		if err != nil {
+			return "", "", diskMeta{}, err
+		}
+	}
+	sidecar, err := s.writeMeta(meta)
+	if err != nil {
+		os.Remove(data)
+		return "", "", diskMeta{}, err
+	}
+	return data, sidecar, meta, nil
+}
+
+// linkTemp links path into the temp directory, provided it still is the data file that is open.
+func (s *DiskBlobStore) linkTemp(path string, open *os.File) (string, error) {
+	reserved, err := os.CreateTemp(filepath.Join(s.root, diskTempDir), "link-*")
+	if err != nil {
+		return "", err
+	}
+	name := reserved.Name()
+	reserved.Close()
+	os.Remove(name)
+	if err = os.Link(path, name); err != nil {
+		return "", err
+	}
+	linked, err := os.Stat(name)
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	opened, err := open.Stat()
+	if err != nil || !os.SameFile(linked, opened) {
+		os.Remove(name)
+		return "", fmt.Errorf("%s was replaced", path)
+	}
+	return name, nil
+}
+
+// Move publishes dst before removing src, a crash in between leaves both keys rather than none.
+func (s *DiskBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	srcName, err := s.name(src)
+	if err != nil {
+		return err
+	}
+	dstName, err := s.name(dst)
+	if err != nil {
+		return err
+	}
+	data, sidecar, meta, err := s.duplicate(src, metadata)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data)
+	defer os.Remove(sidecar)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.commit(dstName, data, sidecar); err != nil {
+		return err
+	}
+	s.indexPut(dst, meta.Size)
+	s.watchers.emit(Event{Type: EventPut, Key: dst, ETag: meta.ETag})
+	if src == dst {
+		return nil
+	}
+	return s.remove(src, srcName)
+}
+
+func (s *DiskBlobStore) Delete(ctx context.Context, key string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(key, name)
+}
+
+func (s *DiskBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		name, err := s.name(key)
+		if err == nil {
+			err = s.remove(key, name)
+		}
+		if err != nil {
+			failed[key] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
+	}
+	return nil
+}
+
+func (s *DiskBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return deleteAll(ctx, s, prefix)
+}
+
+// remove deletes the sidecar, which ends the object, then its data.
+func (s *DiskBlobStore) remove(key string, name string) error {
+	err := os.Remove(s.file(name, diskMetaExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(s.file(name, diskDataExt)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.indexRemove(key)
+	s.watchers.emit(Event{Type: EventDelete, Key: key})
+	return nil
+}
+
+// Watch reports the changes made through this store, not those of other processes sharing the directory.
+func (s *DiskBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.watchers.watch(ctx, prefix), nil
+}
+
+func (s *DiskBlobStore) currentETag(name string) (string, bool, error) {
+	meta, _, err := s.readMeta(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return meta.ETag, true, nil
+}
+
+// commit stages the temp files of an object as name, the sidecar last since its staging is the commit point,
+// and publishes them. The caller holds the write lock.
+func (s *DiskBlobStore) commit(name string, data string, sidecar string) error {
+	staged := filepath.Join(s.root, diskTempDir, name)
+	if err := os.Rename(data, staged+diskDataExt); err != nil {
+		return err
+	}
+	if err := os.Rename(sidecar, staged+diskMetaExt); err != nil {
+		os.Remove(staged + diskDataExt)
+		return err
+	}
+	return s.publish(name)
+}
+
+// publish moves the staged files of name into the root, data first so that the sidecar never names
+// older data. A file that is gone was published by another store on the root already.
+func (s *DiskBlobStore) publish(name string) error {
+	for _, ext := range []string{diskDataExt, diskMetaExt} {
+		staged := filepath.Join(s.root, diskTempDir, name+ext)
+		err := os.Rename(staged, s.file(name, ext))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// renaming a link over the file it links to leaves it in place
+		os.Remove(staged)
+	}
+	return nil
+}
+
+// writeMeta writes a sidecar temp file.
+func (s *DiskBlobStore) writeMeta(meta diskMeta) (string, error) {
+	name, _, err := s.writeTemp(func(w io.Writer) (int64, error) {
+		return 0, json.NewEncoder(w).Encode(meta)
+	})
+	return name, err
+}
+
+// writeTemp fills a fresh file in the temp directory and fsyncs it, so that a following
+// rename publishes either the complete content or nothing. It returns the size write reports.
+func (s *DiskBlobStore) writeTemp(write func(w io.Writer) (int64, error)) (string, int64, error) {
+	file, err := os.CreateTemp(filepath.Join(s.root, diskTempDir), "put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	name := file.Name()
+	size, err := write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", 0, err
+	}
+	return name, size, nil
+}
+
+// name returns the file name of key without its extension, rejecting keys the file system cannot name.
+func (s *DiskBlobStore) name(key string) (string, error) {
+	if key == "" {
+		return "", oops.InvalidKey
+	}
+	name := url.PathEscape(key)
+	if len(name)+len(diskMetaExt) > diskMaxNameLen {
+		return "", fmt.Errorf("%w: %q is too long for a file name", oops.InvalidKey, key)
+	}
+	return name, nil
+}
+
+// file returns the path of the data or sidecar file of name.
+func (s *DiskBlobStore) file(name string, ext string) string {
+	return filepath.Join(s.root, name+ext)
+}
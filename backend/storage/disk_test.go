@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"simplicity/oops"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskBlobStore_PutGet(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+	store, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	_, err = store.Put(ctx, "images/files/1/source.data", strings.NewReader("data1"), map[string]string{"extension": "png"})
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	reopened, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	reader, info, err := reopened.Get(ctx, "images/files/1/source.data")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(data) != "data1" {
+		t.Errorf("Get() data = %q, want %q", data, "data1")
+	}
+	if info.Metadata["extension"] != "png" {
+		t.Errorf("Get() metadata = %v, want extension png", info.Metadata)
+	}
+
+	stat, err := reopened.Stat(ctx, "images/files/1/source.data")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if stat.Size != 5 || stat.ETag != info.ETag || stat.ContentType != "text/plain; charset=utf-8" || stat.Metadata["extension"] != "png" {
+		t.Errorf("Stat() = %+v, want size 5, etag %s, text/plain and the metadata", stat, info.ETag)
+	}
+	if _, err = reopened.Stat(ctx, "images/files/2/source.data"); err != oops.KeyNotFound {
+		t.Errorf("Stat() error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if _, _, err = reopened.Get(ctx, "images/files/2/source.data"); err != oops.KeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if _, err = reopened.Put(ctx, "", strings.NewReader("data"), nil); err != oops.InvalidKey {
+		t.Errorf("Put() error = %v, want %v", err, oops.InvalidKey)
+	}
+}
+
+func TestDiskBlobStore_List(t *testing.T) {
+	store, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"a/2/y", "a/1/x", "a/1/z", "a/b", "b", "../escape"} {
+		if _, err = store.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	tests := []struct {
+		prefix    string
+		delimiter string
+		want      []ListResult
+	}{
+		{prefix: "a/", delimiter: "/", want: []ListResult{
+			{IsObject: false, Key: "a/1/"},
+			{IsObject: false, Key: "a/2/"},
+			{IsObject: true, Key: "a/b", Size: 3},
+		}},
+		{prefix: "a/1", delimiter: "", want: []ListResult{
+			{IsObject: true, Key: "a/1/x", Size: 5},
+			{IsObject: true, Key: "a/1/z", Size: 5},
+		}},
+		{prefix: "", delimiter: "/", want: []ListResult{
+			{IsObject: false, Key: "../"},
+			{IsObject: false, Key: "a/"},
+			{IsObject: true, Key: "b", Size: 1},
+		}},
+	}
+	for _, tt := range tests {
+		result, err := store.List(ctx, tt.prefix, tt.delimiter)
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+		if len(result) != len(tt.want) {
+			t.Fatalf("List(%q, %q) = %v, want %v", tt.prefix, tt.delimiter, result, tt.want)
+		}
+		for i := range result {
+			if result[i] != tt.want[i] {
+				t.Errorf("List(%q, %q) = %v, want %v", tt.prefix, tt.delimiter, result, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDiskBlobStore_Delete(t *testing.T) {
+	store, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"a/1", "a/2", "ab"} {
+		if _, err = store.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	if err = store.Delete(ctx, "ab"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err = store.Delete(ctx, "ab"); err != nil {
+		t.Fatalf("Delete() of a missing key error = %v", err)
+	}
+	if err = store.DeleteAll(ctx, "a"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	result, err := store.List(ctx, "", "")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(result) != 0 {
+		t.Errorf("List() = %v, want empty", result)
+	}
+}
+
+func TestDiskBlobStore_GetRange(t *testing.T) {
+	store, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	if _, err = store.Put(context.Background(), "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	testGetRange(t, store)
+}
+
+func TestDiskBlobStore_CopyMove(t *testing.T) {
+	store, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	testCopyMove(t, store)
+}
+
+func TestDiskBlobStore_Sidecars(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	for _, data := range []string{"first version", "second"} {
+		if _, err = store.Put(ctx, "a/b", strings.NewReader(data), map[string]string{"version": data}); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if err = store.Copy(ctx, "a/b", "a/c", map[string]string{"copied": "true"}); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{".tmp", "a%2Fb.data", "a%2Fb.meta", "a%2Fc.data", "a%2Fc.meta"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("files = %v, want %v", names, want)
+	}
+	temps, err := os.ReadDir(filepath.Join(root, diskTempDir))
+	if err != nil || len(temps) != 0 {
+		t.Errorf("temp files = %v, %v, want none", temps, err)
+	}
+
+	reader, info, err := store.Get(ctx, "a/c")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "second" || info.Size != 6 || info.Metadata["copied"] != "true" {
+		t.Errorf("Get() = %q, %+v, %v, want the second version with the new metadata", data, info, err)
+	}
+
+	// data without a sidecar is no object, a sidecar that does not match its data is no valid one
+	for name, content := range map[string]string{
+		"orphan.data": "data",
+		"torn.data":   "data",
+		"torn.meta":   `{"size":10}`,
+		"broken.data": "data",
+		"broken.meta": `{"size":`,
+	} {
+		if err = os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	if _, err = store.Stat(ctx, "orphan"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of data without a sidecar error = %v, want %v", err, oops.KeyNotFound)
+	}
+	for _, key := range []string{"torn", "broken"} {
+		if _, err = store.Stat(ctx, key); !errors.Is(err, oops.Corrupted) {
+			t.Errorf("Stat(%q) error = %v, want %v", key, err, oops.Corrupted)
+		}
+	}
+}
+
+func TestDiskBlobStore_Recover(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	if _, err = store.Put(ctx, "committed", strings.NewReader("old"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// a crash after the commit point of an overwrite, one before it and the temp files of both
+	temp := filepath.Join(root, diskTempDir)
+	old := time.Now().Add(-2 * diskTempMaxAge)
+	for name, content := range map[string]string{
+		"committed.data": "new",
+		"committed.meta": `{"size":3,"etag":"22af645d1859cb5ca6da0c484f1f37ea","metadata":{"version":"new"}}`,
+		"staged.data":    "uncommitted",
+		"put-1":          "partial",
+		"put-2":          "in flight",
+	} {
+		if err = os.WriteFile(filepath.Join(temp, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if name != "put-2" {
+			os.Chtimes(filepath.Join(temp, name), old, old)
+		}
+	}
+	if store, err = NewDiskBlobStore(root); err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	reader, info, err := store.Get(ctx, "committed")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "new" || info.Metadata["version"] != "new" {
+		t.Errorf("Get() = %q, %+v, %v, want the committed overwrite", data, info, err)
+	}
+	if _, err = store.Stat(ctx, "staged"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of an uncommitted write error = %v, want %v", err, oops.KeyNotFound)
+	}
+	temps, err := os.ReadDir(temp)
+	if err != nil || len(temps) != 1 || temps[0].Name() != "put-2" {
+		t.Errorf("temp files = %v, %v, want only the one of a write that may be in flight", temps, err)
+	}
+}
+
+func TestDiskBlobStore_ListPage(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	keys := make([]ListResult, 0)
+	put := func(store *DiskBlobStore, key string) {
+		if _, err := store.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+		keys = append(keys, ListResult{IsObject: true, Key: key, Size: len(key)})
+	}
+	for i := 0; i < 40; i++ {
+		put(store, fmt.Sprintf("images/%02d/source", i))
+		if i%3 == 0 {
+			put(store, fmt.Sprintf("images/%02d/thumb", i))
+		}
+		if i%4 == 0 {
+			put(store, fmt.Sprintf("images/%02d", i))
+		}
+	}
+	if _, err = store.List(ctx, "", ""); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	// writes of this store and of another one on the same root both show up in the index
+	put(store, "images/40/source")
+	other, err := NewDiskBlobStore(root)
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	put(other, "images/41/source")
+	if err = other.Delete(ctx, "images/00/thumb"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	keys = slices.DeleteFunc(keys, func(result ListResult) bool { return result.Key == "images/00/thumb" })
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	for _, opts := range []ListOptions{
+		{Prefix: "images/", Delimiter: "/", MaxKeys: 7},
+		{Prefix: "images/", MaxKeys: 5},
+		{Prefix: "images/1", Delimiter: "/", MaxKeys: 3},
+		{Delimiter: "/", MaxKeys: 1},
+		{Prefix: "images/", Delimiter: "/", StartAfter: "images/05/", MaxKeys: 4},
+		{Prefix: "images/", Delimiter: "/", StartAfter: "images/05/source", MaxKeys: 4},
+		{Prefix: "images/2", StartAfter: "a", MaxKeys: 2},
+	} {
+		want := slices.DeleteFunc(groupByDelimiter(keys, opts.Prefix, opts.Delimiter), func(result ListResult) bool {
+			return result.Key <= opts.StartAfter
+		})
+		got := make([]ListResult, 0)
+		for page := (ListPage{}); ; {
+			opts.ContinuationToken = page.NextToken
+			if page, err = store.ListPage(ctx, opts); err != nil {
+				t.Fatalf("ListPage(%+v) error = %v", opts, err)
+			}
+			if len(page.Results) > opts.MaxKeys {
+				t.Fatalf("ListPage(%+v) returned %d results", opts, len(page.Results))
+			}
+			got = append(got, page.Results...)
+			if page.NextToken == "" {
+				break
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("ListPage(%+v) pages = %v, want %v", opts, got, want)
+		}
+	}
+}
+
+func TestDiskBlobStore_LongKey(t *testing.T) {
+	store, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	ctx := context.Background()
+	if _, err = store.Put(ctx, strings.Repeat("a", 250), strings.NewReader("data"), nil); err != nil {
+		t.Errorf("Put() of a 255 byte sidecar name error = %v", err)
+	}
+	if _, err = store.Put(ctx, strings.Repeat("画", 28), strings.NewReader("data"), nil); !errors.Is(err, oops.InvalidKey) {
+		t.Errorf("Put() of a 252 byte escaped name error = %v, want %v", err, oops.InvalidKey)
+	}
+}
@@ -0,0 +1,496 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"simplicity/oops"
+	"strings"
+)
+
+// Objects are sealed in chunks of encChunkSize with AES-256-GCM under a random data key per object.
+// The data key is sealed with the current key of the keyring and travels in the object metadata,
+// next to the ID of the key that sealed it. The seal authenticates that ID and the object key, so an
+// object copied or moved under another key below this store fails to open rather than serving content
+// that was written for a different key. Chunk nonces count the chunks and flag the last one,
+// so chunks cannot be reordered, dropped or cut off without failing authentication.
+const (
+	encChunkSize   = 64 * 1024
+	encOverhead    = 16
+	encScheme      = "aes256gcm-64k"
+	encMetaPrefix  = "enc_"
+	encMetaScheme  = "enc_scheme"
+	encMetaKeyID   = "enc_key_id"
+	encMetaDataKey = "enc_data_key"
+	encMetaType    = "enc_content_type"
+)
+
+// EncryptingBlobStore encrypts object content on Put and decrypts it on Get, both streaming.
+// Metadata stays readable, the store needs it to find the data key. Objects without encryption metadata,
+// written before encryption was turned on, are read as they are; Rotate encrypts them.
+// It is no Presigner, a presigned URL would hand out ciphertext; wrap it in a URLSigner instead.
+type EncryptingBlobStore struct {
+	store   BlobStore
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewEncryptingBlobStore takes the keyring as 32 byte AES keys by ID. New objects use the current key,
+// the other keys are needed as long as objects sealed with them exist.
+func NewEncryptingBlobStore(store BlobStore, keys map[string][]byte, current string) (*EncryptingBlobStore, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current encryption key %q is not in the keyring", current)
+	}
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q has %d bytes, want 32", id, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[id] = aead
+	}
+	return &EncryptingBlobStore{store: store, keys: aeads, current: current}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// List reports plaintext sizes, assuming all objects are encrypted.
+func (s *EncryptingBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	results, err := s.store.List(ctx, prefix, delimiter)
+	for i := range results {
+		if results[i].IsObject {
+			results[i].Size = int(plaintextSize(int64(results[i].Size)))
+		}
+	}
+	return results, err
+}
+
+func (s *EncryptingBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := s.store.ListPage(ctx, opts)
+	for i := range page.Results {
+		if page.Results[i].IsObject {
+			page.Results[i].Size = int(plaintextSize(int64(page.Results[i].Size)))
+		}
+	}
+	return page, err
+}
+
+func (s *EncryptingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	reader, info, err := s.store.Get(ctx, key)
+	if err != nil || info.Metadata[encMetaKeyID] == "" {
+		return reader, info, err
+	}
+	aead, err := s.dataKey(key, info.Metadata)
+	if err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	decrypted := newDecryptReader(aead, reader, 0, chunkCount(info.Size))
+	return readCloser{decrypted, reader}, plaintextInfo(info), nil
+}
+
+// GetRange fetches only the chunks that overlap the range and cuts the plaintext to fit.
+func (s *EncryptingBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	if offset < 0 {
+		return nil, ObjectInfo{}, oops.InvalidRange
+	}
+	first := offset / encChunkSize
+	var cipherLength int64
+	if length > 0 {
+		last := (offset + length - 1) / encChunkSize
+		cipherLength = (last - first + 1) * (encChunkSize + encOverhead)
+	}
+	reader, info, err := s.store.GetRange(ctx, key, first*(encChunkSize+encOverhead), cipherLength)
+	if err == nil && info.Metadata[encMetaKeyID] == "" {
+		reader.Close()
+		return s.store.GetRange(ctx, key, offset, length)
+	}
+	if errors.Is(err, oops.InvalidRange) {
+		// the chunk lies beyond the end, tell a legacy object from an encrypted one
+		stat, statErr := s.store.Stat(ctx, key)
+		if statErr == nil && stat.Metadata[encMetaKeyID] == "" {
+			return s.store.GetRange(ctx, key, offset, length)
+		}
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	plain := plaintextInfo(info)
+	length, err = resolveRange(offset, length, plain.Size)
+	if err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, err
+	}
+	aead, err := s.dataKey(key, info.Metadata)
+	if err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	decrypted := newDecryptReader(aead, reader, first, chunkCount(info.Size))
+	if _, err = io.CopyN(io.Discard, decrypted, offset-first*encChunkSize); err != nil {
+		reader.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return readCloser{io.LimitReader(decrypted, length), reader}, plain, nil
+}
+
+func (s *EncryptingBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil || info.Metadata[encMetaKeyID] == "" {
+		return info, err
+	}
+	return plaintextInfo(info), nil
+}
+
+func (s *EncryptingBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *EncryptingBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := newEncryptReader(aead, reader)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := s.sealDataKey(key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	stored := withoutReserved(metadata, encMetaPrefix)
+	stored[encMetaScheme] = encScheme
+	stored[encMetaKeyID] = s.current
+	stored[encMetaDataKey] = sealed
+	stored[encMetaType] = encrypted.contentType
+	return s.store.PutIf(ctx, key, encrypted, stored, cond)
+}
+
+// Copy and Move keep the ciphertext and reseal its data key for dst, the seal binds the object key.
+// Replaced metadata gets the encryption metadata carried over.
+func (s *EncryptingBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := s.rebind(ctx, src, dst, metadata)
+	if err != nil {
+		return err
+	}
+	return s.store.Copy(ctx, src, dst, metadata)
+}
+
+func (s *EncryptingBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	metadata, err := s.rebind(ctx, src, dst, metadata)
+	if err != nil {
+		return err
+	}
+	return s.store.Move(ctx, src, dst, metadata)
+}
+
+// rebind returns the metadata a copy of src at dst is stored with, the encryption metadata of src
+// with the data key sealed for dst and either metadata or the metadata of src.
+func (s *EncryptingBlobStore) rebind(ctx context.Context, src string, dst string, metadata map[string]string) (map[string]string, error) {
+	info, err := s.store.Stat(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if info.Metadata[encMetaKeyID] == "" {
+		if metadata == nil {
+			return nil, nil
+		}
+		return withoutReserved(metadata, encMetaPrefix), nil
+	}
+	if metadata == nil {
+		metadata = info.Metadata
+	}
+	rebound := withoutReserved(metadata, encMetaPrefix)
+	for k, v := range info.Metadata {
+		if strings.HasPrefix(k, encMetaPrefix) {
+			rebound[k] = v
+		}
+	}
+	dataKey, err := s.openDataKey(src, info.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	if rebound[encMetaDataKey], err = s.sealDataKey(dst, dataKey); err != nil {
+		return nil, err
+	}
+	rebound[encMetaKeyID] = s.current
+	return rebound, nil
+}
+
+func (s *EncryptingBlobStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, key)
+}
+
+func (s *EncryptingBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	return s.store.DeleteMany(ctx, keys)
+}
+
+func (s *EncryptingBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return s.store.DeleteAll(ctx, prefix)
+}
+
+func (s *EncryptingBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.store, prefix)
+}
+
+// Rotate reseals the data keys of all objects below prefix that are not sealed with the current key,
+// and encrypts objects that are still stored in plain. Resealed objects keep their ciphertext, only the
+// sealed data key in the metadata changes. Objects written while they are rotated are left to the writer,
+// they are sealed with the current key already. It returns the number of objects changed.
+func (s *EncryptingBlobStore) Rotate(ctx context.Context, prefix string) (int, error) {
+	objects, err := s.store.List(ctx, prefix, "")
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, object := range objects {
+		if !object.IsObject {
+			continue
+		}
+		changed, err := s.rotate(ctx, object.Key)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rotate %s: %w", object.Key, err)
+		}
+		if changed {
+			rotated++
+		}
+	}
+	return rotated, nil
+}
+
+// rotate rewrites key only if it still is what it read, a concurrent write wins and the key is skipped.
+func (s *EncryptingBlobStore) rotate(ctx context.Context, key string) (bool, error) {
+	info, err := s.store.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if info.Metadata[encMetaKeyID] == s.current {
+		return false, nil
+	}
+	reader, info, err := s.store.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	switch info.Metadata[encMetaKeyID] {
+	case s.current:
+		return false, nil
+	case "":
+		_, err = s.PutIf(ctx, key, reader, info.Metadata, Precondition{IfMatch: info.ETag})
+		return skipConflict(err)
+	}
+	dataKey, err := s.openDataKey(key, info.Metadata)
+	if err != nil {
+		return false, err
+	}
+	sealed, err := s.sealDataKey(key, dataKey)
+	if err != nil {
+		return false, err
+	}
+	metadata := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		metadata[k] = v
+	}
+	metadata[encMetaKeyID] = s.current
+	metadata[encMetaDataKey] = sealed
+	_, err = s.store.PutIf(ctx, key, reader, metadata, Precondition{IfMatch: info.ETag})
+	return skipConflict(err)
+}
+
+// skipConflict reports a rotation that lost against a concurrent write as no change.
+func skipConflict(err error) (bool, error) {
+	if errors.Is(err, oops.Conflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *EncryptingBlobStore) sealDataKey(key string, dataKey []byte) (string, error) {
+	aead := s.keys[s.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, sealedData(s.current, key))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *EncryptingBlobStore) openDataKey(key string, metadata map[string]string) ([]byte, error) {
+	id := metadata[encMetaKeyID]
+	if scheme := metadata[encMetaScheme]; scheme != encScheme {
+		return nil, fmt.Errorf("unknown encryption scheme %q", scheme)
+	}
+	aead, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(metadata[encMetaDataKey])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed data key")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, sealedData(id, key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// sealedData is the additional data of a data key seal, the ID of the sealing key and the object key,
+// each prefixed with its length so that no other pair gives the same bytes.
+func sealedData(id string, key string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(id)))
+	data = append(data, id...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+	return append(data, key...)
+}
+
+func (s *EncryptingBlobStore) dataKey(key string, metadata map[string]string) (cipher.AEAD, error) {
+	dataKey, err := s.openDataKey(key, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(dataKey)
+}
+
+func plaintextInfo(info ObjectInfo) ObjectInfo {
+	info.Size = plaintextSize(info.Size)
+	info.ContentType = info.Metadata[encMetaType]
+	info.Metadata = withoutReserved(info.Metadata, encMetaPrefix)
+	return info
+}
+
+// chunkCount is the number of chunks of a ciphertext, every object has at least the final one.
+func chunkCount(cipherSize int64) int64 {
+	return max(1, (cipherSize+encChunkSize+encOverhead-1)/(encChunkSize+encOverhead))
+}
+
+func plaintextSize(cipherSize int64) int64 {
+	return max(0, cipherSize-chunkCount(cipherSize)*encOverhead)
+}
+
+func chunkNonce(aead cipher.AEAD, index int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptReader seals its source chunk by chunk. It reads one byte ahead to know which chunk is the last.
+type encryptReader struct {
+	aead        cipher.AEAD
+	source      *bufio.Reader
+	chunk       []byte
+	sealed      []byte
+	pending     []byte
+	index       int64
+	done        bool
+	contentType string
+}
+
+// newEncryptReader reads the first chunk right away, its content type goes into the metadata.
+func newEncryptReader(aead cipher.AEAD, source io.Reader) (*encryptReader, error) {
+	r := &encryptReader{aead: aead, source: bufio.NewReader(source), chunk: make([]byte, encChunkSize)}
+	if err := r.seal(); err != nil {
+		return nil, err
+	}
+	r.contentType = http.DetectContentType(r.chunk[:min(len(r.chunk), sniffLen)])
+	return r, nil
+}
+
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.source, r.chunk[:encChunkSize])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	r.chunk = r.chunk[:n]
+	last := n < encChunkSize
+	if !last {
+		if _, err = r.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.aead, r.index, last), r.chunk, nil)
+	r.pending = r.sealed
+	r.index++
+	r.done = last
+	return nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// decryptReader opens the chunks from index on, chunks is the number of chunks of the whole object.
+type decryptReader struct {
+	aead    cipher.AEAD
+	source  io.Reader
+	index   int64
+	chunks  int64
+	buffer  []byte
+	pending []byte
+}
+
+func newDecryptReader(aead cipher.AEAD, source io.Reader, index int64, chunks int64) *decryptReader {
+	return &decryptReader{aead: aead, source: source, index: index, chunks: chunks, buffer: make([]byte, encChunkSize+encOverhead)}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.index >= r.chunks {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.source, r.buffer)
+		last := r.index == r.chunks-1
+		if err == io.EOF && n == 0 || err == io.ErrUnexpectedEOF && !last {
+			return 0, fmt.Errorf("encrypted object is truncated at chunk %d: %w", r.index, io.ErrUnexpectedEOF)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		r.pending, err = r.aead.Open(r.buffer[:0], chunkNonce(r.aead, r.index, last), r.buffer[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt chunk %d: %w", r.index, err)
+		}
+		r.index++
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
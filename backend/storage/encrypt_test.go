@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"simplicity/storage/s3test"
+	"strings"
+	"testing"
+)
+
+func testKeys(ids ...string) map[string][]byte {
+	keys := make(map[string][]byte)
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return keys
+}
+
+func newTestEncrypting(t *testing.T, store BlobStore, current string, ids ...string) *EncryptingBlobStore {
+	t.Helper()
+	encrypting, err := NewEncryptingBlobStore(store, testKeys(ids...), current)
+	if err != nil {
+		t.Fatalf("NewEncryptingBlobStore() error = %v", err)
+	}
+	return encrypting
+}
+
+func patterned(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestEncryptingBlobStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := newTestEncrypting(t, backend, "k1", "k1")
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 17} {
+		data := patterned(size)
+		if _, err := store.Put(ctx, "key", bytes.NewReader(data), map[string]string{"extension": "png"}); err != nil {
+			t.Fatalf("Put(%d bytes) error = %v", size, err)
+		}
+		if got := readString(t, store, "key"); got != string(data) {
+			t.Fatalf("Get() of %d bytes returned %d different bytes", size, len(got))
+		}
+		info, err := store.Stat(ctx, "key")
+		if err != nil || info.Size != int64(size) || info.Metadata["extension"] != "png" || info.Metadata[encMetaKeyID] != "" {
+			t.Errorf("Stat() = %+v, %v, want size %d and only the user metadata", info, err, size)
+		}
+		raw := readString(t, backend, "key")
+		if size > 16 && strings.Contains(raw, string(data[:16])) {
+			t.Errorf("stored object contains plaintext")
+		}
+	}
+
+	if _, err := store.Put(ctx, "page", strings.NewReader("<html><body>hi</body></html>"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if info, _ := store.Stat(ctx, "page"); info.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Stat() content type = %q, want the plaintext one", info.ContentType)
+	}
+}
+
+func TestEncryptingBlobStore_GetRange(t *testing.T) {
+	ctx := context.Background()
+	store := newTestEncrypting(t, NewInMemoryBlobStore(), "k1", "k1")
+	if _, err := store.Put(ctx, "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	testGetRange(t, store)
+
+	data := patterned(3*encChunkSize + 17)
+	store.Put(ctx, "large", bytes.NewReader(data), nil)
+	for _, r := range [][2]int64{{encChunkSize - 5, 10}, {2*encChunkSize + 3, 0}, {encChunkSize, encChunkSize}} {
+		reader, info, err := store.GetRange(ctx, "large", r[0], r[1])
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d) error = %v", r[0], r[1], err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		end := int64(len(data))
+		if r[1] > 0 {
+			end = r[0] + r[1]
+		}
+		if err != nil || !bytes.Equal(got, data[r[0]:end]) || info.Size != int64(len(data)) {
+			t.Errorf("GetRange(%d, %d) = %d bytes, %v, want %d bytes of the plaintext", r[0], r[1], len(got), err, end-r[0])
+		}
+	}
+}
+
+func TestEncryptingBlobStore_Tampering(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := newTestEncrypting(t, backend, "k1", "k1")
+	data := patterned(2*encChunkSize + 5)
+	store.Put(ctx, "key", bytes.NewReader(data), nil)
+	_, info, _ := backend.Get(ctx, "key")
+	raw := []byte(readString(t, backend, "key"))
+
+	for name, stored := range map[string][]byte{
+		"flipped byte":   append(append([]byte{}, raw[:100]...), append([]byte{raw[100] ^ 1}, raw[101:]...)...),
+		"last chunk cut": raw[:2*(encChunkSize+encOverhead)],
+		"chunks swapped": append(append(append([]byte{}, raw[encChunkSize+encOverhead:2*(encChunkSize+encOverhead)]...), raw[:encChunkSize+encOverhead]...), raw[2*(encChunkSize+encOverhead):]...),
+	} {
+		backend.Put(ctx, "key", bytes.NewReader(stored), info.Metadata)
+		reader, _, err := store.Get(ctx, "key")
+		if err == nil {
+			_, err = io.ReadAll(reader)
+			reader.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: Get() read without error, want authentication to fail", name)
+		}
+	}
+}
+
+func TestEncryptingBlobStore_Rotate(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	old := newTestEncrypting(t, backend, "k1", "k1")
+	old.Put(ctx, "images/1", strings.NewReader("sealed with k1"), map[string]string{"extension": "png"})
+	backend.Put(ctx, "images/2", strings.NewReader("legacy plaintext"), nil)
+
+	store := newTestEncrypting(t, backend, "k2", "k1", "k2")
+	if got := readString(t, store, "images/1"); got != "sealed with k1" {
+		t.Errorf("Get() with a rotated keyring = %q", got)
+	}
+	if got := readString(t, store, "images/2"); got != "legacy plaintext" {
+		t.Errorf("Get() of a legacy object = %q", got)
+	}
+	rotated, err := store.Rotate(ctx, "images/")
+	if err != nil || rotated != 2 {
+		t.Fatalf("Rotate() = %d, %v, want 2 objects", rotated, err)
+	}
+	if rotated, _ = store.Rotate(ctx, "images/"); rotated != 0 {
+		t.Errorf("second Rotate() = %d, want nothing left to do", rotated)
+	}
+
+	keys := testKeys("k1", "k2")
+	delete(keys, "k1")
+	onlyNew, err := NewEncryptingBlobStore(backend, keys, "k2")
+	if err != nil {
+		t.Fatalf("NewEncryptingBlobStore() error = %v", err)
+	}
+	if got := readString(t, onlyNew, "images/1"); got != "sealed with k1" {
+		t.Errorf("Get() without the old key = %q", got)
+	}
+	if got := readString(t, onlyNew, "images/2"); got != "legacy plaintext" {
+		t.Errorf("Get() of the encrypted legacy object = %q", got)
+	}
+	if info, _ := onlyNew.Stat(ctx, "images/1"); info.Metadata["extension"] != "png" {
+		t.Errorf("Stat() metadata after rotation = %v, want it kept", info.Metadata)
+	}
+}
+
+// racingBlobStore lets another writer in between a Get and whatever the caller does next.
+type racingBlobStore struct {
+	BlobStore
+	afterGet func()
+}
+
+func (s *racingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	reader, info, err := s.BlobStore.Get(ctx, key)
+	if s.afterGet != nil {
+		afterGet := s.afterGet
+		s.afterGet = nil
+		afterGet()
+	}
+	return reader, info, err
+}
+
+func TestEncryptingBlobStore_RotateConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := &racingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	old := newTestEncrypting(t, backend, "k1", "k1")
+	old.Put(ctx, "images/1", strings.NewReader("sealed with k1"), nil)
+	backend.Put(ctx, "images/2", strings.NewReader("legacy plaintext"), nil)
+
+	store := newTestEncrypting(t, backend, "k2", "k1", "k2")
+	for _, key := range []string{"images/1", "images/2"} {
+		backend.afterGet = func() {
+			// the writer still has the old keyring, its write must not be undone by the rotation
+			if _, err := old.Put(ctx, key, strings.NewReader("rewritten"), nil); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+		}
+		if rotated, err := store.Rotate(ctx, key); err != nil || rotated != 0 {
+			t.Errorf("Rotate(%q) = %d, %v, want the key skipped", key, rotated, err)
+		}
+		if got := readString(t, store, key); got != "rewritten" {
+			t.Errorf("Get(%q) after the rotation = %q, want the concurrent write", key, got)
+		}
+	}
+	if rotated, err := store.Rotate(ctx, "images/"); err != nil || rotated != 2 {
+		t.Errorf("Rotate() = %d, %v, want the skipped keys rotated by the next run", rotated, err)
+	}
+}
+
+func TestEncryptingBlobStore_CopyMove(t *testing.T) {
+	testCopyMove(t, newTestEncrypting(t, NewInMemoryBlobStore(), "k1", "k1"))
+}
+
+func TestEncryptingBlobStore_SwappedObjects(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	store := newTestEncrypting(t, backend, "k1", "k1")
+	store.Put(ctx, "public/1", strings.NewReader("public"), nil)
+	store.Put(ctx, "private/1", strings.NewReader("private"), map[string]string{"extension": "png"})
+
+	// a copy below the store keeps the data key sealed for the source
+	_, info, _ := backend.Get(ctx, "private/1")
+	backend.Put(ctx, "public/1", strings.NewReader(readString(t, backend, "private/1")), info.Metadata)
+	if reader, _, err := store.Get(ctx, "public/1"); err == nil {
+		reader.Close()
+		t.Errorf("Get() of an object stored under another key read without error")
+	}
+
+	if err := store.Copy(ctx, "private/1", "public/2", nil); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if got := readString(t, store, "public/2"); got != "private" {
+		t.Errorf("Get() of a copy = %q", got)
+	}
+	if info, _ := store.Stat(ctx, "public/2"); info.Metadata["extension"] != "png" {
+		t.Errorf("Stat() metadata of a copy = %v, want it kept", info.Metadata)
+	}
+}
+
+func TestEncryptingBlobStore_UnderPrefixOverS3(t *testing.T) {
+	_, client := s3test.New(t)
+	s3Store := &S3BlobStore{client: client, bucket: "bucket", partSize: 5000}
+	store := NewPrefixBlobStore(newTestEncrypting(t, s3Store, "k1", "k1"), "images/")
+	data := patterned(encChunkSize + 1000)
+	if _, err := store.Put(context.Background(), "files/1/source.data", bytes.NewReader(data), map[string]string{"extension": "png"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := readString(t, store, "files/1/source.data"); got != string(data) {
+		t.Errorf("Get() returned %d different bytes", len(got))
+	}
+	if info, err := s3Store.Stat(context.Background(), "images/files/1/source.data"); err != nil || info.Metadata[encMetaKeyID] != "k1" {
+		t.Errorf("stored metadata = %v, %v, want the key ID", info.Metadata, err)
+	}
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"context"
+	"simplicity/storage/s3test"
+	"testing"
+	"time"
+)
+
+// NewFakeS3BlobStore returns an S3BlobStore on a fake S3 server for the tests of package storage_test,
+// with small parts so larger objects take the multipart path.
+func NewFakeS3BlobStore(t *testing.T) *S3BlobStore {
+	_, client := s3test.New(t)
+	return &S3BlobStore{client: client, bucket: "bucket", partSize: 256 * 1024}
+}
+
+// NewTestResilientBlobStore returns a ResilientBlobStore for the tests of package storage_test
+// that retries without waiting and reads the time from now.
+func NewTestResilientBlobStore(store BlobStore, opts RetryOptions, now func() time.Time) *ResilientBlobStore {
+	s := NewResilientBlobStore(store, opts)
+	s.now = now
+	s.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	return s
+}
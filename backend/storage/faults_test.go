@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/storage/storagetest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSource(t *testing.T, count int) storage.BlobStore {
+	t.Helper()
+	src := storage.NewInMemoryBlobStore()
+	for i := range count {
+		key := fmt.Sprintf("files/%d/source.data", i)
+		if _, err := src.Put(context.Background(), key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	return src
+}
+
+func TestMirroredBlobStore_SyncReplicaFailure(t *testing.T) {
+	ctx := context.Background()
+	primary, replica := storage.NewInMemoryBlobStore(), newFaulty()
+	store := storage.NewMirroredBlobStore(primary, []storage.BlobStore{replica}, storage.MirrorOptions{})
+	replica.Inject(fail(storagetest.OpPut, "key", errTransient, 1))
+
+	if _, err := store.Put(ctx, "key", strings.NewReader("data"), nil); err != nil {
+		t.Errorf("Put() error = %v, want success once the primary has the write", err)
+	}
+	if got := read(t, primary, "key"); got != "data" {
+		t.Errorf("primary Get() = %q, want the write kept", got)
+	}
+	if stats := store.Stats(); stats.Replicas[0].Failed != 1 || stats.Replicas[0].Unrepaired != 1 || stats.Replicas[0].LastError == "" {
+		t.Errorf("Stats() = %+v, want the failure counted and the key unrepaired", stats)
+	}
+
+	divergences, err := store.Divergence(ctx, "")
+	if err != nil || len(divergences) != 1 || divergences[0] != (storage.Divergence{Replica: 0, Key: "key", Reason: storage.DivergenceMissing}) {
+		t.Fatalf("Divergence() = %v, %v, want key missing on the replica", divergences, err)
+	}
+	if repaired, err := store.Resync(ctx, ""); err != nil || repaired != 1 {
+		t.Errorf("Resync() = %d, %v, want 1 key repaired", repaired, err)
+	}
+	if got := read(t, replica, "key"); got != "data" {
+		t.Errorf("replica Get() after Resync() = %q", got)
+	}
+
+	// an overwrite of the same size cannot be told apart by listing, the recorded failure finds it
+	replica.Inject(fail(storagetest.OpPut, "key", errTransient, 1))
+	if _, err = store.Put(ctx, "key", strings.NewReader("DATA"), nil); err != nil {
+		t.Errorf("Put() error = %v, want success once the primary has the write", err)
+	}
+	divergences, err = store.Divergence(ctx, "")
+	if err != nil || len(divergences) != 1 || divergences[0] != (storage.Divergence{Replica: 0, Key: "key", Reason: storage.DivergenceFailed}) {
+		t.Fatalf("Divergence() = %v, %v, want the failed key", divergences, err)
+	}
+	if repaired, err := store.Resync(ctx, ""); err != nil || repaired != 1 {
+		t.Errorf("Resync() = %d, %v, want 1 key repaired", repaired, err)
+	}
+	if got := read(t, replica, "key"); got != "DATA" {
+		t.Errorf("replica Get() after Resync() = %q", got)
+	}
+	if stats := store.Stats(); stats.Replicas[0].Unrepaired != 0 {
+		t.Errorf("Stats() = %+v, want no unrepaired keys after Resync()", stats)
+	}
+	if divergences, _ = store.Divergence(ctx, ""); len(divergences) != 0 {
+		t.Errorf("Divergence() after Resync() = %v, want none", divergences)
+	}
+}
+
+func TestMirroredBlobStore_Failover(t *testing.T) {
+	ctx := context.Background()
+	primary, replica := newFaulty(), storage.NewInMemoryBlobStore()
+	store := storage.NewMirroredBlobStore(primary, []storage.BlobStore{replica}, storage.MirrorOptions{})
+	store.Put(ctx, "key", strings.NewReader("0123456789"), nil)
+
+	primary.Inject(fail(storagetest.OpGet, "key", errTransient, 1))
+	if got := read(t, store, "key"); got != "0123456789" {
+		t.Errorf("Get() with a failing primary = %q, want the replica copy", got)
+	}
+	primary.Inject(fail(storagetest.OpStat, "key", errTransient, 1))
+	if info, err := store.Stat(ctx, "key"); err != nil || info.Size != 10 {
+		t.Errorf("Stat() with a failing primary = %+v, %v", info, err)
+	}
+	if _, err := store.Stat(ctx, "missing"); err != oops.KeyNotFound {
+		t.Errorf("Stat() of a missing key error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if failovers := store.Stats().Failovers; failovers != 2 {
+		t.Errorf("Stats() failovers = %d, want 2", failovers)
+	}
+
+	down := newFaulty().Inject(fail(storagetest.OpStat, "key", errTransient, 1))
+	store = storage.NewMirroredBlobStore(primary, []storage.BlobStore{down}, storage.MirrorOptions{})
+	primary.Inject(fail(storagetest.OpStat, "key", errTransient, 1))
+	if _, err := store.Stat(ctx, "key"); !errors.Is(err, errTransient) {
+		t.Errorf("Stat() with every store failing error = %v, want the primary failure", err)
+	}
+}
+
+func TestMigrate_Resume(t *testing.T) {
+	src := newSource(t, 11)
+	dst := newFaulty().Inject(fail(storagetest.OpPut, "", errTransient, 2))
+	journal := filepath.Join(t.TempDir(), "migrate.journal")
+
+	report, err := storage.Migrate(context.Background(), src, dst, storage.MigrateOptions{Workers: 1, Journal: journal})
+	if err == nil || report.Copied != 9 || len(report.Failed) != 2 {
+		t.Fatalf("interrupted Migrate() = %+v, %v, want 2 failures", report, err)
+	}
+
+	// a delay of zero records every write without failing it
+	dst.Reset()
+	dst.Inject(storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Delay})
+	report, err = storage.Migrate(context.Background(), src, dst, storage.MigrateOptions{Workers: 2, Journal: journal})
+	if err != nil || report.Copied != 2 || report.Skipped != 9 {
+		t.Errorf("resumed Migrate() = %+v, %v, want only the failed objects copied", report, err)
+	}
+	if writes := hits(dst, storagetest.OpPut); writes != 2 {
+		t.Errorf("resumed Migrate() wrote %d objects, want 2", writes)
+	}
+}
+
+func TestMigrate_ChecksumMismatch(t *testing.T) {
+	dst := newFaulty().Inject(storagetest.Fault{Op: storagetest.OpGet, Action: storagetest.Corrupt})
+	report, err := storage.Migrate(context.Background(), newSource(t, 1), dst, storage.MigrateOptions{})
+	if err == nil || !strings.Contains(report.Failed["files/0/source.data"], "checksum mismatch") {
+		t.Errorf("Migrate() = %+v, %v, want a checksum mismatch", report, err)
+	}
+}
+
+func TestJanitor_DeleteFailure(t *testing.T) {
+	store := newFaulty()
+	deletedAt := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	for _, key := range []string{"deleted-files/1", "deleted-files/2"} {
+		if _, err := store.Put(context.Background(), key, strings.NewReader(key), map[string]string{storage.DeletedAtKey: deletedAt}); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	store.Inject(fail(storagetest.OpDelete, "deleted-files/2", errors.New("access denied"), 1))
+
+	janitor := storage.NewJanitor(store, storage.JanitorOptions{Rules: []storage.LifecycleRule{{Prefix: "deleted-files/", MaxAge: time.Hour}}}, slog.Default())
+	report, err := janitor.Run(context.Background(), false)
+	if err != nil || len(report.Purged) != 1 || report.Failed["deleted-files/2"] != "access denied" {
+		t.Errorf("Run() = %+v, %v, want the failed key reported", report, err)
+	}
+}
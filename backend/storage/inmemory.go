@@ -1,86 +1,222 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"io"
+	"net/http"
 	"simplicity/oops"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type InMemoryBlobStore struct {
+	mu       sync.RWMutex
 	store    map[string][]byte
-	metadata map[string]map[string]string
+	info     map[string]ObjectInfo
+	watchers watchHub
 }
 
 func NewInMemoryBlobStore() *InMemoryBlobStore {
-	return &InMemoryBlobStore{make(map[string][]byte), make(map[string]map[string]string)}
+	return &InMemoryBlobStore{
+		store: make(map[string][]byte),
+		info:  make(map[string]ObjectInfo),
+	}
 }
 
 func (s *InMemoryBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
-	result := make([]ListResult, 0)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objects := make([]ListResult, 0)
 	for k, v := range s.store {
 		if strings.HasPrefix(k, prefix) {
-			base := strings.TrimPrefix(k, prefix)
-			if delimiter == "" {
-				result = append(result, ListResult{IsObject: true, Key: k, Size: len(v)})
-				continue
-			}
-			index := strings.Index(base, delimiter)
-			if index == -1 {
-				result = append(result, ListResult{IsObject: true, Key: k, Size: len(v)})
-				continue
-			}
-			dir := base[:index+1]
-			result = append(result, ListResult{IsObject: false, Key: dir, Size: 0})
+			objects = append(objects, ListResult{IsObject: true, Key: k, Size: len(v)})
 		}
 	}
-	return result, nil
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return groupByDelimiter(objects, prefix, delimiter), nil
+}
+
+func (s *InMemoryBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	results, err := s.List(ctx, opts.Prefix, opts.Delimiter)
+	if err != nil {
+		return ListPage{}, err
+	}
+	return paginate(results, opts)
 }
 
-func (s *InMemoryBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+func (s *InMemoryBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	if key == "" {
+		return nil, ObjectInfo{}, oops.InvalidKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	data, ok := s.store[key]
 	if !ok {
-		return nil, nil, oops.KeyNotFound
+		return nil, ObjectInfo{}, oops.KeyNotFound
 	}
 	reader := io.NopCloser(strings.NewReader(string(data)))
-	metadata, ok := s.metadata[key]
+	return reader, s.info[key], nil
+}
+
+func (s *InMemoryBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	if key == "" {
+		return nil, ObjectInfo{}, oops.InvalidKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.store[key]
 	if !ok {
-		metadata = make(map[string]string)
+		return nil, ObjectInfo{}, oops.KeyNotFound
+	}
+	length, err := resolveRange(offset, length, int64(len(data)))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	reader := io.NopCloser(bytes.NewReader(data[offset : offset+length]))
+	return reader, s.info[key], nil
+}
+
+func (s *InMemoryBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if key == "" {
+		return ObjectInfo{}, oops.InvalidKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.info[key]
+	if !ok {
+		return ObjectInfo{}, oops.KeyNotFound
 	}
-	return reader, metadata, nil
+	return info, nil
+}
+
+func (s *InMemoryBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
 }
-func (s *InMemoryBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+
+func (s *InMemoryBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
 	if key == "" {
-		return oops.InvalidKey
+		return "", oops.InvalidKey
 	}
 	if metadata == nil {
 		metadata = make(map[string]string)
 	}
 	data, err := io.ReadAll(reader)
 	if err != nil {
-		return err
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.info[key]
+	if err = checkPrecondition(cond, current.ETag, exists); err != nil {
+		return "", err
+	}
+	info := ObjectInfo{
+		Size:         int64(len(data)),
+		LastModified: time.Now().UTC(),
+		ContentType:  http.DetectContentType(data),
+		ETag:         contentETag(data),
+		Metadata:     metadata,
 	}
 	s.store[key] = data
-	s.metadata[key] = metadata
+	s.info[key] = info
+	s.watchers.emit(Event{Type: EventPut, Key: key, ETag: info.ETag})
+	return info.ETag, nil
+}
+
+func (s *InMemoryBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if src == "" || dst == "" {
+		return oops.InvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copy(src, dst, metadata)
+}
+
+func (s *InMemoryBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if src == "" || dst == "" {
+		return oops.InvalidKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.copy(src, dst, metadata); err != nil {
+		return err
+	}
+	if src != dst {
+		s.remove(src)
+	}
 	return nil
 }
 
-func (s *InMemoryBlobStore) Delete(ctx context.Context, key string) error {
-	delete(s.store, key)
+// copy shares the content slice, stored data is never modified in place.
+func (s *InMemoryBlobStore) copy(src string, dst string, metadata map[string]string) error {
+	data, ok := s.store[src]
+	if !ok {
+		return oops.KeyNotFound
+	}
+	info := s.info[src]
+	info.LastModified = time.Now().UTC()
+	if metadata != nil {
+		info.Metadata = metadata
+	}
+	s.store[dst] = data
+	s.info[dst] = info
+	s.watchers.emit(Event{Type: EventPut, Key: dst, ETag: info.ETag})
 	return nil
 }
 
-func (s *InMemoryBlobStore) DeleteAll(ctx context.Context, prefix string) error {
-	if prefix == "" {
+func (s *InMemoryBlobStore) Delete(ctx context.Context, key string) error {
+	if key == "" {
 		return oops.InvalidKey
 	}
-	if !strings.HasSuffix(prefix, Delimiter) {
-		prefix += Delimiter
-	}
-	for k := range s.store {
-		if strings.HasPrefix(k, prefix) {
-			delete(s.store, k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	return nil
+}
+
+func (s *InMemoryBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if key == "" {
+			failed[key] = oops.InvalidKey
+			continue
 		}
+		s.remove(key)
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
 	}
 	return nil
 }
+
+func (s *InMemoryBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return deleteAll(ctx, s, prefix)
+}
+
+func (s *InMemoryBlobStore) remove(key string) {
+	if _, ok := s.store[key]; !ok {
+		return
+	}
+	delete(s.store, key)
+	delete(s.info, key)
+	s.watchers.emit(Event{Type: EventDelete, Key: key})
+}
+
+// Watch reports the changes made through this store.
+func (s *InMemoryBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.watchers.watch(ctx, prefix), nil
+}
+
+func contentETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
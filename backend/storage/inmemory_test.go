@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"simplicity/oops"
 	"strings"
 	"testing"
 )
@@ -63,3 +66,207 @@ func TestInMemoryBlobStore_List(t *testing.T) {
 		}
 	}
 }
+
+func TestInMemoryBlobStore_PutIf(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	ctx := context.Background()
+
+	etag, err := store.PutIf(ctx, "key", strings.NewReader("v1"), nil, Precondition{IfNoneMatch: true})
+	if err != nil {
+		t.Fatalf("PutIf() error = %v", err)
+	}
+	if _, err = store.PutIf(ctx, "key", strings.NewReader("v2"), nil, Precondition{IfNoneMatch: true}); err != oops.Conflict {
+		t.Errorf("PutIf() create-only error = %v, want %v", err, oops.Conflict)
+	}
+	if _, err = store.PutIf(ctx, "missing", strings.NewReader("v2"), nil, Precondition{IfMatch: etag}); err != oops.Conflict {
+		t.Errorf("PutIf() of a missing key error = %v, want %v", err, oops.Conflict)
+	}
+	next, err := store.PutIf(ctx, "key", strings.NewReader("v2"), nil, Precondition{IfMatch: etag})
+	if err != nil {
+		t.Fatalf("PutIf() error = %v", err)
+	}
+	if _, err = store.PutIf(ctx, "key", strings.NewReader("v3"), nil, Precondition{IfMatch: etag}); err != oops.Conflict {
+		t.Errorf("PutIf() with stale etag error = %v, want %v", err, oops.Conflict)
+	}
+	reader, info, err := store.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	reader.Close()
+	if info.ETag != next {
+		t.Errorf("Get() etag = %q, want %q", info.ETag, next)
+	}
+}
+
+func TestInMemoryBlobStore_ListPage(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	ctx := context.Background()
+	for _, key := range []string{"a/1/x", "a/1/y", "a/2/x", "a/3", "a/4/x", "b"} {
+		store.Put(ctx, key, strings.NewReader(key), nil)
+	}
+	want := []string{"a/1/", "a/2/", "a/3", "a/4/"}
+
+	var keys []string
+	opts := ListOptions{Prefix: "a/", Delimiter: "/", MaxKeys: 3}
+	for pages := 1; ; pages++ {
+		page, err := store.ListPage(ctx, opts)
+		if err != nil {
+			t.Fatalf("ListPage() error = %v", err)
+		}
+		if len(page.Results) > opts.MaxKeys {
+			t.Fatalf("ListPage() = %v, more than %d results", page.Results, opts.MaxKeys)
+		}
+		for _, r := range page.Results {
+			keys = append(keys, r.Key)
+		}
+		if page.NextToken == "" {
+			if pages != 2 {
+				t.Errorf("ListPage() took %d pages, want 2", pages)
+			}
+			break
+		}
+		opts.ContinuationToken = page.NextToken
+	}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("ListPage() keys = %v, want %v", keys, want)
+	}
+
+	page, err := store.ListPage(ctx, ListOptions{Prefix: "a/", Delimiter: "/", StartAfter: "a/2/"})
+	if err != nil {
+		t.Fatalf("ListPage() error = %v", err)
+	}
+	if len(page.Results) != 2 || page.Results[0].Key != "a/3" {
+		t.Errorf("ListPage() after a/2/ = %v, want a/3 and a/4/", page.Results)
+	}
+
+	if _, err = store.ListPage(ctx, ListOptions{ContinuationToken: "!"}); !errors.Is(err, oops.ValidationError) {
+		t.Errorf("ListPage() with a broken token error = %v, want %v", err, oops.ValidationError)
+	}
+}
+
+func TestInMemoryBlobStore_Stat(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	ctx := context.Background()
+	etag, err := store.Put(ctx, "key", strings.NewReader("\xFF\xD8\xFF\xE0data"), map[string]string{"extension": "jpeg"})
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	info, err := store.Stat(ctx, "key")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size != 8 || info.ETag != etag || info.ContentType != "image/jpeg" || info.Metadata["extension"] != "jpeg" {
+		t.Errorf("Stat() = %+v, want size 8, etag %s, image/jpeg and the metadata", info, etag)
+	}
+	if _, err = store.Stat(ctx, "missing"); err != oops.KeyNotFound {
+		t.Errorf("Stat() error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+func TestInMemoryBlobStore_GetRange(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	if _, err := store.Put(context.Background(), "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	testGetRange(t, store)
+}
+
+// testGetRange expects "key" to hold "0123456789".
+func testGetRange(t *testing.T, store BlobStore) {
+	tests := []struct {
+		offset int64
+		length int64
+		want   string
+		err    error
+	}{
+		{offset: 0, length: 0, want: "0123456789"},
+		{offset: 2, length: 3, want: "234"},
+		{offset: 7, length: 0, want: "789"},
+		{offset: 7, length: 10, want: "789"},
+		{offset: 10, length: 1, err: oops.InvalidRange},
+	}
+	for _, tt := range tests {
+		reader, info, err := store.GetRange(context.Background(), "key", tt.offset, tt.length)
+		if err != tt.err {
+			t.Errorf("GetRange(%d, %d) error = %v, want %v", tt.offset, tt.length, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, %v, want %q", tt.offset, tt.length, data, err, tt.want)
+		}
+		if info.Size != 10 {
+			t.Errorf("GetRange(%d, %d) size = %d, want the object size 10", tt.offset, tt.length, info.Size)
+		}
+	}
+	if _, _, err := store.GetRange(context.Background(), "missing", 0, 1); err != oops.KeyNotFound {
+		t.Errorf("GetRange() error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+func TestInMemoryBlobStore_CopyMove(t *testing.T) {
+	testCopyMove(t, NewInMemoryBlobStore())
+}
+
+func testCopyMove(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	if _, err := store.Put(ctx, "files/1/source.data", strings.NewReader("data"), map[string]string{"extension": "png"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := store.Copy(ctx, "files/1/source.data", "files/2/source.data", nil); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := store.Move(ctx, "files/1/source.data", "deleted-files/1/source.data", nil); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	for _, key := range []string{"files/2/source.data", "deleted-files/1/source.data"} {
+		reader, info, err := store.Get(ctx, key)
+		if err != nil {
+			t.Errorf("Get(%q) error = %v", key, err)
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "data" || info.Metadata["extension"] != "png" {
+			t.Errorf("Get(%q) = %q, %v, %v, want the copied data and metadata", key, data, info.Metadata, err)
+		}
+	}
+	if _, err := store.Stat(ctx, "files/1/source.data"); err != oops.KeyNotFound {
+		t.Errorf("Stat() of the moved key error = %v, want %v", err, oops.KeyNotFound)
+	}
+	replaced := map[string]string{"extension": "png", "deleted_at": "2025-01-01T00:00:00Z"}
+	if err := store.Move(ctx, "files/2/source.data", "deleted-files/2/source.data", replaced); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	info, err := store.Stat(ctx, "deleted-files/2/source.data")
+	if err != nil || info.Metadata["deleted_at"] != replaced["deleted_at"] || info.Size != 4 {
+		t.Errorf("Stat() = %+v, %v, want the replaced metadata", info, err)
+	}
+	if err := store.Copy(ctx, "missing", "files/3", nil); err != oops.KeyNotFound {
+		t.Errorf("Copy() of a missing key error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if err := store.Move(ctx, "missing", "files/3", nil); err != oops.KeyNotFound {
+		t.Errorf("Move() of a missing key error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+func TestInMemoryBlobStore_DeleteMany(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	ctx := context.Background()
+	for _, key := range []string{"a/1", "a/2", "b"} {
+		store.Put(ctx, key, strings.NewReader(key), nil)
+	}
+	err := store.DeleteMany(ctx, []string{"a/1", "", "missing", "b"})
+	var deleteErr *DeleteError
+	if !errors.As(err, &deleteErr) || len(deleteErr.Failed) != 1 || deleteErr.Failed[""] != oops.InvalidKey {
+		t.Errorf("DeleteMany() error = %v, want the empty key to fail", err)
+	}
+	result, _ := store.List(ctx, "", "")
+	if len(result) != 1 || result[0].Key != "a/2" {
+		t.Errorf("List() = %v, want a/2 only", result)
+	}
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"simplicity/oops"
+	"sync"
+	"time"
+)
+
+// DeletedAtKey is the metadata key holding when an object was deleted, as an RFC 3339 timestamp.
+// Deleting moves objects aside and stamps them with it, the Janitor purges them once they are old enough.
+const DeletedAtKey = "deleted_at"
+
+// LifecycleRule purges the objects under Prefix whose deletion timestamp is older than MaxAge.
+type LifecycleRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+// JanitorOptions configure a Janitor. Start runs it every Interval, a DryRun only reports what would be purged.
+type JanitorOptions struct {
+	Rules    []LifecycleRule
+	Interval time.Duration
+	DryRun   bool
+}
+
+const defaultJanitorInterval = 24 * time.Hour
+
+// JanitorReport is the result of a run. Undated objects have no deletion timestamp and are kept,
+// Purged lists the expired keys, which are still there after a dry run.
+type JanitorReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	DryRun     bool              `json:"dry_run"`
+	Checked    int               `json:"checked"`
+	Undated    int               `json:"undated"`
+	Purged     []string          `json:"purged"`
+	Bytes      int64             `json:"bytes"`
+	Failed     map[string]string `json:"failed,omitempty"`
+}
+
+// Janitor applies lifecycle rules to a store, one run at a time.
+type Janitor struct {
+	store  BlobStore
+	opts   JanitorOptions
+	logger *slog.Logger
+	now    func() time.Time
+	run    sync.Mutex
+	mu     sync.Mutex
+	last   *JanitorReport
+	stop   context.CancelFunc
+	done   chan struct{}
+}
+
+func NewJanitor(store BlobStore, opts JanitorOptions, logger *slog.Logger) *Janitor {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultJanitorInterval
+	}
+	return &Janitor{store: store, opts: opts, logger: logger.With("component", "janitor"), now: time.Now}
+}
+
+// DryRun tells whether the runs of Start are dry runs.
+func (j *Janitor) DryRun() bool {
+	return j.opts.DryRun
+}
+
+// Last returns the report of the latest run, nil before the first one.
+func (j *Janitor) Last() *JanitorReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last
+}
+
+// Start runs the janitor now and then every Interval until Close.
+func (j *Janitor) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	j.stop, j.done = stop, make(chan struct{})
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(j.opts.Interval)
+		defer ticker.Stop()
+		for {
+			j.Run(ctx, j.opts.DryRun)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the runs of Start, cancelling the current one.
+func (j *Janitor) Close() error {
+	if j.stop != nil {
+		j.stop()
+		<-j.done
+	}
+	return nil
+}
+
+// Run applies every rule once. Objects are purged in batches after their rule has been listed,
+// failures are reported per key and do not stop the run.
+func (j *Janitor) Run(ctx context.Context, dryRun bool) (JanitorReport, error) {
+	j.run.Lock()
+	defer j.run.Unlock()
+	report := JanitorReport{StartedAt: j.now(), DryRun: dryRun, Purged: make([]string, 0), Failed: make(map[string]string)}
+	j.logger.InfoContext(ctx, "Janitor run started", "DryRun", dryRun, "Rules", len(j.opts.Rules))
+
+	var err error
+	for _, rule := range j.opts.Rules {
+		if err = j.apply(ctx, rule, dryRun, &report); err != nil {
+			break
+		}
+	}
+	report.FinishedAt = j.now()
+	j.mu.Lock()
+	j.last = &report
+	j.mu.Unlock()
+	if err != nil {
+		j.logger.ErrorContext(ctx, "Janitor run failed", "Purged", len(report.Purged), "Error:", err.Error())
+		return report, err
+	}
+	j.logger.InfoContext(ctx, "Janitor run finished", "DryRun", dryRun, "Checked", report.Checked,
+		"Purged", len(report.Purged), "Bytes", report.Bytes, "Undated", report.Undated, "Failed", len(report.Failed))
+	return report, nil
+}
+
+func (j *Janitor) apply(ctx context.Context, rule LifecycleRule, dryRun bool, report *JanitorReport) error {
+	cutoff := j.now().Add(-rule.MaxAge)
+	var expired []string
+	sizes := make(map[string]int64)
+	err := listObjects(ctx, j.store, rule.Prefix, func(result ListResult) error {
+		info, err := j.store.Stat(ctx, result.Key)
+		if errors.Is(err, oops.KeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			report.Failed[result.Key] = err.Error()
+			return nil
+		}
+		report.Checked++
+		deletedAt, err := time.Parse(time.RFC3339, info.Metadata[DeletedAtKey])
+		if err != nil {
+			report.Undated++
+			return nil
+		}
+		if deletedAt.Before(cutoff) {
+			expired = append(expired, result.Key)
+			sizes[result.Key] = info.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(expired); start += deleteBatchSize {
+		batch := expired[start:min(start+deleteBatchSize, len(expired))]
+		failed := make(map[string]error)
+		if !dryRun {
+			var deleteErr *DeleteError
+			if err = j.store.DeleteMany(ctx, batch); errors.As(err, &deleteErr) {
+				failed = deleteErr.Failed
+			} else if err != nil {
+				return err
+			}
+		}
+		for _, key := range batch {
+			if keyErr, ok := failed[key]; ok {
+				report.Failed[key] = keyErr.Error()
+				continue
+			}
+			report.Purged = append(report.Purged, key)
+			report.Bytes += sizes[key]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var janitorNow = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestJanitor(store BlobStore, opts JanitorOptions) *Janitor {
+	janitor := NewJanitor(store, opts, slog.Default())
+	janitor.now = func() time.Time { return janitorNow }
+	return janitor
+}
+
+func putDeleted(t *testing.T, store BlobStore, key string, age time.Duration) {
+	t.Helper()
+	metadata := map[string]string{"extension": "png"}
+	if age > 0 {
+		metadata[DeletedAtKey] = janitorNow.Add(-age).Format(time.RFC3339)
+	}
+	if _, err := store.Put(context.Background(), key, strings.NewReader(key), metadata); err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+}
+
+func TestJanitor_Run(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryBlobStore()
+	day := 24 * time.Hour
+	putDeleted(t, store, "images/deleted-files/1/source.data", 40*day)
+	putDeleted(t, store, "images/deleted-files/2/source.data", 31*day)
+	putDeleted(t, store, "images/deleted-files/3/source.data", day)
+	putDeleted(t, store, "images/deleted-files/4/source.data", 0)
+	putDeleted(t, store, "images/files/5/source.data", 40*day)
+	janitor := newTestJanitor(store, JanitorOptions{Rules: []LifecycleRule{{Prefix: "images/deleted-files/", MaxAge: 30 * day}}})
+	if janitor.Last() != nil {
+		t.Errorf("Last() before any run = %+v, want nil", janitor.Last())
+	}
+
+	expired := []string{"images/deleted-files/1/source.data", "images/deleted-files/2/source.data"}
+	report, err := janitor.Run(ctx, true)
+	if err != nil || !report.DryRun || report.Checked != 4 || report.Undated != 1 || !reflect.DeepEqual(report.Purged, expired) ||
+		report.Bytes != int64(2*len(expired[0])) {
+		t.Fatalf("dry Run() = %+v, %v, want 2 objects to purge", report, err)
+	}
+	if results, _ := store.List(ctx, "images/", ""); len(results) != 5 {
+		t.Errorf("dry Run() left %d objects, want all 5", len(results))
+	}
+
+	report, err = janitor.Run(ctx, false)
+	if err != nil || report.DryRun || !reflect.DeepEqual(report.Purged, expired) {
+		t.Fatalf("Run() = %+v, %v, want 2 objects purged", report, err)
+	}
+	for _, key := range expired {
+		if _, err := store.Stat(ctx, key); err == nil {
+			t.Errorf("Stat(%q) after Run() error = nil, want it purged", key)
+		}
+	}
+	if results, _ := store.List(ctx, "images/", ""); len(results) != 3 {
+		t.Errorf("Run() left %d objects, want 3", len(results))
+	}
+	if last := janitor.Last(); last == nil || last.DryRun || len(last.Purged) != 2 {
+		t.Errorf("Last() = %+v, want the report of the latest run", last)
+	}
+}
+
+func TestJanitor_Start(t *testing.T) {
+	store := NewInMemoryBlobStore()
+	putDeleted(t, store, "deleted-files/1", 48*time.Hour)
+	janitor := newTestJanitor(store, JanitorOptions{Rules: []LifecycleRule{{Prefix: "deleted-files/", MaxAge: time.Hour}}, Interval: time.Hour})
+	janitor.Start()
+	deadline := time.Now().Add(time.Second)
+	for janitor.Last() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	janitor.Close()
+	if last := janitor.Last(); last == nil || len(last.Purged) != 1 {
+		t.Errorf("Last() after Start() = %+v, want a run right away", last)
+	}
+}
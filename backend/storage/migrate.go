@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"simplicity/oops"
+	"sync"
+)
+
+// MigrateOptions control Migrate. Only keys under Prefix are copied, by Workers in parallel.
+// A DryRun lists what would be copied without writing anything. Journal names a file that records
+// every verified object, a migration restarted with the journal of an interrupted one skips them.
+// Source and Destination name the stores in the journal, which is refused for any other pair.
+type MigrateOptions struct {
+	Prefix      string
+	Workers     int
+	DryRun      bool
+	Journal     string
+	Source      string
+	Destination string
+}
+
+const defaultMigrateWorkers = 4
+
+// MigrateReport counts the objects of a migration, for a dry run Copied and Bytes are what would be copied.
+// Failed maps keys that were not migrated to the reason.
+type MigrateReport struct {
+	Copied  int               `json:"copied"`
+	Skipped int               `json:"skipped"`
+	Bytes   int64             `json:"bytes"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// journalHeader is the first line of a journal, it ties the journal to the stores it was written for.
+type journalHeader struct {
+	Journal     string `json:"journal"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+const journalKind = "migrate"
+
+type journalEntry struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Migrate copies every object under opts.Prefix from src to dst with its metadata. Each copy is read back
+// from dst and compared with the source by size and SHA-256 before it counts as migrated. Objects that
+// fail are reported and the rest carry on, the returned error then says how many failed.
+func Migrate(ctx context.Context, src BlobStore, dst BlobStore, opts MigrateOptions) (MigrateReport, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultMigrateWorkers
+	}
+	report := MigrateReport{Failed: make(map[string]string)}
+	header := journalHeader{Journal: journalKind, Source: opts.Source, Destination: opts.Destination}
+	done, journal, err := openJournal(opts.Journal, opts.DryRun, header)
+	if err != nil {
+		return report, err
+	}
+	if journal != nil {
+		defer journal.Close()
+	}
+
+	var mu sync.Mutex
+	var workers sync.WaitGroup
+	keys := make(chan ListResult)
+	for range opts.Workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for result := range keys {
+				entry, err := migrateObject(ctx, src, dst, result.Key)
+				mu.Lock()
+				if err == nil && journal != nil {
+					err = journal.record(entry)
+				}
+				if err != nil {
+					report.Failed[result.Key] = err.Error()
+				} else {
+					report.Copied++
+					report.Bytes += entry.Size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	listErr := listObjects(ctx, src, opts.Prefix, func(result ListResult) error {
+		switch {
+		case done[result.Key]:
+			mu.Lock()
+			report.Skipped++
+			mu.Unlock()
+		case opts.DryRun:
+			mu.Lock()
+			report.Copied++
+			report.Bytes += int64(result.Size)
+			mu.Unlock()
+		default:
+			select {
+			case keys <- result:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	close(keys)
+	workers.Wait()
+	if listErr != nil {
+		return report, fmt.Errorf("failed to list source: %w", listErr)
+	}
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("failed to migrate %d of %d objects", len(report.Failed), len(report.Failed)+report.Copied+report.Skipped)
+	}
+	return report, nil
+}
+
+// listObjects calls fn for every object under prefix, page by page.
+func listObjects(ctx context.Context, store BlobStore, prefix string, fn func(result ListResult) error) error {
+	opts := ListOptions{Prefix: prefix, MaxKeys: DefaultMaxKeys}
+	for {
+		page, err := store.ListPage(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, result := range page.Results {
+			if !result.IsObject {
+				continue
+			}
+			if err = fn(result); err != nil {
+				return err
+			}
+		}
+		if page.NextToken == "" {
+			return nil
+		}
+		opts.ContinuationToken = page.NextToken
+	}
+}
+
+func migrateObject(ctx context.Context, src BlobStore, dst BlobStore, key string) (journalEntry, error) {
+	reader, info, err := src.Get(ctx, key)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	defer reader.Close()
+	source := newHashingReader(reader)
+	if _, err = dst.Put(ctx, key, source, info.Metadata); err != nil {
+		return journalEntry{}, err
+	}
+	if source.size != info.Size {
+		return journalEntry{}, fmt.Errorf("read %d bytes of %d", source.size, info.Size)
+	}
+	sum := hex.EncodeToString(source.hash.Sum(nil))
+
+	copied, _, err := dst.Get(ctx, key)
+	if err != nil {
+		return journalEntry{}, fmt.Errorf("failed to read back: %w", err)
+	}
+	defer copied.Close()
+	check := newHashingReader(copied)
+	if _, err = io.Copy(io.Discard, check); err != nil {
+		return journalEntry{}, fmt.Errorf("failed to read back: %w", err)
+	}
+	if check.size != info.Size {
+		return journalEntry{}, fmt.Errorf("size mismatch: copied %d bytes of %d", check.size, info.Size)
+	}
+	if copiedSum := hex.EncodeToString(check.hash.Sum(nil)); copiedSum != sum {
+		return journalEntry{}, fmt.Errorf("checksum mismatch: copied %s of %s", copiedSum, sum)
+	}
+	return journalEntry{Key: key, Size: info.Size, SHA256: sum}, nil
+}
+
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func newHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{reader: reader, hash: sha256.New()}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+type migrateJournal struct {
+	file *os.File
+}
+
+// openJournal reads the keys an earlier run has migrated and opens the journal for appending,
+// a dry run only reads it. Without a path there is nothing to skip and nothing is recorded.
+// A journal with another header than the given one belongs to other stores and fails the migration,
+// skipping its keys would leave them missing in the destination.
+func openJournal(path string, readOnly bool, header journalHeader) (map[string]bool, *migrateJournal, error) {
+	done := make(map[string]bool)
+	if path == "" {
+		return done, nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	// without a complete line not even the header made it to disk
+	if !bytes.Contains(data, []byte("\n")) {
+		data = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if scanner.Scan() {
+		var written journalHeader
+		if json.Unmarshal(scanner.Bytes(), &written) != nil || written.Journal != journalKind {
+			return nil, nil, fmt.Errorf("%w: %s is not a migration journal", oops.ValidationError, path)
+		}
+		if written != header {
+			return nil, nil, fmt.Errorf("%w: journal %s is for the migration from %q to %q, not from %q to %q",
+				oops.ValidationError, path, written.Source, written.Destination, header.Source, header.Destination)
+		}
+	}
+	for scanner.Scan() {
+		var entry journalEntry
+		// a line cut off by the interruption is ignored, its object is copied again
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Key != "" {
+			done[entry.Key] = true
+		}
+	}
+	if readOnly {
+		return done, nil, nil
+	}
+	if len(data) == 0 {
+		journal, err := createJournal(path, header)
+		return done, journal, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	if data[len(data)-1] != '\n' {
+		file.Write([]byte("\n"))
+	}
+	return done, &migrateJournal{file: file}, nil
+}
+
+func createJournal(path string, header journalHeader) (*migrateJournal, error) {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal: %w", err)
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write journal: %w", err)
+	}
+	return &migrateJournal{file: file}, nil
+}
+
+func (j *migrateJournal) record(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+func (j *migrateJournal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"simplicity/oops"
+	"strings"
+	"testing"
+)
+
+func newMigrateSource(t *testing.T, count int) BlobStore {
+	t.Helper()
+	src := NewInMemoryBlobStore()
+	for i := range count {
+		key := fmt.Sprintf("files/%d/source.data", i)
+		if _, err := src.Put(context.Background(), key, strings.NewReader(key), map[string]string{"extension": "png"}); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	src.Put(context.Background(), "item/items.js", strings.NewReader("{}"), nil)
+	return src
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src := newMigrateSource(t, 25)
+	dst, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+
+	report, err := Migrate(ctx, src, dst, MigrateOptions{Workers: 3})
+	if err != nil || report.Copied != 26 || report.Skipped != 0 || len(report.Failed) != 0 {
+		t.Fatalf("Migrate() = %+v, %v, want 26 objects copied", report, err)
+	}
+	if got := readString(t, dst, "files/7/source.data"); got != "files/7/source.data" {
+		t.Errorf("Get() of a migrated object = %q", got)
+	}
+	if info, err := dst.Stat(ctx, "files/7/source.data"); err != nil || info.Metadata["extension"] != "png" {
+		t.Errorf("Stat() of a migrated object = %+v, %v, want the metadata kept", info, err)
+	}
+}
+
+func TestMigrate_DryRun(t *testing.T) {
+	src := newMigrateSource(t, 3)
+	dst := NewInMemoryBlobStore()
+	report, err := Migrate(context.Background(), src, dst, MigrateOptions{Prefix: "files/", DryRun: true})
+	if err != nil || report.Copied != 3 || report.Bytes != 3*int64(len("files/0/source.data")) {
+		t.Errorf("Migrate() dry run = %+v, %v, want 3 objects to copy", report, err)
+	}
+	if results, _ := dst.List(context.Background(), "", ""); len(results) != 0 {
+		t.Errorf("dry run wrote %v", results)
+	}
+}
+
+func TestMigrate_JournalOfOtherStores(t *testing.T) {
+	ctx := context.Background()
+	src := newMigrateSource(t, 3)
+	journal := filepath.Join(t.TempDir(), "migrate.journal")
+	opts := MigrateOptions{Journal: journal, Source: "s3://bucket", Destination: "disk:./data"}
+	if _, err := Migrate(ctx, src, NewInMemoryBlobStore(), opts); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	dst := NewInMemoryBlobStore()
+	opts.Destination = "disk:./other"
+	report, err := Migrate(ctx, src, dst, opts)
+	if !errors.Is(err, oops.ValidationError) || report.Skipped != 0 {
+		t.Errorf("Migrate() with the journal of another destination = %+v, %v, want it refused", report, err)
+	}
+	if results, _ := dst.List(ctx, "", ""); len(results) != 0 {
+		t.Errorf("refused Migrate() wrote %v", results)
+	}
+
+	if err = os.WriteFile(journal, []byte(`{"key":"files/0/source.data","size":19,"sha256":""}`+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err = Migrate(ctx, src, dst, opts); !errors.Is(err, oops.ValidationError) {
+		t.Errorf("Migrate() with a journal without header error = %v, want %v", err, oops.ValidationError)
+	}
+}
@@ -0,0 +1,486 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"simplicity/oops"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorOptions configure a MirroredBlobStore. Async writes return once the primary has the change and
+// replicas catch up from a queue of QueueSize operations, a full queue blocks writers until there is room.
+type MirrorOptions struct {
+	Async     bool
+	QueueSize int
+}
+
+const defaultMirrorQueueSize = 1024
+
+type MirrorStats struct {
+	Failovers int64          `json:"failovers"`
+	Replicas  []ReplicaStats `json:"replicas"`
+}
+
+// ReplicaStats report how far a replica is behind: Pending operations are queued or running
+// and the oldest of them was queued LagSeconds ago. Failed operations are not retried, their keys
+// are counted in Unrepaired until a later write of the key or Resync repairs them.
+type ReplicaStats struct {
+	Pending    int       `json:"pending"`
+	LagSeconds float64   `json:"lag_seconds"`
+	Replicated int64     `json:"replicated"`
+	Failed     int64     `json:"failed"`
+	Unrepaired int       `json:"unrepaired"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastSync   time.Time `json:"last_sync"`
+}
+
+// Divergence is a key that differs between the primary and a replica, Reason is one of
+// DivergenceMissing, DivergenceExtra, DivergenceSize and DivergenceFailed.
+type Divergence struct {
+	Replica int    `json:"replica"`
+	Key     string `json:"key"`
+	Reason  string `json:"reason"`
+}
+
+const (
+	DivergenceMissing = "missing"
+	DivergenceExtra   = "extra"
+	DivergenceSize    = "size"
+	// DivergenceFailed is a key whose replication failed, it may differ in content at the same size.
+	DivergenceFailed = "failed"
+)
+
+// MirroredBlobStore writes to a primary store and copies every change to its replicas. Replicas copy the
+// primary's object after the write rather than the request body, so they end up with the latest version
+// even when operations are applied late. A write succeeds once the primary has it, also when a replica
+// fails, the key is then recorded for Divergence and Resync. Reads go to the primary and fail over to the replicas, in order,
+// when it fails for any reason other than an answer like oops.KeyNotFound. An async replica may be behind
+// the primary it stands in for. Replicas should be plain backends, the decorators belong above the mirror.
+type MirroredBlobStore struct {
+	primary   BlobStore
+	replicas  []*replica
+	async     bool
+	failovers atomic.Int64
+	workers   sync.WaitGroup
+	now       func() time.Time
+}
+
+type replica struct {
+	store BlobStore
+	queue chan mirrorOp
+	mu    sync.Mutex
+	// queued holds the time every pending operation was queued at, oldest first
+	queued []time.Time
+	// unrepaired holds the keys whose last replication failed
+	unrepaired map[string]bool
+	stats      ReplicaStats
+}
+
+type mirrorOp struct {
+	ctx   context.Context
+	keys  []string
+	apply func(ctx context.Context, store BlobStore) error
+}
+
+func NewMirroredBlobStore(primary BlobStore, replicas []BlobStore, opts MirrorOptions) *MirroredBlobStore {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultMirrorQueueSize
+	}
+	s := &MirroredBlobStore{primary: primary, async: opts.Async, now: time.Now}
+	for _, store := range replicas {
+		r := &replica{store: store, unrepaired: make(map[string]bool)}
+		if opts.Async {
+			r.queue = make(chan mirrorOp, opts.QueueSize)
+			s.workers.Add(1)
+			go s.work(r)
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	return s
+}
+
+func (s *MirroredBlobStore) Stats() MirrorStats {
+	stats := MirrorStats{Failovers: s.failovers.Load()}
+	for _, r := range s.replicas {
+		r.mu.Lock()
+		replicaStats := r.stats
+		replicaStats.Pending = len(r.queued)
+		replicaStats.Unrepaired = len(r.unrepaired)
+		if len(r.queued) > 0 {
+			replicaStats.LagSeconds = s.now().Sub(r.queued[0]).Seconds()
+		}
+		r.mu.Unlock()
+		stats.Replicas = append(stats.Replicas, replicaStats)
+	}
+	return stats
+}
+
+// Flush waits until the replicas have applied every queued operation.
+func (s *MirroredBlobStore) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		for _, r := range s.replicas {
+			r.mu.Lock()
+			pending += len(r.queued)
+			r.mu.Unlock()
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close applies the queued operations and stops the replication workers, the store must not be written after.
+func (s *MirroredBlobStore) Close() error {
+	for _, r := range s.replicas {
+		if r.queue != nil {
+			close(r.queue)
+		}
+	}
+	s.workers.Wait()
+	return nil
+}
+
+// Divergence compares the objects under prefix of the primary with those of every replica, by key and size,
+// and adds the keys whose replication failed.
+func (s *MirroredBlobStore) Divergence(ctx context.Context, prefix string) ([]Divergence, error) {
+	primary, err := s.sizes(ctx, s.primary, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list primary: %w", err)
+	}
+	var divergences []Divergence
+	for i, r := range s.replicas {
+		sizes, err := s.sizes(ctx, r.store, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list replica %d: %w", i, err)
+		}
+		for key, size := range primary {
+			replicaSize, ok := sizes[key]
+			switch {
+			case !ok:
+				divergences = append(divergences, Divergence{Replica: i, Key: key, Reason: DivergenceMissing})
+			case replicaSize != size:
+				divergences = append(divergences, Divergence{Replica: i, Key: key, Reason: DivergenceSize})
+			}
+		}
+		for key := range sizes {
+			if _, ok := primary[key]; !ok {
+				divergences = append(divergences, Divergence{Replica: i, Key: key, Reason: DivergenceExtra})
+			}
+		}
+		for _, key := range r.unrepairedKeys(prefix) {
+			size, onPrimary := primary[key]
+			replicaSize, onReplica := sizes[key]
+			// keys missing, extra or of another size are reported already
+			if onPrimary == onReplica && size == replicaSize {
+				divergences = append(divergences, Divergence{Replica: i, Key: key, Reason: DivergenceFailed})
+			}
+		}
+	}
+	return divergences, nil
+}
+
+// Resync copies or deletes the diverging keys under prefix so the replicas match the primary again,
+// and returns how many keys it repaired.
+func (s *MirroredBlobStore) Resync(ctx context.Context, prefix string) (int, error) {
+	divergences, err := s.Divergence(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, d := range divergences {
+		r := s.replicas[d.Replica]
+		if err = s.syncKey(d.Key)(ctx, r.store); err != nil {
+			return repaired, fmt.Errorf("failed to resync %s on replica %d: %w", d.Key, d.Replica, err)
+		}
+		r.repaired(d.Key)
+		repaired++
+	}
+	return repaired, nil
+}
+
+func (s *MirroredBlobStore) sizes(ctx context.Context, store BlobStore, prefix string) (map[string]int64, error) {
+	results, err := store.List(ctx, prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(results))
+	for _, result := range results {
+		sizes[result.Key] = int64(result.Size)
+	}
+	return sizes, nil
+}
+
+func (s *MirroredBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	var results []ListResult
+	err := s.read(func(store BlobStore) (err error) {
+		results, err = store.List(ctx, prefix, delimiter)
+		return err
+	})
+	return results, err
+}
+
+func (s *MirroredBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	var page ListPage
+	err := s.read(func(store BlobStore) (err error) {
+		page, err = store.ListPage(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+func (s *MirroredBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	var reader io.ReadCloser
+	var info ObjectInfo
+	err := s.read(func(store BlobStore) (err error) {
+		reader, info, err = store.Get(ctx, key)
+		return err
+	})
+	return reader, info, err
+}
+
+func (s *MirroredBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	var reader io.ReadCloser
+	var info ObjectInfo
+	err := s.read(func(store BlobStore) (err error) {
+		reader, info, err = store.GetRange(ctx, key, offset, length)
+		return err
+	})
+	return reader, info, err
+}
+
+func (s *MirroredBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := s.read(func(store BlobStore) (err error) {
+		info, err = store.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (s *MirroredBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *MirroredBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	etag, err := s.primary.PutIf(ctx, key, reader, metadata, cond)
+	if err != nil {
+		return "", err
+	}
+	s.replicate(ctx, []string{key}, s.syncKey(key))
+	return etag, nil
+}
+
+func (s *MirroredBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if err := s.primary.Copy(ctx, src, dst, metadata); err != nil {
+		return err
+	}
+	s.replicate(ctx, []string{dst}, s.syncKey(dst))
+	return nil
+}
+
+func (s *MirroredBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if err := s.primary.Move(ctx, src, dst, metadata); err != nil {
+		return err
+	}
+	s.replicate(ctx, []string{dst}, s.syncKey(dst))
+	s.replicate(ctx, []string{src}, deleteKey(src))
+	return nil
+}
+
+func (s *MirroredBlobStore) Delete(ctx context.Context, key string) error {
+	if err := s.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.replicate(ctx, []string{key}, deleteKey(key))
+	return nil
+}
+
+// DeleteMany deletes on the replicas the keys the primary deleted, even when it failed on others.
+func (s *MirroredBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	err := s.primary.DeleteMany(ctx, keys)
+	var deleteErr *DeleteError
+	if err != nil && !errors.As(err, &deleteErr) {
+		return err
+	}
+	var deleted []string
+	for _, key := range keys {
+		if deleteErr == nil || deleteErr.Failed[key] == nil {
+			deleted = append(deleted, key)
+		}
+	}
+	if len(deleted) > 0 {
+		s.replicate(ctx, deleted, func(ctx context.Context, store BlobStore) error {
+			return store.DeleteMany(ctx, deleted)
+		})
+	}
+	return err
+}
+
+// DeleteAll records no keys when it fails on a replica, what it left there shows up as DivergenceExtra.
+func (s *MirroredBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	if err := s.primary.DeleteAll(ctx, prefix); err != nil {
+		return err
+	}
+	s.replicate(ctx, nil, func(ctx context.Context, store BlobStore) error {
+		return store.DeleteAll(ctx, prefix)
+	})
+	return nil
+}
+
+// PresignGet and PresignPut sign for the primary, objects uploaded that way reach the replicas
+// once they are copied or moved through the mirror, or on the next Resync.
+func (s *MirroredBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.primary.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *MirroredBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.primary.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+// Watch follows the primary, the replicas only ever copy its changes.
+func (s *MirroredBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.primary, prefix)
+}
+
+// read calls the primary and then the replicas until one of them answers.
+func (s *MirroredBlobStore) read(call func(store BlobStore) error) error {
+	err := call(s.primary)
+	if !shouldFailover(err) {
+		return err
+	}
+	for _, r := range s.replicas {
+		replicaErr := call(r.store)
+		if replicaErr == nil || !shouldFailover(replicaErr) {
+			s.failovers.Add(1)
+			return replicaErr
+		}
+	}
+	return err
+}
+
+func shouldFailover(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, answer := range []error{
+		oops.KeyNotFound, oops.InvalidKey, oops.ValidationError, oops.InvalidRange,
+		context.Canceled, context.DeadlineExceeded,
+	} {
+		if errors.Is(err, answer) {
+			return false
+		}
+	}
+	return true
+}
+
+// replicate applies op for keys to every replica, or queues it when async. The primary has the change
+// already, so failures are not the caller's: they are counted and the keys recorded as unrepaired.
+func (s *MirroredBlobStore) replicate(ctx context.Context, keys []string, apply func(ctx context.Context, store BlobStore) error) {
+	op := mirrorOp{ctx: context.WithoutCancel(ctx), keys: keys, apply: apply}
+	for _, r := range s.replicas {
+		r.enqueued(s.now())
+		if !s.async {
+			err := op.apply(ctx, r.store)
+			r.done(s.now(), op.keys, err)
+			continue
+		}
+		select {
+		case r.queue <- op:
+		case <-ctx.Done():
+			r.done(s.now(), op.keys, fmt.Errorf("failed to queue: %w", ctx.Err()))
+		}
+	}
+}
+
+func (s *MirroredBlobStore) work(r *replica) {
+	defer s.workers.Done()
+	for op := range r.queue {
+		err := op.apply(op.ctx, r.store)
+		r.done(s.now(), op.keys, err)
+	}
+}
+
+// syncKey copies the primary's current version of key to a replica, or deletes it there when the primary has none.
+func (s *MirroredBlobStore) syncKey(key string) func(ctx context.Context, store BlobStore) error {
+	return func(ctx context.Context, store BlobStore) error {
+		err := CopyBetween(ctx, s.primary, key, store, key)
+		if errors.Is(err, oops.KeyNotFound) {
+			return deleteKey(key)(ctx, store)
+		}
+		return err
+	}
+}
+
+func deleteKey(key string) func(ctx context.Context, store BlobStore) error {
+	return func(ctx context.Context, store BlobStore) error {
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, oops.KeyNotFound) {
+			return err
+		}
+		return nil
+	}
+}
+
+func (r *replica) enqueued(at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queued = append(r.queued, at)
+}
+
+// done records the outcome of an operation on keys, a success repairs the keys an earlier one left behind.
+func (r *replica) done(at time.Time, keys []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queued = r.queued[1:]
+	if err != nil {
+		r.stats.Failed++
+		r.stats.LastError = err.Error()
+		for _, key := range keys {
+			r.unrepaired[key] = true
+		}
+		return
+	}
+	r.stats.Replicated++
+	r.stats.LastSync = at
+	for _, key := range keys {
+		delete(r.unrepaired, key)
+	}
+}
+
+func (r *replica) unrepairedKeys(prefix string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var keys []string
+	for key := range r.unrepaired {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (r *replica) repaired(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.unrepaired, key)
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"simplicity/oops"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingBlobStore holds every PutIf until release is closed.
+type blockingBlobStore struct {
+	BlobStore
+	release chan struct{}
+}
+
+func (s *blockingBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	<-s.release
+	return s.BlobStore.PutIf(ctx, key, reader, metadata, cond)
+}
+
+func (s *blockingBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func TestMirroredBlobStore_Sync(t *testing.T) {
+	ctx := context.Background()
+	primary, replica := NewInMemoryBlobStore(), NewInMemoryBlobStore()
+	store := NewMirroredBlobStore(primary, []BlobStore{replica}, MirrorOptions{})
+	testCopyMove(t, store)
+
+	for _, key := range []string{"deleted-files/1/source.data", "deleted-files/2/source.data"} {
+		if got := readString(t, replica, key); got != "data" {
+			t.Errorf("replica Get(%q) = %q, want the copy", key, got)
+		}
+	}
+	info, err := replica.Stat(ctx, "deleted-files/2/source.data")
+	if err != nil || info.Metadata["deleted_at"] == "" {
+		t.Errorf("replica Stat() = %+v, %v, want the replaced metadata", info, err)
+	}
+	if _, err = replica.Stat(ctx, "files/2/source.data"); err != oops.KeyNotFound {
+		t.Errorf("replica Stat() of a moved key error = %v, want %v", err, oops.KeyNotFound)
+	}
+
+	store.Delete(ctx, "deleted-files/1/source.data")
+	store.DeleteAll(ctx, "deleted-files/")
+	if results, _ := replica.List(ctx, "", ""); len(results) != 0 {
+		t.Errorf("replica List() after deletes = %v, want nothing", results)
+	}
+	if stats := store.Stats(); stats.Replicas[0].Pending != 0 || stats.Replicas[0].Replicated == 0 || stats.Replicas[0].Failed != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestMirroredBlobStore_Async(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryBlobStore()
+	replica := &blockingBlobStore{BlobStore: NewInMemoryBlobStore(), release: make(chan struct{})}
+	store := NewMirroredBlobStore(primary, []BlobStore{replica}, MirrorOptions{Async: true})
+	defer store.Close()
+	now := time.Unix(0, 0)
+	store.now = func() time.Time { return now }
+
+	if _, err := store.Put(ctx, "a", strings.NewReader("first"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	store.Put(ctx, "b", strings.NewReader("second"), nil)
+	now = now.Add(3 * time.Second)
+	if stats := store.Stats(); stats.Replicas[0].Pending != 2 || stats.Replicas[0].LagSeconds != 3 {
+		t.Errorf("Stats() = %+v, want 2 pending operations 3 seconds behind", stats)
+	}
+	if _, err := replica.Stat(ctx, "a"); err != oops.KeyNotFound {
+		t.Errorf("replica Stat() before catching up error = %v, want %v", err, oops.KeyNotFound)
+	}
+
+	close(replica.release)
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := store.Flush(flushCtx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if got := readString(t, replica, "b"); got != "second" {
+		t.Errorf("replica Get() = %q after Flush()", got)
+	}
+	if stats := store.Stats(); stats.Replicas[0].Pending != 0 || stats.Replicas[0].LagSeconds != 0 || stats.Replicas[0].Replicated != 2 {
+		t.Errorf("Stats() = %+v, want the replica caught up", stats)
+	}
+}
+
+func TestMirroredBlobStore_Divergence(t *testing.T) {
+	ctx := context.Background()
+	primary, first, second := NewInMemoryBlobStore(), NewInMemoryBlobStore(), NewInMemoryBlobStore()
+	store := NewMirroredBlobStore(primary, []BlobStore{first, second}, MirrorOptions{})
+	store.Put(ctx, "same", strings.NewReader("data"), nil)
+	primary.Put(ctx, "missing", strings.NewReader("data"), nil)
+	first.Put(ctx, "same", strings.NewReader("changed"), nil)
+	second.Put(ctx, "extra", strings.NewReader("data"), nil)
+
+	divergences, err := store.Divergence(ctx, "")
+	if err != nil {
+		t.Fatalf("Divergence() error = %v", err)
+	}
+	sort.Slice(divergences, func(i, j int) bool {
+		if divergences[i].Replica != divergences[j].Replica {
+			return divergences[i].Replica < divergences[j].Replica
+		}
+		return divergences[i].Key < divergences[j].Key
+	})
+	want := []Divergence{
+		{Replica: 0, Key: "missing", Reason: DivergenceMissing},
+		{Replica: 0, Key: "same", Reason: DivergenceSize},
+		{Replica: 1, Key: "extra", Reason: DivergenceExtra},
+		{Replica: 1, Key: "missing", Reason: DivergenceMissing},
+	}
+	if len(divergences) != len(want) {
+		t.Fatalf("Divergence() = %v, want %v", divergences, want)
+	}
+	for i := range want {
+		if divergences[i] != want[i] {
+			t.Errorf("Divergence()[%d] = %v, want %v", i, divergences[i], want[i])
+		}
+	}
+
+	if repaired, err := store.Resync(ctx, ""); err != nil || repaired != 4 {
+		t.Errorf("Resync() = %d, %v, want 4 keys repaired", repaired, err)
+	}
+	if divergences, _ = store.Divergence(ctx, ""); len(divergences) != 0 {
+		t.Errorf("Divergence() after Resync() = %v, want none", divergences)
+	}
+}
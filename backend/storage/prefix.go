@@ -2,47 +2,279 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"simplicity/oops"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// StripPrefixBlobStore confines its callers to the keys under its prefix: keys are taken and returned
+// relative to it and keys that could leave it, with . or .. segments, a leading slash, backslashes or
+// control characters, fail with oops.InvalidKey. Nested stores collapse into one with the joined prefix.
 type StripPrefixBlobStore struct {
 	store  BlobStore
 	prefix string
 }
 
+// NewPrefixBlobStore is NewNamespacedBlobStore for prefixes fixed in code, it panics on an invalid one.
 func NewPrefixBlobStore(store BlobStore, prefix string) *StripPrefixBlobStore {
-	return &StripPrefixBlobStore{store: store, prefix: prefix}
+	namespaced, err := NewNamespacedBlobStore(store, prefix)
+	if err != nil {
+		panic(err)
+	}
+	return namespaced
 }
 
-func (s *StripPrefixBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
-	return s.store.List(ctx, s.prefix+prefix, delimiter)
+// NewNamespacedBlobStore returns the store of the keys under namespace, a / is appended when it lacks one
+// so tenant1 does not see the keys of tenant10.
+func NewNamespacedBlobStore(store BlobStore, namespace string) (*StripPrefixBlobStore, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("%w: empty namespace", oops.InvalidKey)
+	}
+	if err := checkKey(namespace); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(namespace, Delimiter) {
+		namespace += Delimiter
+	}
+	if outer, ok := store.(*StripPrefixBlobStore); ok {
+		return &StripPrefixBlobStore{store: outer.store, prefix: outer.prefix + namespace}, nil
+	}
+	return &StripPrefixBlobStore{store: store, prefix: namespace}, nil
 }
 
-func (s *StripPrefixBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
-	if key == "" {
-		return nil, nil, oops.InvalidKey
-	}
-	return s.store.Get(ctx, s.prefix+key)
+// Prefix returns the keys of the underlying store this one is confined to.
+func (s *StripPrefixBlobStore) Prefix() string {
+	return s.prefix
 }
 
-func (s *StripPrefixBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+// checkKey rejects keys that could be read as something outside the namespace once prefixed.
+func checkKey(key string) error {
 	if key == "" {
 		return oops.InvalidKey
 	}
-	return s.store.Put(ctx, s.prefix+key, reader, metadata)
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: %q is not UTF-8", oops.InvalidKey, key)
+	}
+	if strings.HasPrefix(key, Delimiter) || strings.Contains(key, `\`) {
+		return fmt.Errorf("%w: %q is not a relative key", oops.InvalidKey, key)
+	}
+	if strings.IndexFunc(key, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %q contains control characters", oops.InvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, Delimiter) {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %q contains a %s segment", oops.InvalidKey, key, segment)
+		}
+	}
+	return nil
+}
+
+// checkPrefix is checkKey for list and delete prefixes, where the empty prefix means all keys.
+func checkPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	return checkKey(prefix)
+}
+
+func (s *StripPrefixBlobStore) key(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+func (s *StripPrefixBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	if err := checkPrefix(prefix); err != nil {
+		return nil, err
+	}
+	results, err := s.store.List(ctx, s.prefix+prefix, delimiter)
+	if err != nil {
+		return nil, err
+	}
+	return s.strip(results), nil
+}
+
+func (s *StripPrefixBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := checkPrefix(opts.Prefix); err != nil {
+		return ListPage{}, err
+	}
+	opts.Prefix = s.prefix + opts.Prefix
+	if opts.StartAfter != "" {
+		opts.StartAfter = s.prefix + opts.StartAfter
+	}
+	page, err := s.store.ListPage(ctx, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	page.Results = s.strip(page.Results)
+	return page, nil
+}
+
+// strip returns listed keys relative to the prefix, as every other method takes them.
+func (s *StripPrefixBlobStore) strip(results []ListResult) []ListResult {
+	for i := range results {
+		results[i].Key = strings.TrimPrefix(results[i].Key, s.prefix)
+	}
+	return results
+}
+
+func (s *StripPrefixBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := s.key(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return s.store.Get(ctx, key)
+}
+
+func (s *StripPrefixBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	key, err := s.key(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return s.store.GetRange(ctx, key, offset, length)
+}
+
+func (s *StripPrefixBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := s.key(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.store.Stat(ctx, key)
+}
+
+func (s *StripPrefixBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	key, err := s.key(key)
+	if err != nil {
+		return "", err
+	}
+	return s.store.Put(ctx, key, reader, metadata)
+}
+
+func (s *StripPrefixBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	key, err := s.key(key)
+	if err != nil {
+		return "", err
+	}
+	return s.store.PutIf(ctx, key, reader, metadata, cond)
+}
+
+func (s *StripPrefixBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	src, dst, err := s.keys(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.store.Copy(ctx, src, dst, metadata)
+}
+
+func (s *StripPrefixBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	src, dst, err := s.keys(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.store.Move(ctx, src, dst, metadata)
+}
+
+func (s *StripPrefixBlobStore) keys(src string, dst string) (string, string, error) {
+	src, err := s.key(src)
+	if err != nil {
+		return "", "", err
+	}
+	dst, err = s.key(dst)
+	return src, dst, err
 }
 
 func (s *StripPrefixBlobStore) Delete(ctx context.Context, key string) error {
-	if key == "" {
-		return oops.InvalidKey
+	key, err := s.key(key)
+	if err != nil {
+		return err
 	}
-	return s.store.Delete(ctx, s.prefix+key)
+	return s.store.Delete(ctx, key)
+}
+
+func (s *StripPrefixBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	prefixed := make([]string, 0, len(keys))
+	failed := make(map[string]error)
+	for _, key := range keys {
+		full, err := s.key(key)
+		if err != nil {
+			failed[key] = err
+			continue
+		}
+		prefixed = append(prefixed, full)
+	}
+	var deleteErr *DeleteError
+	err := s.store.DeleteMany(ctx, prefixed)
+	if errors.As(err, &deleteErr) {
+		for key, keyErr := range deleteErr.Failed {
+			failed[strings.TrimPrefix(key, s.prefix)] = keyErr
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
+	}
+	return nil
 }
 
 func (s *StripPrefixBlobStore) DeleteAll(ctx context.Context, prefix string) error {
-	if prefix == "" {
-		return oops.InvalidKey
+	prefix, err := s.key(prefix)
+	if err != nil {
+		return err
+	}
+	return s.store.DeleteAll(ctx, prefix)
+}
+
+func (s *StripPrefixBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	key, err := s.key(key)
+	if err != nil {
+		return "", err
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *StripPrefixBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	key, err := s.key(key)
+	if err != nil {
+		return "", err
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+// Watch reports keys relative to the prefix.
+func (s *StripPrefixBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	if err := checkPrefix(prefix); err != nil {
+		return nil, err
+	}
+	events, err := watchStore(ctx, s.store, s.prefix+prefix)
+	if err != nil {
+		return nil, err
 	}
-	return s.store.DeleteAll(ctx, s.prefix+prefix)
+	stripped := make(chan Event)
+	go func() {
+		defer close(stripped)
+		for event := range events {
+			event.Key = strings.TrimPrefix(event.Key, s.prefix)
+			select {
+			case stripped <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stripped, nil
 }
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"simplicity/oops"
+	"strings"
+	"testing"
+)
+
+func TestStripPrefixBlobStore_Traversal(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	backend.Put(ctx, "secret", strings.NewReader("secret"), nil)
+	store := NewPrefixBlobStore(backend, "tenant/")
+	for _, key := range []string{"../secret", "a/../../secret", "./a", "a/.", "/secret", `a\..\b`, "a\x00b", "a\nb", "a\x7fb", "\xff"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("data"), nil); !errors.Is(err, oops.InvalidKey) {
+			t.Errorf("Put(%q) error = %v, want %v", key, err, oops.InvalidKey)
+		}
+		if _, _, err := store.Get(ctx, key); !errors.Is(err, oops.InvalidKey) {
+			t.Errorf("Get(%q) error = %v, want %v", key, err, oops.InvalidKey)
+		}
+		if err := store.Copy(ctx, "a", key, nil); !errors.Is(err, oops.InvalidKey) {
+			t.Errorf("Copy() to %q error = %v, want %v", key, err, oops.InvalidKey)
+		}
+		if _, err := store.List(ctx, key, ""); !errors.Is(err, oops.InvalidKey) {
+			t.Errorf("List(%q) error = %v, want %v", key, err, oops.InvalidKey)
+		}
+	}
+	if results, _ := backend.List(ctx, "", ""); len(results) != 1 {
+		t.Errorf("rejected keys were written: %v", results)
+	}
+	for _, key := range []string{"a..b", "..a/b", "ünïcode name.png", "a b/c"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("data"), nil); err != nil {
+			t.Errorf("Put(%q) error = %v", key, err)
+		}
+	}
+
+	if _, err := NewNamespacedBlobStore(backend, "../tenant"); !errors.Is(err, oops.InvalidKey) {
+		t.Errorf("NewNamespacedBlobStore() with a traversing namespace error = %v, want %v", err, oops.InvalidKey)
+	}
+	if _, err := NewNamespacedBlobStore(backend, ""); !errors.Is(err, oops.InvalidKey) {
+		t.Errorf("NewNamespacedBlobStore() with an empty namespace error = %v, want %v", err, oops.InvalidKey)
+	}
+}
+
+func TestStripPrefixBlobStore_Isolation(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	tenant1, err := NewNamespacedBlobStore(backend, "tenant1")
+	if err != nil {
+		t.Fatalf("NewNamespacedBlobStore() error = %v", err)
+	}
+	tenant10, _ := NewNamespacedBlobStore(backend, "tenant10")
+	tenant1.Put(ctx, "a", strings.NewReader("1"), nil)
+	tenant10.Put(ctx, "b", strings.NewReader("10"), nil)
+
+	results, err := tenant1.List(ctx, "", "")
+	if err != nil || !reflect.DeepEqual(results, []ListResult{{IsObject: true, Key: "a", Size: 1}}) {
+		t.Errorf("List() = %v, %v, want the keys of tenant1 only", results, err)
+	}
+	if _, err = tenant1.Stat(ctx, "0/b"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of a key of tenant10 error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+func TestStripPrefixBlobStore_Nested(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	images := NewPrefixBlobStore(backend, "images/")
+	files := NewPrefixBlobStore(images, "files")
+	if files.Prefix() != "images/files/" || files.store != BlobStore(backend) {
+		t.Errorf("nested store = %q over %T, want one store over the backend", files.Prefix(), files.store)
+	}
+
+	files.Put(ctx, "1/source.data", strings.NewReader("data"), nil)
+	if _, err := backend.Stat(ctx, "images/files/1/source.data"); err != nil {
+		t.Errorf("Stat() of the full key error = %v", err)
+	}
+	results, err := images.List(ctx, "", Delimiter)
+	if err != nil || !reflect.DeepEqual(results, []ListResult{{Key: "files/"}}) {
+		t.Errorf("List() = %v, %v, want the nested prefix", results, err)
+	}
+	results, err = files.List(ctx, "", "")
+	if err != nil || len(results) != 1 || results[0].Key != "1/source.data" {
+		t.Errorf("List() = %v, %v, want keys relative to the nested prefix", results, err)
+	}
+	if _, err = files.Stat(ctx, results[0].Key); err != nil {
+		t.Errorf("Stat() of a listed key error = %v", err)
+	}
+}
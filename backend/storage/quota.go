@@ -0,0 +1,579 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"simplicity/oops"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaRule accounts the objects under Prefix. Writes that would take it past HardBytes or MaxObjects fail
+// with oops.QuotaExceeded, SoftBytes is only reported. Zero limits are unlimited.
+type QuotaRule struct {
+	Prefix     string
+	SoftBytes  int64
+	HardBytes  int64
+	MaxObjects int64
+}
+
+// QuotaOptions configure a QuotaBlobStore. The counters are saved to StateKey every SaveInterval while Start runs.
+type QuotaOptions struct {
+	Rules        []QuotaRule
+	StateKey     string
+	SaveInterval time.Duration
+}
+
+const (
+	defaultUsageKey          = "storage/usage.json"
+	defaultUsageSaveInterval = time.Minute
+)
+
+// Usage is what the objects under Prefix take, with the limits of its rule.
+type Usage struct {
+	Prefix       string    `json:"prefix"`
+	Objects      int64     `json:"objects"`
+	Bytes        int64     `json:"bytes"`
+	SoftBytes    int64     `json:"soft_bytes,omitempty"`
+	HardBytes    int64     `json:"hard_bytes,omitempty"`
+	MaxObjects   int64     `json:"max_objects,omitempty"`
+	OverSoft     bool      `json:"over_soft"`
+	RecomputedAt time.Time `json:"recomputed_at"`
+}
+
+// QuotaBlobStore counts the objects and bytes under the prefixes of its rules as they are written
+// through it and enforces their quotas. The counters start from the saved state or a listing and
+// drift when other processes write the store or writes of the same key race, Recompute corrects them.
+// Limits are checked before a write, concurrent writes may together overshoot them. It should sit
+// right above the backend so it counts the stored bytes, presigned uploads bypass it.
+type QuotaBlobStore struct {
+	store BlobStore
+	opts  QuotaOptions
+	mu    sync.Mutex
+	usage []*Usage
+	dirty bool
+	stop  context.CancelFunc
+	done  chan struct{}
+}
+
+func NewQuotaBlobStore(ctx context.Context, store BlobStore, opts QuotaOptions) (*QuotaBlobStore, error) {
+	if opts.StateKey == "" {
+		opts.StateKey = defaultUsageKey
+	}
+	if opts.SaveInterval <= 0 {
+		opts.SaveInterval = defaultUsageSaveInterval
+	}
+	s := &QuotaBlobStore{store: store, opts: opts}
+	saved, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range opts.Rules {
+		usage, ok := saved[rule.Prefix]
+		if !ok {
+			if usage, err = s.count(ctx, rule.Prefix); err != nil {
+				return nil, fmt.Errorf("failed to count %s: %w", rule.Prefix, err)
+			}
+			s.dirty = true
+		}
+		usage.SoftBytes, usage.HardBytes, usage.MaxObjects = rule.SoftBytes, rule.HardBytes, rule.MaxObjects
+		usage.OverSoft = rule.SoftBytes > 0 && usage.Bytes > rule.SoftBytes
+		s.usage = append(s.usage, &usage)
+	}
+	return s, nil
+}
+
+func (s *QuotaBlobStore) load(ctx context.Context) (map[string]Usage, error) {
+	saved := make(map[string]Usage)
+	reader, _, err := s.store.Get(ctx, s.opts.StateKey)
+	if errors.Is(err, oops.KeyNotFound) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+	defer reader.Close()
+	var usages []Usage
+	if err = json.NewDecoder(reader).Decode(&usages); err != nil {
+		// counting again is cheaper than refusing to start
+		return saved, nil
+	}
+	for _, usage := range usages {
+		saved[usage.Prefix] = usage
+	}
+	return saved, nil
+}
+
+// count lists the objects under prefix.
+func (s *QuotaBlobStore) count(ctx context.Context, prefix string) (Usage, error) {
+	usage := Usage{Prefix: prefix, RecomputedAt: time.Now().UTC()}
+	err := listObjects(ctx, s.store, prefix, func(result ListResult) error {
+		if result.Key != s.opts.StateKey {
+			usage.Objects++
+			usage.Bytes += int64(result.Size)
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// Usage returns the counters of every rule.
+func (s *QuotaBlobStore) Usage() []Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usages := make([]Usage, 0, len(s.usage))
+	for _, usage := range s.usage {
+		usages = append(usages, *usage)
+	}
+	return usages
+}
+
+// Recompute replaces the counters with a listing of every prefix and saves them.
+func (s *QuotaBlobStore) Recompute(ctx context.Context) ([]Usage, error) {
+	for i := range s.usage {
+		counted, err := s.count(ctx, s.usage[i].Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", s.usage[i].Prefix, err)
+		}
+		s.mu.Lock()
+		usage := s.usage[i]
+		usage.Objects, usage.Bytes, usage.RecomputedAt = counted.Objects, counted.Bytes, counted.RecomputedAt
+		usage.OverSoft = usage.SoftBytes > 0 && usage.Bytes > usage.SoftBytes
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return s.Usage(), s.Save(ctx)
+}
+
+// Save writes the counters to the state key if they changed since the last save.
+func (s *QuotaBlobStore) Save(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	usages := make([]Usage, 0, len(s.usage))
+	for _, usage := range s.usage {
+		usages = append(usages, *usage)
+	}
+	s.dirty = false
+	s.mu.Unlock()
+	data, err := json.Marshal(usages)
+	if err == nil {
+		_, err = s.store.Put(ctx, s.opts.StateKey, strings.NewReader(string(data)), nil)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	return nil
+}
+
+// Start saves the counters every SaveInterval until Close.
+func (s *QuotaBlobStore) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop, s.done = stop, make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.opts.SaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := s.Save(ctx); err != nil {
+				slog.Default().Error("Saving storage usage failed", "Error", err.Error())
+			}
+		}
+	}()
+}
+
+// Close stops the saves of Start and saves the counters a last time.
+func (s *QuotaBlobStore) Close() error {
+	if s.stop != nil {
+		s.stop()
+		<-s.done
+	}
+	return s.Save(context.Background())
+}
+
+// matching returns the counters key is accounted in.
+func (s *QuotaBlobStore) matching(key string) []*Usage {
+	if key == s.opts.StateKey {
+		return nil
+	}
+	var usages []*Usage
+	for _, usage := range s.usage {
+		if strings.HasPrefix(key, usage.Prefix) {
+			usages = append(usages, usage)
+		}
+	}
+	return usages
+}
+
+// allowance returns how many bytes a write may add to usages when it replaces an object of
+// replaced bytes, -1 is unlimited. A new object that exceeds the object limit fails.
+func (s *QuotaBlobStore) allowance(usages []*Usage, replaced int64, exists bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allowed := int64(-1)
+	for _, usage := range usages {
+		if !exists && usage.MaxObjects > 0 && usage.Objects >= usage.MaxObjects {
+			return 0, fmt.Errorf("%w: %s holds %d of %d objects", oops.QuotaExceeded, usage.Prefix, usage.Objects, usage.MaxObjects)
+		}
+		if usage.HardBytes > 0 {
+			left := max(usage.HardBytes-usage.Bytes+replaced, 0)
+			if allowed < 0 || left < allowed {
+				allowed = left
+			}
+		}
+	}
+	return allowed, nil
+}
+
+func (s *QuotaBlobStore) add(usages []*Usage, objects int64, bytes int64) {
+	if len(usages) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, usage := range usages {
+		usage.Objects += objects
+		usage.Bytes += bytes
+		over := usage.SoftBytes > 0 && usage.Bytes > usage.SoftBytes
+		if over && !usage.OverSoft {
+			slog.Default().Warn("Soft storage quota exceeded", "prefix", usage.Prefix, "bytes", usage.Bytes, "soft_bytes", usage.SoftBytes)
+		}
+		usage.OverSoft = over
+	}
+	s.dirty = true
+}
+
+// current returns the size of key and whether it exists.
+func (s *QuotaBlobStore) current(ctx context.Context, key string) (int64, bool, error) {
+	info, err := s.store.Stat(ctx, key)
+	if errors.Is(err, oops.KeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size, true, nil
+}
+
+func quotaError(size int64, allowed int64, usages []*Usage) error {
+	for _, usage := range usages {
+		if usage.HardBytes > 0 && size > usage.HardBytes {
+			return fmt.Errorf("%w: %w: %d bytes do not fit into the %d bytes of %s", oops.TooLarge, oops.QuotaExceeded, size, usage.HardBytes, usage.Prefix)
+		}
+	}
+	return fmt.Errorf("%w: %d bytes left, %d wanted", oops.QuotaExceeded, allowed, size)
+}
+
+func (s *QuotaBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	return s.store.List(ctx, prefix, delimiter)
+}
+
+func (s *QuotaBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return s.store.ListPage(ctx, opts)
+}
+
+func (s *QuotaBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	return s.store.Get(ctx, key)
+}
+
+func (s *QuotaBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	return s.store.GetRange(ctx, key, offset, length)
+}
+
+func (s *QuotaBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.store.Stat(ctx, key)
+}
+
+func (s *QuotaBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+// PutIf rejects a body of known length that does not fit up front and stops any other body
+// as soon as it reads past the allowance.
+func (s *QuotaBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	usages := s.matching(key)
+	if len(usages) == 0 {
+		return s.store.PutIf(ctx, key, reader, metadata, cond)
+	}
+	replaced, exists, err := s.current(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	allowed, err := s.allowance(usages, replaced, exists)
+	if err != nil {
+		return "", err
+	}
+	if sized, ok := reader.(interface{ Len() int }); ok && allowed >= 0 && int64(sized.Len()) > allowed {
+		return "", quotaError(int64(sized.Len()), allowed, usages)
+	}
+	counting := &quotaReader{reader: reader, allowed: allowed}
+	var body io.Reader = counting
+	if seeker, ok := reader.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			body = &quotaSeeker{quotaReader: counting, seeker: seeker, start: start}
+		}
+	}
+	etag, err := s.store.PutIf(ctx, key, body, metadata, cond)
+	if counting.exceeded {
+		return "", quotaError(counting.read, allowed, usages)
+	}
+	if err != nil {
+		return "", err
+	}
+	objects := int64(1)
+	if exists {
+		objects = 0
+	}
+	s.add(usages, objects, counting.read-replaced)
+	return etag, nil
+}
+
+// quotaReader counts what it reads and fails once that is more than allowed, unless allowed is -1.
+type quotaReader struct {
+	reader   io.Reader
+	allowed  int64
+	read     int64
+	exceeded bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.allowed >= 0 && r.read > r.allowed {
+		r.exceeded = true
+		return n, oops.QuotaExceeded
+	}
+	return n, err
+}
+
+// quotaSeeker keeps a seekable body seekable so the stores below can replay it.
+type quotaSeeker struct {
+	*quotaReader
+	seeker io.Seeker
+	start  int64
+}
+
+func (r *quotaSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.seeker.Seek(offset, whence)
+	if err == nil {
+		r.read, r.exceeded = position-r.start, false
+	}
+	return position, err
+}
+
+func (s *QuotaBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	return s.copy(ctx, src, dst, metadata, false)
+}
+
+func (s *QuotaBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	return s.copy(ctx, src, dst, metadata, true)
+}
+
+func (s *QuotaBlobStore) copy(ctx context.Context, src string, dst string, metadata map[string]string, move bool) error {
+	from, to := s.matching(src), s.matching(dst)
+	if src == dst || len(from) == 0 && len(to) == 0 {
+		if move {
+			return s.store.Move(ctx, src, dst, metadata)
+		}
+		return s.store.Copy(ctx, src, dst, metadata)
+	}
+	size, found, err := s.current(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return oops.KeyNotFound
+	}
+	replaced, exists, err := s.current(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if len(to) > 0 {
+		allowed, err := s.allowance(to, replaced, exists)
+		if err != nil {
+			return err
+		}
+		if allowed >= 0 && size > allowed {
+			return quotaError(size, allowed, to)
+		}
+	}
+	if move {
+		err = s.store.Move(ctx, src, dst, metadata)
+	} else {
+		err = s.store.Copy(ctx, src, dst, metadata)
+	}
+	if err != nil {
+		return err
+	}
+	objects := int64(1)
+	if exists {
+		objects = 0
+	}
+	s.add(to, objects, size-replaced)
+	if move {
+		s.add(from, -1, -size)
+	}
+	return nil
+}
+
+func (s *QuotaBlobStore) Delete(ctx context.Context, key string) error {
+	usages := s.matching(key)
+	if len(usages) == 0 {
+		return s.store.Delete(ctx, key)
+	}
+	size, exists, err := s.current(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Delete(ctx, key); err != nil {
+		return err
+	}
+	if exists {
+		s.add(usages, -1, -size)
+	}
+	return nil
+}
+
+// DeleteMany takes the sizes of the counted keys from listings of the key ranges they span,
+// the callers delete pages of a listing so a batch costs one more page rather than a Stat per key.
+func (s *QuotaBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	sizes, err := s.sizes(ctx, keys)
+	if err != nil {
+		return err
+	}
+	err = s.store.DeleteMany(ctx, keys)
+	var deleteErr *DeleteError
+	if err != nil && !errors.As(err, &deleteErr) {
+		return err
+	}
+	for key, size := range sizes {
+		if deleteErr != nil && deleteErr.Failed[key] != nil {
+			continue
+		}
+		s.add(s.matching(key), -1, -size)
+	}
+	return err
+}
+
+// sizes returns the sizes of the counted keys that exist. The keys are grouped by the innermost rule
+// prefix they are counted under and each group is listed on its own, so keys of far apart rules do not
+// list everything in between.
+func (s *QuotaBlobStore) sizes(ctx context.Context, keys []string) (map[string]int64, error) {
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		usages := s.matching(key)
+		if key == "" || len(usages) == 0 {
+			continue
+		}
+		inner := usages[0].Prefix
+		for _, usage := range usages[1:] {
+			if len(usage.Prefix) > len(inner) {
+				inner = usage.Prefix
+			}
+		}
+		groups[inner] = append(groups[inner], key)
+	}
+	sizes := make(map[string]int64)
+	for _, group := range groups {
+		if err := s.listSizes(ctx, group, sizes); err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// listSizes adds the sizes of the keys that exist from a listing of the range between the least and the
+// greatest key. A listing that walks more than a page past the keys it looks for meets a wide range, within
+// a rule of a short prefix, and gives up: the keys it did not reach yet are Stat one by one.
+func (s *QuotaBlobStore) listSizes(ctx context.Context, keys []string, sizes map[string]int64) error {
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	first, last := keys[0], keys[len(keys)-1]
+	// every proper prefix of first sorts before it
+	opts := ListOptions{Prefix: first[:commonPrefix(first, last)], StartAfter: first[:len(first)-1], MaxKeys: DefaultMaxKeys}
+	budget := len(keys) + DefaultMaxKeys
+	next := 0
+	for budget > 0 {
+		page, err := s.store.ListPage(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, result := range page.Results {
+			// keys the listing passed do not exist
+			for next < len(keys) && keys[next] < result.Key {
+				next++
+			}
+			if next < len(keys) && result.IsObject && result.Key == keys[next] {
+				sizes[result.Key] = int64(result.Size)
+				next++
+			}
+			if next == len(keys) {
+				return nil
+			}
+			budget--
+		}
+		if page.NextToken == "" {
+			return nil
+		}
+		opts.ContinuationToken = page.NextToken
+	}
+	for _, key := range keys[next:] {
+		size, exists, err := s.current(ctx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			sizes[key] = size
+		}
+	}
+	return nil
+}
+
+func commonPrefix(a string, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// DeleteAll goes through DeleteMany so the deleted objects are accounted.
+func (s *QuotaBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return deleteAll(ctx, s, prefix)
+}
+
+func (s *QuotaBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *QuotaBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+func (s *QuotaBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.store, prefix)
+}
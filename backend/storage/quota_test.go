@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"simplicity/oops"
+	"strings"
+	"testing"
+)
+
+func newTestQuota(t *testing.T, store BlobStore, rules ...QuotaRule) *QuotaBlobStore {
+	t.Helper()
+	quota, err := NewQuotaBlobStore(context.Background(), store, QuotaOptions{Rules: rules})
+	if err != nil {
+		t.Fatalf("NewQuotaBlobStore() error = %v", err)
+	}
+	return quota
+}
+
+func expectUsage(t *testing.T, quota *QuotaBlobStore, prefix string, objects int64, size int64) {
+	t.Helper()
+	for _, usage := range quota.Usage() {
+		if usage.Prefix == prefix {
+			if usage.Objects != objects || usage.Bytes != size {
+				t.Errorf("usage of %q = %d objects, %d bytes, want %d, %d", prefix, usage.Objects, usage.Bytes, objects, size)
+			}
+			return
+		}
+	}
+	t.Errorf("no usage of %q", prefix)
+}
+
+func TestQuotaBlobStore_Accounting(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	backend.Put(ctx, "images/files/old", strings.NewReader("12345"), nil)
+	quota := newTestQuota(t, backend, QuotaRule{Prefix: "images/"}, QuotaRule{Prefix: "images/files/"})
+	expectUsage(t, quota, "images/files/", 1, 5)
+
+	quota.Put(ctx, "images/files/1", strings.NewReader("123"), nil)
+	quota.Put(ctx, "images/files/1", strings.NewReader("1234"), nil)
+	quota.Put(ctx, "item/items.js", strings.NewReader("{}"), nil)
+	expectUsage(t, quota, "images/files/", 2, 9)
+	expectUsage(t, quota, "images/", 2, 9)
+
+	quota.Copy(ctx, "images/files/1", "images/files/2", nil)
+	quota.Move(ctx, "images/files/2", "images/deleted-files/2", nil)
+	expectUsage(t, quota, "images/files/", 2, 9)
+	expectUsage(t, quota, "images/", 3, 13)
+
+	quota.Delete(ctx, "images/files/old")
+	quota.Delete(ctx, "images/files/missing")
+	quota.DeleteMany(ctx, []string{"images/files/1", "item/items.js"})
+	expectUsage(t, quota, "images/files/", 0, 0)
+	expectUsage(t, quota, "images/", 1, 4)
+
+	quota.DeleteAll(ctx, "images/")
+	expectUsage(t, quota, "images/", 0, 0)
+}
+
+func TestQuotaBlobStore_DeleteManyListsSizes(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	quota := newTestQuota(t, backend, QuotaRule{Prefix: "images/"})
+	for _, key := range []string{"images/files/1/a", "images/files/1/b", "images/files/2/a", "images/files/3/a", "item/items.js"} {
+		if _, err := quota.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	backend.stats = 0
+
+	keys := []string{"images/files/2/a", "images/files/1/a", "images/files/2/missing", "item/items.js"}
+	if err := quota.DeleteMany(ctx, keys); err != nil {
+		t.Fatalf("DeleteMany() error = %v", err)
+	}
+	expectUsage(t, quota, "images/", 2, int64(len("images/files/1/b")+len("images/files/3/a")))
+	if err := quota.DeleteAll(ctx, "images/files/"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	expectUsage(t, quota, "images/", 0, 0)
+	if backend.stats != 0 {
+		t.Errorf("DeleteMany() made %d Stat calls, want the sizes from the listing", backend.stats)
+	}
+}
+
+func TestQuotaBlobStore_DeleteManyWideRange(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBlobStore{BlobStore: NewInMemoryBlobStore()}
+	for i := range 3 * DefaultMaxKeys {
+		backend.Put(ctx, fmt.Sprintf("m/%04d", i), strings.NewReader("1"), nil)
+	}
+	quota := newTestQuota(t, backend, QuotaRule{Prefix: "a/"}, QuotaRule{Prefix: "z/"}, QuotaRule{Prefix: ""})
+	for _, key := range []string{"a/1", "b", "y", "z/1"} {
+		if _, err := quota.Put(ctx, key, strings.NewReader("12"), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+	backend.stats, backend.pages = 0, 0
+
+	// a/1 and z/1 are listed apart, b and y only share the rule of the whole store, whose listing
+	// runs into the keys in between and gives up on them
+	if err := quota.DeleteMany(ctx, []string{"a/1", "b", "y", "z/1"}); err != nil {
+		t.Fatalf("DeleteMany() error = %v", err)
+	}
+	expectUsage(t, quota, "a/", 0, 0)
+	expectUsage(t, quota, "z/", 0, 0)
+	expectUsage(t, quota, "", 3*DefaultMaxKeys, 3*DefaultMaxKeys)
+	if backend.pages != 4 || backend.stats != 1 {
+		t.Errorf("DeleteMany() listed %d pages and made %d Stat calls, want a page for a/1 and z/1, two and a Stat for b and y", backend.pages, backend.stats)
+	}
+}
+
+func TestQuotaBlobStore_HardLimit(t *testing.T) {
+	ctx := context.Background()
+	quota := newTestQuota(t, NewInMemoryBlobStore(), QuotaRule{Prefix: "tenant/", HardBytes: 10, MaxObjects: 3})
+	if _, err := quota.Put(ctx, "tenant/1", strings.NewReader("123456"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	_, err := quota.Put(ctx, "tenant/2", strings.NewReader("123456"), nil)
+	if !errors.Is(err, oops.QuotaExceeded) || errors.Is(err, oops.TooLarge) {
+		t.Errorf("Put() past the hard limit error = %v, want %v", err, oops.QuotaExceeded)
+	}
+	// a body of unknown length is cut off while it is read
+	_, err = quota.Put(ctx, "tenant/2", io.MultiReader(strings.NewReader("123456")), nil)
+	if !errors.Is(err, oops.QuotaExceeded) {
+		t.Errorf("streamed Put() past the hard limit error = %v, want %v", err, oops.QuotaExceeded)
+	}
+	if _, err = quota.Stat(ctx, "tenant/2"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("rejected Put() stored the object, Stat() error = %v", err)
+	}
+	_, err = quota.Put(ctx, "tenant/2", bytes.NewReader(make([]byte, 11)), nil)
+	if !errors.Is(err, oops.TooLarge) || !errors.Is(err, oops.QuotaExceeded) {
+		t.Errorf("Put() of an object larger than the quota error = %v, want %v", err, oops.TooLarge)
+	}
+	// replacing an object only takes the difference
+	if _, err = quota.Put(ctx, "tenant/1", strings.NewReader("1234567890"), nil); err != nil {
+		t.Errorf("Put() replacing an object error = %v", err)
+	}
+	expectUsage(t, quota, "tenant/", 1, 10)
+	if err = quota.Copy(ctx, "tenant/1", "tenant/3", nil); !errors.Is(err, oops.QuotaExceeded) {
+		t.Errorf("Copy() past the hard limit error = %v, want %v", err, oops.QuotaExceeded)
+	}
+
+	quota.Put(ctx, "tenant/1", strings.NewReader(""), nil)
+	quota.Put(ctx, "tenant/2", strings.NewReader(""), nil)
+	quota.Put(ctx, "tenant/3", strings.NewReader(""), nil)
+	if _, err = quota.Put(ctx, "tenant/4", strings.NewReader(""), nil); !errors.Is(err, oops.QuotaExceeded) {
+		t.Errorf("Put() past the object limit error = %v, want %v", err, oops.QuotaExceeded)
+	}
+	expectUsage(t, quota, "tenant/", 3, 0)
+}
+
+func TestQuotaBlobStore_SoftLimit(t *testing.T) {
+	ctx := context.Background()
+	quota := newTestQuota(t, NewInMemoryBlobStore(), QuotaRule{Prefix: "tenant/", SoftBytes: 4})
+	if _, err := quota.Put(ctx, "tenant/1", strings.NewReader("123456"), nil); err != nil {
+		t.Fatalf("Put() past the soft limit error = %v", err)
+	}
+	if usage := quota.Usage()[0]; !usage.OverSoft {
+		t.Errorf("Usage() = %+v, want it over the soft limit", usage)
+	}
+	quota.Delete(ctx, "tenant/1")
+	if usage := quota.Usage()[0]; usage.OverSoft {
+		t.Errorf("Usage() = %+v, want it back under the soft limit", usage)
+	}
+}
+
+func TestQuotaBlobStore_Persistence(t *testing.T) {
+	ctx := context.Background()
+	backend := NewInMemoryBlobStore()
+	quota := newTestQuota(t, backend, QuotaRule{Prefix: ""})
+	quota.Put(ctx, "a", strings.NewReader("123"), nil)
+	if err := quota.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// a write the counters miss is kept until the next recount
+	backend.Put(ctx, "b", strings.NewReader("1234"), nil)
+	reopened := newTestQuota(t, backend, QuotaRule{Prefix: ""}, QuotaRule{Prefix: "b"})
+	expectUsage(t, reopened, "", 1, 3)
+	expectUsage(t, reopened, "b", 1, 4)
+
+	usages, err := reopened.Recompute(ctx)
+	if err != nil || len(usages) != 2 {
+		t.Fatalf("Recompute() = %+v, %v", usages, err)
+	}
+	expectUsage(t, reopened, "", 2, 7)
+}
@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"simplicity/oops"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryOptions configure a ResilientBlobStore, zero values fall back to the defaults below.
+// MaxAttempts counts the first call. After FailureThreshold retryable failures in a row the breaker opens
+// and calls fail with oops.Unavailable for OpenTimeout, then a single probe call decides whether it closes again.
+type RetryOptions struct {
+	MaxAttempts      int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	// MaxReplayBytes bounds how much of a Put body is buffered to be able to send it again,
+	// larger bodies that cannot seek get a single attempt.
+	MaxReplayBytes int64
+}
+
+const (
+	defaultMaxAttempts      = 3
+	defaultBaseDelay        = 50 * time.Millisecond
+	defaultMaxDelay         = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 10 * time.Second
+	defaultMaxReplayBytes   = 8 * 1024 * 1024
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// ResilientBlobStore retries calls that failed for transient reasons with jittered exponential backoff,
+// and stops calling a backend that keeps failing. Errors that are answers, like oops.KeyNotFound,
+// are passed through at once. A retried PutIf can report oops.Conflict when the lost attempt had succeeded.
+type ResilientBlobStore struct {
+	store    BlobStore
+	opts     RetryOptions
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func NewResilientBlobStore(store BlobStore, opts RetryOptions) *ResilientBlobStore {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = defaultBaseDelay
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = defaultMaxDelay
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultOpenTimeout
+	}
+	if opts.MaxReplayBytes <= 0 {
+		opts.MaxReplayBytes = defaultMaxReplayBytes
+	}
+	return &ResilientBlobStore{store: store, opts: opts, now: time.Now, sleep: sleepContext}
+}
+
+// IsRetryable tells transient failures, which may succeed when tried again, from every other error.
+// Only failures of the connection, timeouts and HTTP 5xx, 408 and 429 responses are transient,
+// an error it does not know, like a body that cannot be read or a bug, is given up on at once.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var deleteErr *DeleteError
+	if errors.As(err, &deleteErr) {
+		for _, failure := range deleteErr.Failed {
+			if IsRetryable(failure) {
+				return true
+			}
+		}
+		return false
+	}
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		code := status.HTTPStatusCode()
+		return code >= 500 || code == 408 || code == 429
+	}
+	for _, transient := range []error{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isAnswer tells whether err is the reply of a backend that is up, which closes the breaker.
+func isAnswer(err error) bool {
+	var deleteErr *DeleteError
+	if errors.As(err, &deleteErr) {
+		return !IsRetryable(err)
+	}
+	for _, answer := range []error{
+		oops.KeyNotFound, oops.InvalidKey, oops.KeyAlreadyExists, oops.ValidationError, oops.Conflict,
+		oops.InvalidRange, oops.NotSupported, oops.TooLarge,
+	} {
+		if errors.Is(err, answer) {
+			return true
+		}
+	}
+	var status interface{ HTTPStatusCode() int }
+	return errors.As(err, &status) && !IsRetryable(err)
+}
+
+func (s *ResilientBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
+	var results []ListResult
+	err := s.do(ctx, func() (err error) {
+		results, err = s.store.List(ctx, prefix, delimiter)
+		return err
+	})
+	return results, err
+}
+
+func (s *ResilientBlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	var page ListPage
+	err := s.do(ctx, func() (err error) {
+		page, err = s.store.ListPage(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+// Get retries until the body starts streaming, failures while reading it are the caller's.
+func (s *ResilientBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	var reader io.ReadCloser
+	var info ObjectInfo
+	err := s.do(ctx, func() (err error) {
+		reader, info, err = s.store.Get(ctx, key)
+		return err
+	})
+	return reader, info, err
+}
+
+func (s *ResilientBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	var reader io.ReadCloser
+	var info ObjectInfo
+	err := s.do(ctx, func() (err error) {
+		reader, info, err = s.store.GetRange(ctx, key, offset, length)
+		return err
+	})
+	return reader, info, err
+}
+
+func (s *ResilientBlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := s.do(ctx, func() (err error) {
+		info, err = s.store.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (s *ResilientBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *ResilientBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	body, replay, err := s.replayable(reader)
+	if err != nil {
+		return "", err
+	}
+	attempts := s.opts.MaxAttempts
+	if replay == nil {
+		attempts = 1
+	}
+	var etag string
+	first := true
+	err = s.retry(ctx, attempts, func() (err error) {
+		if !first {
+			if body, err = replay(); err != nil {
+				return err
+			}
+		}
+		first = false
+		source := &sourceReader{Reader: body}
+		etag, err = s.store.PutIf(ctx, key, source, metadata, cond)
+		if err != nil && source.err != nil {
+			return bodyError{err}
+		}
+		return err
+	})
+	var failedBody bodyError
+	if errors.As(err, &failedBody) {
+		return "", failedBody.err
+	}
+	return etag, err
+}
+
+// sourceReader remembers the failure of the caller's body, which says nothing about the backend.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// bodyError marks a Put that failed since its body could not be read. It hides the cause,
+// which may look transient, so that it is neither retried nor fed to the breaker.
+type bodyError struct {
+	err error
+}
+
+func (e bodyError) Error() string { return e.err.Error() }
+
+// replayable returns the body for the first attempt and, if the body can be sent again,
+// a function that rewinds it for the next one. Without it the Put gets a single attempt.
+func (s *ResilientBlobStore) replayable(reader io.Reader) (io.Reader, func() (io.Reader, error), error) {
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return reader, func() (io.Reader, error) {
+				_, err := seeker.Seek(start, io.SeekStart)
+				return seeker, err
+			}, nil
+		}
+	}
+	buffer, err := io.ReadAll(io.LimitReader(reader, s.opts.MaxReplayBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(buffer)) > s.opts.MaxReplayBytes {
+		return io.MultiReader(bytes.NewReader(buffer), reader), nil, nil
+	}
+	return bytes.NewReader(buffer), func() (io.Reader, error) {
+		return bytes.NewReader(buffer), nil
+	}, nil
+}
+
+func (s *ResilientBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	return s.do(ctx, func() error {
+		return s.store.Copy(ctx, src, dst, metadata)
+	})
+}
+
+// Move is only retried while src is still there, a lost reply of a finished move must not turn into KeyNotFound.
+func (s *ResilientBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	first := true
+	return s.do(ctx, func() error {
+		if !first {
+			if _, err := s.store.Stat(ctx, src); errors.Is(err, oops.KeyNotFound) {
+				if _, dstErr := s.store.Stat(ctx, dst); dstErr == nil {
+					return nil
+				}
+			}
+		}
+		first = false
+		return s.store.Move(ctx, src, dst, metadata)
+	})
+}
+
+func (s *ResilientBlobStore) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, func() error {
+		return s.store.Delete(ctx, key)
+	})
+}
+
+// DeleteMany sends only the keys that failed for transient reasons again.
+func (s *ResilientBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	permanent := make(map[string]error)
+	err := s.do(ctx, func() error {
+		err := s.store.DeleteMany(ctx, keys)
+		var deleteErr *DeleteError
+		if !errors.As(err, &deleteErr) {
+			return err
+		}
+		keys = keys[:0:0]
+		for key, failure := range deleteErr.Failed {
+			if IsRetryable(failure) {
+				keys = append(keys, key)
+			} else {
+				permanent[key] = failure
+			}
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		return err
+	})
+	if len(permanent) > 0 {
+		return errors.Join(err, &DeleteError{Failed: permanent})
+	}
+	return err
+}
+
+func (s *ResilientBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	return deleteAll(ctx, s, prefix)
+}
+
+func (s *ResilientBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *ResilientBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.store.(Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+// Watch polls through the retries and the breaker when the wrapped store watches by listing.
+func (s *ResilientBlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	lister, ok := s.store.(versionLister)
+	if !ok {
+		return watchStore(ctx, s.store, prefix)
+	}
+	return pollChanges(ctx, lister.pollInterval(), func(ctx context.Context) (versions map[string]objectVersion, err error) {
+		err = s.do(ctx, func() (err error) {
+			versions, err = lister.listVersions(ctx, prefix)
+			return err
+		})
+		return versions, err
+	})
+}
+
+func (s *ResilientBlobStore) do(ctx context.Context, call func() error) error {
+	return s.retry(ctx, s.opts.MaxAttempts, call)
+}
+
+// retry runs call until it succeeds, fails with an answer, runs out of attempts or the breaker opens.
+// Transient failures that are given up on are reported as oops.Unavailable.
+func (s *ResilientBlobStore) retry(ctx context.Context, attempts int, call func() error) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if sleepErr := s.sleep(ctx, s.backoff(attempt)); sleepErr != nil {
+				return errors.Join(err, sleepErr)
+			}
+		}
+		if !s.allow() {
+			if err == nil {
+				return fmt.Errorf("%w: circuit breaker is open", oops.Unavailable)
+			}
+			return fmt.Errorf("%w: circuit breaker opened: %w", oops.Unavailable, err)
+		}
+		err = call()
+		s.record(err)
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: giving up after %d attempts: %w", oops.Unavailable, attempts, err)
+}
+
+// backoff is full jitter: a random delay up to the exponentially growing cap.
+func (s *ResilientBlobStore) backoff(attempt int) time.Duration {
+	ceiling := s.opts.BaseDelay << (attempt - 1)
+	if ceiling > s.opts.MaxDelay || ceiling <= 0 {
+		ceiling = s.opts.MaxDelay
+	}
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+func (s *ResilientBlobStore) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.state {
+	case breakerOpen:
+		if s.now().Sub(s.openedAt) < s.opts.OpenTimeout {
+			return false
+		}
+		s.state = breakerHalfOpen
+		s.probing = true
+		return true
+	case breakerHalfOpen:
+		if s.probing {
+			return false
+		}
+		s.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record feeds the outcome of a call to the breaker. Answers count as success, the backend is up,
+// transient failures count against it. Every other error says nothing about it: a cancelled call,
+// the verdicts on the data or the caller that decorators above the backend hand down, a damaged object,
+// a full quota or a refused key, a body that could not be read and errors nobody expected.
+func (s *ResilientBlobStore) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+	for _, neutral := range []error{context.Canceled, context.DeadlineExceeded, oops.Corrupted, oops.QuotaExceeded, oops.Unauthorized} {
+		if errors.Is(err, neutral) {
+			return
+		}
+	}
+	switch {
+	case err == nil || isAnswer(err):
+		s.state = breakerClosed
+		s.failures = 0
+	case IsRetryable(err):
+		s.failures++
+		if s.state == breakerHalfOpen || s.failures >= s.opts.FailureThreshold {
+			s.state = breakerOpen
+			s.openedAt = s.now()
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
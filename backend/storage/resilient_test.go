@@ -0,0 +1,291 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/storage/storagetest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type statusError int
+
+func (e statusError) Error() string       { return fmt.Sprintf("status %d", int(e)) }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+var errTransient = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+func newFaulty() *storagetest.FaultyBlobStore {
+	return storagetest.NewFaultyBlobStore(storage.NewInMemoryBlobStore(), 1)
+}
+
+// fail scripts an error for the next calls of op on key, every call if times is 0.
+func fail(op storagetest.Op, key string, err error, times int) storagetest.Fault {
+	return storagetest.Fault{Op: op, Key: key, Action: storagetest.Fail, Err: err, Times: times}
+}
+
+// hits counts the calls of op the faults of store hit.
+func hits(store *storagetest.FaultyBlobStore, op storagetest.Op) int {
+	n := 0
+	for _, injection := range store.Injected() {
+		if injection.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+func read(t *testing.T, store storage.BlobStore, key string) string {
+	t.Helper()
+	reader, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q) error = %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return string(data)
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{oops.KeyNotFound, false},
+		{fmt.Errorf("wrapped: %w", oops.InvalidKey), false},
+		{oops.Conflict, false},
+		{context.Canceled, false},
+		{fmt.Errorf("%w: checksum mismatch", oops.Corrupted), false},
+		{fmt.Errorf("%w: %w: over the hard limit", oops.TooLarge, oops.QuotaExceeded), false},
+		{oops.QuotaExceeded, false},
+		{oops.Unauthorized, false},
+		{oops.Unavailable, false},
+		{errors.New("unexpected"), false},
+		{io.ErrUnexpectedEOF, false},
+		{fmt.Errorf("reading the body: %w", syscall.ECONNRESET), true},
+		{os.ErrDeadlineExceeded, true},
+		{errTransient, true},
+		{statusError(503), true},
+		{statusError(429), true},
+		{statusError(403), false},
+		{&storage.DeleteError{Failed: map[string]error{"a": statusError(403)}}, false},
+		{&storage.DeleteError{Failed: map[string]error{"a": statusError(403), "b": statusError(500)}}, true},
+	}
+	for _, tt := range tests {
+		if got := storage.IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestResilientBlobStore_Retries(t *testing.T) {
+	ctx := context.Background()
+	faulty := newFaulty()
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 3, FailureThreshold: 10}, time.Now)
+
+	// the first attempt consumes part of the body before the connection drops
+	faulty.Inject(
+		storagetest.Fault{Op: storagetest.OpPut, Key: "key", Action: storagetest.Truncate, Err: errTransient, Bytes: 2, Times: 1},
+		fail(storagetest.OpPut, "key", statusError(500), 1),
+	)
+	if _, err := store.Put(ctx, "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := read(t, faulty, "key"); got != "0123456789" {
+		t.Errorf("stored %q after retries, want the whole body", got)
+	}
+
+	faulty.Reset()
+	faulty.Inject(fail(storagetest.OpGet, "key", errTransient, 1))
+	if got := read(t, store, "key"); got != "0123456789" || hits(faulty, storagetest.OpGet) != 1 {
+		t.Errorf("Get() = %q after %d failures, want the content after one retry", got, hits(faulty, storagetest.OpGet))
+	}
+
+	faulty.Reset()
+	faulty.Inject(fail(storagetest.OpStat, "missing", oops.KeyNotFound, 0))
+	if _, err := store.Stat(ctx, "missing"); err != oops.KeyNotFound || hits(faulty, storagetest.OpStat) != 1 {
+		t.Errorf("Stat() error = %v after %d calls, want %v without retries", err, hits(faulty, storagetest.OpStat), oops.KeyNotFound)
+	}
+
+	faulty.Reset()
+	faulty.Inject(fail(storagetest.OpStat, "key", errTransient, 0))
+	_, err := store.Stat(ctx, "key")
+	if !errors.Is(err, oops.Unavailable) || !errors.Is(err, errTransient) || hits(faulty, storagetest.OpStat) != 3 {
+		t.Errorf("Stat() error = %v after %d calls, want oops.Unavailable wrapping the last failure", err, hits(faulty, storagetest.OpStat))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	faulty.Reset()
+	faulty.Inject(fail(storagetest.OpStat, "key", errTransient, 1))
+	store = storage.NewResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 3, FailureThreshold: 10})
+	if _, err = store.Stat(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Stat() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestResilientBlobStore_ReplayLimit(t *testing.T) {
+	faulty := newFaulty().Inject(storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Truncate, Err: errTransient, Bytes: 2})
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxReplayBytes: 4, FailureThreshold: 10}, time.Now)
+	body := io.MultiReader(strings.NewReader("0123456789"))
+	if _, err := store.Put(context.Background(), "key", body, nil); !errors.Is(err, oops.Unavailable) {
+		t.Errorf("Put() error = %v, want %v", err, oops.Unavailable)
+	}
+	if hits(faulty, storagetest.OpPut) != 1 {
+		t.Errorf("PutIf calls = %d, want a single attempt for a body that cannot be replayed", hits(faulty, storagetest.OpPut))
+	}
+}
+
+// failingReader is a client body that breaks off after its data.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *failingReader) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func TestResilientBlobStore_NotRetried(t *testing.T) {
+	ctx := context.Background()
+	faulty := newFaulty()
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 3, FailureThreshold: 1, OpenTimeout: time.Minute}, time.Now)
+	faulty.Inject(storagetest.Fault{Op: storagetest.OpPut, Action: storagetest.Delay})
+
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"aborted upload", io.ErrUnexpectedEOF},
+		{"reset client", errTransient},
+		{"bug", errors.New("unexpected")},
+	} {
+		body := &failingReader{data: "0123", err: tt.err}
+		if _, err := store.Put(ctx, "key", body, nil); !errors.Is(err, tt.err) {
+			t.Errorf("Put() of a %s error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if writes := hits(faulty, storagetest.OpPut); writes != 3 {
+		t.Errorf("Put() called the store %d times, want one call per body without retries", writes)
+	}
+
+	faulty.Reset()
+	faulty.Inject(fail(storagetest.OpStat, "key", errors.New("unexpected"), 0))
+	store.Stat(ctx, "key")
+	store.Stat(ctx, "key")
+	if hits(faulty, storagetest.OpStat) != 2 {
+		t.Errorf("Stat() calls = %d, want 2 without retries nor an open breaker", hits(faulty, storagetest.OpStat))
+	}
+	if _, err := store.Put(ctx, "key", strings.NewReader("data"), nil); err != nil {
+		t.Errorf("Put() error = %v, want the breaker still closed", err)
+	}
+}
+
+func TestResilientBlobStore_CircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	faulty := newFaulty()
+	now := time.Unix(0, 0)
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 1, FailureThreshold: 2, OpenTimeout: time.Minute},
+		func() time.Time { return now })
+	faulty.Put(ctx, "key", strings.NewReader("data"), nil)
+
+	faulty.Inject(fail(storagetest.OpStat, "key", errTransient, 0))
+	store.Stat(ctx, "key")
+	store.Stat(ctx, "key")
+	_, err := store.Stat(ctx, "key")
+	if !errors.Is(err, oops.Unavailable) || hits(faulty, storagetest.OpStat) != 2 {
+		t.Errorf("Stat() error = %v after %d calls, want to fail fast once open", err, hits(faulty, storagetest.OpStat))
+	}
+
+	now = now.Add(time.Minute)
+	store.Stat(ctx, "key")
+	if _, err = store.Stat(ctx, "key"); !errors.Is(err, oops.Unavailable) || hits(faulty, storagetest.OpStat) != 3 {
+		t.Errorf("Stat() error = %v after %d calls, want a failed probe to reopen", err, hits(faulty, storagetest.OpStat))
+	}
+
+	now = now.Add(time.Minute)
+	faulty.Reset()
+	if _, err = store.Stat(ctx, "missing"); err != oops.KeyNotFound {
+		t.Errorf("Stat() probe error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if _, err = store.Stat(ctx, "key"); err != nil {
+		t.Errorf("Stat() error = %v, want the breaker closed after an answer", err)
+	}
+}
+
+func TestResilientBlobStore_BreakerIgnoresVerdicts(t *testing.T) {
+	ctx := context.Background()
+	faulty := newFaulty()
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 3, FailureThreshold: 2, OpenTimeout: time.Minute}, time.Now)
+	faulty.Put(ctx, "key", strings.NewReader("data"), nil)
+
+	for _, verdict := range []error{oops.Corrupted, oops.QuotaExceeded, oops.Unauthorized} {
+		faulty.Reset()
+		faulty.Inject(fail(storagetest.OpStat, "key", verdict, 0))
+		if _, err := store.Stat(ctx, "key"); !errors.Is(err, verdict) || hits(faulty, storagetest.OpStat) != 1 {
+			t.Errorf("Stat() error = %v after %d calls, want %v without retries", err, hits(faulty, storagetest.OpStat), verdict)
+		}
+	}
+
+	// a verdict between two failures neither closes nor opens the breaker
+	faulty.Reset()
+	faulty.Inject(
+		fail(storagetest.OpStat, "key", errTransient, 1),
+		fail(storagetest.OpStat, "key", oops.Corrupted, 1),
+		fail(storagetest.OpStat, "key", errTransient, 1),
+	)
+	store = storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{MaxAttempts: 1, FailureThreshold: 2, OpenTimeout: time.Minute}, time.Now)
+	store.Stat(ctx, "key")
+	store.Stat(ctx, "key")
+	store.Stat(ctx, "key")
+	if _, err := store.Stat(ctx, "key"); !errors.Is(err, oops.Unavailable) {
+		t.Errorf("Stat() error = %v, want the breaker open after two failures", err)
+	}
+}
+
+func TestResilientBlobStore_DeleteMany(t *testing.T) {
+	ctx := context.Background()
+	faulty := newFaulty()
+	store := storage.NewTestResilientBlobStore(faulty, storage.RetryOptions{FailureThreshold: 10}, time.Now)
+	for _, key := range []string{"a", "b", "c"} {
+		faulty.Put(ctx, key, strings.NewReader(key), nil)
+	}
+	faulty.Inject(
+		fail(storagetest.OpDelete, "b", statusError(500), 1),
+		fail(storagetest.OpDelete, "c", statusError(403), 1),
+	)
+
+	err := store.DeleteMany(ctx, []string{"a", "b", "c"})
+	var deleteErr *storage.DeleteError
+	if !errors.As(err, &deleteErr) || len(deleteErr.Failed) != 1 || deleteErr.Failed["c"] == nil {
+		t.Fatalf("DeleteMany() error = %v, want only c failed", err)
+	}
+	if hits(faulty, storagetest.OpDelete) != 2 {
+		t.Errorf("DeleteMany failures = %d, want b to succeed on its retry", hits(faulty, storagetest.OpDelete))
+	}
+	results, _ := faulty.List(ctx, "", "")
+	if len(results) != 1 || results[0].Key != "c" {
+		t.Errorf("List() = %v, want only c left", results)
+	}
+}
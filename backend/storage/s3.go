@@ -4,49 +4,91 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"io"
+	"net/http"
+	"net/url"
 	"simplicity/oops"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// s3PartSize bounds the memory a single Put holds at once. Bodies that fit into one part
+// are sent with a plain PutObject, larger or unknown-length bodies go through multipart upload.
+const s3PartSize = 8 * 1024 * 1024 // 8MB, S3 requires at least 5MB for all but the last part
+
+// s3PollInterval is how often Watch lists the bucket, S3 has no change feed the store could follow.
+const s3PollInterval = 10 * time.Second
+
 type S3BlobStore struct {
-	client *s3.Client
-	bucket string
+	client   *s3.Client
+	bucket   string
+	partSize int
+	poll     time.Duration
+	// parts holds *[]byte buffers of partSize for the bodies of unknown or large length
+	parts sync.Pool
 }
 
 func NewS3BlobStore(client *s3.Client, bucket string) BlobStore {
-	return &S3BlobStore{client, bucket}
+	return &S3BlobStore{client: client, bucket: bucket, partSize: s3PartSize, poll: s3PollInterval}
 }
 
 func (s *S3BlobStore) List(ctx context.Context, prefix string, delimiter string) ([]ListResult, error) {
-	var err error
-	var output *s3.ListObjectsV2Output
-	var result ListResult
+	return listAll(ctx, s, prefix, delimiter)
+}
+
+func (s *S3BlobStore) ListPage(ctx context.Context, opts ListOptions) (ListPage, error) {
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
 	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s.bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String(delimiter),
-	}
-	var results []ListResult
-	objectPaginator := s3.NewListObjectsV2Paginator(s.client, input)
-	for objectPaginator.HasMorePages() {
-		output, err = objectPaginator.NextPage(ctx)
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(opts.Prefix),
+		MaxKeys: aws.Int32(int32(maxKeys)),
+	}
+	if opts.Delimiter != "" {
+		input.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.StartAfter != "" {
+		input.StartAfter = aws.String(opts.StartAfter)
+	}
+	if opts.ContinuationToken != "" {
+		input.ContinuationToken = aws.String(opts.ContinuationToken)
+	}
+	output, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return ListPage{}, err
+	}
+	results := make([]ListResult, 0, len(output.Contents)+len(output.CommonPrefixes))
+	for _, object := range output.Contents {
+		result, err := toLestResult(object)
 		if err != nil {
-			return nil, err
+			return ListPage{}, err
 		}
-		for _, object := range output.Contents {
-			result, err = toLestResult(object)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, result)
-
+		results = append(results, result)
+	}
+	for _, commonPrefix := range output.CommonPrefixes {
+		if commonPrefix.Prefix == nil {
+			continue
 		}
+		results = append(results, ListResult{IsObject: false, Key: *commonPrefix.Prefix, Size: 0})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+	page := ListPage{Results: results}
+	if aws.ToBool(output.IsTruncated) {
+		page.NextToken = aws.ToString(output.NextContinuationToken)
 	}
-	return results, nil
+	return page, nil
 }
 
 func toLestResult(object types.Object) (ListResult, error) {
@@ -64,43 +106,294 @@ func toLestResult(object types.Object) (ListResult, error) {
 	}, nil
 }
 
-func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	if key == "" {
+		return nil, ObjectInfo{}, oops.InvalidKey
+	}
 	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "NoSuchKey") {
-			return nil, nil, oops.KeyNotFound
+		return nil, ObjectInfo{}, mapS3Error(err)
+	}
+	return output.Body, ObjectInfo{
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		Metadata:     output.Metadata,
+	}, nil
+}
+
+func (s *S3BlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, ObjectInfo, error) {
+	if key == "" {
+		return nil, ObjectInfo{}, oops.InvalidKey
+	}
+	if offset < 0 {
+		return nil, ObjectInfo{}, oops.InvalidRange
+	}
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, mapS3Error(err)
+	}
+	size := aws.ToInt64(output.ContentLength)
+	if contentRange := aws.ToString(output.ContentRange); contentRange != "" {
+		// "bytes 0-99/1234", the object size follows the slash
+		total, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+		if err == nil {
+			size = total
 		}
-		return nil, nil, err
 	}
-	return output.Body, output.Metadata, nil
+	return output.Body, ObjectInfo{
+		Size:         size,
+		LastModified: aws.ToTime(output.LastModified),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		Metadata:     output.Metadata,
+	}, nil
 }
 
-func (s *S3BlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
 	if key == "" {
-		return errors.New("key is empty")
+		return ObjectInfo{}, oops.InvalidKey
 	}
-	data, err := io.ReadAll(reader)
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return err
+		return ObjectInfo{}, mapS3Error(err)
 	}
+	return ObjectInfo{
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		Metadata:     output.Metadata,
+	}, nil
+}
 
-	input := &s3.PutObjectInput{
+func (s *S3BlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	request, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign get: %w", err)
+	}
+	return request.URL, nil
+}
+
+// PresignPut signs the Content-Length, S3 refuses the upload unless the body has exactly size bytes.
+func (s *S3BlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	if size <= 0 {
+		return "", fmt.Errorf("%w: presigned uploads need a size, got %d", oops.ValidationError, size)
+	}
+	request, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(s.bucket),
 		Key:           aws.String(key),
-		Body:          bytes.NewReader(data),
-		ContentLength: aws.Int64(int64(len(data))),
-		Metadata:      metadata,
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign put: %w", err)
+	}
+	return request.URL, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, Precondition{})
+}
+
+func (s *S3BlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	if key == "" {
+		return "", oops.InvalidKey
+	}
+	ifMatch, ifNoneMatch := s3Precondition(cond)
+	buf, release := s.partBuffer(reader)
+	defer release()
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		input := &s3.PutObjectInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+			ContentType:   aws.String(http.DetectContentType(buf[:n])),
+			Metadata:      metadata,
+			IfMatch:       ifMatch,
+			IfNoneMatch:   ifNoneMatch,
+		}
+		output, err := s.client.PutObject(ctx, input)
+		if err != nil {
+			return "", mapS3Error(err)
+		}
+		return aws.ToString(output.ETag), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.putMultipart(ctx, key, buf, reader, metadata, cond)
+}
+
+// partBuffer returns the buffer PutIf reads the first part into. Bodies that tell their length and fit into
+// a part get a buffer one byte longer, so reading them ends in EOF and they go out with a single PutObject,
+// all others share pooled buffers of a whole part instead of allocating one per Put.
+func (s *S3BlobStore) partBuffer(reader io.Reader) ([]byte, func()) {
+	if sized, ok := reader.(interface{ Len() int }); ok && sized.Len() < s.partSize {
+		return make([]byte, sized.Len()+1), func() {}
+	}
+	buf, ok := s.parts.Get().(*[]byte)
+	if !ok {
+		allocated := make([]byte, s.partSize)
+		buf = &allocated
+	}
+	return *buf, func() { s.parts.Put(buf) }
+}
+
+func s3Precondition(cond Precondition) (ifMatch *string, ifNoneMatch *string) {
+	if cond.IfMatch != "" {
+		ifMatch = aws.String(cond.IfMatch)
+	}
+	if cond.IfNoneMatch {
+		ifNoneMatch = aws.String("*")
+	}
+	return ifMatch, ifNoneMatch
+}
+
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return oops.KeyNotFound
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return oops.Conflict
+		case "InvalidRange":
+			return oops.InvalidRange
+		}
+	}
+	if strings.Contains(err.Error(), "NoSuchKey") {
+		return oops.KeyNotFound
 	}
-	_, err = s.client.PutObject(ctx, input)
 	return err
 }
 
+// putMultipart uploads the already read first part from buf and then keeps refilling the same
+// buffer from reader, so memory use stays at one part regardless of the object size.
+func (s *S3BlobStore) putMultipart(ctx context.Context, key string, buf []byte, reader io.Reader, metadata map[string]string, cond Precondition) (string, error) {
+	upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(http.DetectContentType(buf)),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	var parts []types.CompletedPart
+	n := len(buf)
+	for partNumber := int32(1); n > 0; partNumber++ {
+		output, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      upload.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return "", s.abortMultipart(key, upload.UploadId, fmt.Errorf("failed to upload part %d: %w", partNumber, err))
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(partNumber)})
+
+		n, err = io.ReadFull(reader, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return "", s.abortMultipart(key, upload.UploadId, err)
+		}
+	}
+	ifMatch, ifNoneMatch := s3Precondition(cond)
+	output, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		IfMatch:         ifMatch,
+		IfNoneMatch:     ifNoneMatch,
+	})
+	if err != nil {
+		return "", s.abortMultipart(key, upload.UploadId, mapS3Error(err))
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// abortMultipart uses its own context, the request one is usually what got cancelled.
+func (s *S3BlobStore) abortMultipart(key string, uploadID *string, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to abort multipart upload: %w", err))
+	}
+	return cause
+}
+
+func (s *S3BlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if src == "" || dst == "" {
+		return oops.InvalidKey
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(dst),
+		CopySource:        aws.String(s.bucket + "/" + url.PathEscape(src)),
+		MetadataDirective: types.MetadataDirectiveCopy,
+	}
+	if metadata != nil {
+		// replacing metadata resets the content type as well, so carry it over
+		info, err := s.Stat(ctx, src)
+		if err != nil {
+			return err
+		}
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.Metadata = metadata
+		input.ContentType = aws.String(info.ContentType)
+	}
+	_, err := s.client.CopyObject(ctx, input)
+	return mapS3Error(err)
+}
+
+// Move is a copy followed by a delete, S3 has no rename.
+func (s *S3BlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	if err := s.Copy(ctx, src, dst, metadata); err != nil {
+		return err
+	}
+	if src == dst {
+		return nil
+	}
+	return s.Delete(ctx, src)
+}
+
 func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
 	if key == "" {
-		return errors.New("key is empty")
+		return oops.InvalidKey
 	}
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -110,34 +403,79 @@ func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// DeleteMany sends the keys in DeleteObjects batches, each batch is applied by S3 as a whole
+// but a failed batch does not stop the following ones.
+func (s *S3BlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	objects := make([]types.ObjectIdentifier, 0, min(len(keys), deleteBatchSize))
+	for _, key := range keys {
+		if key == "" {
+			failed[key] = oops.InvalidKey
+			continue
+		}
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+	}
+	for start := 0; start < len(objects); start += deleteBatchSize {
+		batch := objects[start:min(start+deleteBatchSize, len(objects))]
+		output, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, object := range batch {
+				failed[*object.Key] = err
+			}
+			continue
+		}
+		for _, deleteErr := range output.Errors {
+			failed[aws.ToString(deleteErr.Key)] = fmt.Errorf("%s: %s", aws.ToString(deleteErr.Code), aws.ToString(deleteErr.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
+	}
+	return nil
+}
+
 func (s *S3BlobStore) DeleteAll(ctx context.Context, prefix string) error {
 	if prefix == "" {
-		return errors.New("prefix is empty")
+		return oops.InvalidKey
 	}
-	if !strings.HasSuffix(prefix, Delimiter) {
-		prefix += Delimiter
+	return deleteAll(ctx, s, prefix)
+}
+
+// Watch polls the objects under prefix and reports the keys whose ETag or LastModified changed,
+// changes that are undone between two polls go unnoticed.
+func (s *S3BlobStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return pollChanges(ctx, s.pollInterval(), func(ctx context.Context) (map[string]objectVersion, error) {
+		return s.listVersions(ctx, prefix)
+	})
+}
+
+func (s *S3BlobStore) pollInterval() time.Duration {
+	if s.poll <= 0 {
+		return s3PollInterval
 	}
-	input := &s3.ListObjectsV2Input{
+	return s.poll
+}
+
+func (s *S3BlobStore) listVersions(ctx context.Context, prefix string) (map[string]objectVersion, error) {
+	versions := make(map[string]objectVersion)
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
 		Prefix: aws.String(prefix),
-	}
-	var err error
-	var output *s3.ListObjectsV2Output
-	objectPaginator := s3.NewListObjectsV2Paginator(s.client, input)
-	for objectPaginator.HasMorePages() {
-		output, err = objectPaginator.NextPage(ctx)
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		for _, object := range output.Contents {
-			if object.Key == nil {
-				continue
-			}
-			err = s.Delete(ctx, *object.Key)
-			if err != nil {
-				return err
+			versions[aws.ToString(object.Key)] = objectVersion{
+				etag:         aws.ToString(object.ETag),
+				lastModified: aws.ToTime(object.LastModified),
 			}
 		}
 	}
-	return nil
+	return versions, nil
 }
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"simplicity/oops"
+	"simplicity/storage/s3test"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingReader struct {
+	reader io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestS3BlobStore_Put(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		puts  int
+		parts int
+	}{
+		{name: "empty", size: 0, puts: 1},
+		{name: "single part", size: 15, puts: 1},
+		{name: "exactly one part", size: 16, parts: 1},
+		{name: "multipart", size: 100, parts: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := s3test.New(t)
+			store := &S3BlobStore{client: client, bucket: "bucket", partSize: 16}
+			data := strings.Repeat("x", tt.size)
+
+			// hide the length from the SDK to mimic a streamed upload
+			_, err := store.Put(context.Background(), "images/1", io.MultiReader(strings.NewReader(data)), nil)
+			if err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if got, _ := fake.Object("bucket", "images/1"); string(got) != data {
+				t.Errorf("stored %d bytes, want %d", len(got), len(data))
+			}
+			stats := fake.Stats()
+			if stats.Puts != tt.puts || stats.Parts != tt.parts {
+				t.Errorf("puts = %d, parts = %d, want %d and %d", stats.Puts, stats.Parts, tt.puts, tt.parts)
+			}
+			if stats.MaxPart > store.partSize {
+				t.Errorf("part of %d bytes exceeds the part size %d", stats.MaxPart, store.partSize)
+			}
+		})
+	}
+}
+
+func TestS3BlobStore_PartBuffer(t *testing.T) {
+	fake, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 16}
+
+	buf, release := store.partBuffer(strings.NewReader("small"))
+	if len(buf) != 6 {
+		t.Errorf("partBuffer() of a 5 byte body = %d bytes, want 6", len(buf))
+	}
+	release()
+	buf, release = store.partBuffer(io.MultiReader(strings.NewReader("small")))
+	if len(buf) != store.partSize {
+		t.Errorf("partBuffer() of a body of unknown length = %d bytes, want %d", len(buf), store.partSize)
+	}
+	release()
+
+	ctx := context.Background()
+	for _, data := range []string{"", "small", strings.Repeat("x", 15), strings.Repeat("x", 16), strings.Repeat("x", 40)} {
+		if _, err := store.Put(ctx, "images/1", strings.NewReader(data), nil); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		if got, _ := fake.Object("bucket", "images/1"); string(got) != data {
+			t.Errorf("stored %q, want %q", got, data)
+		}
+	}
+	if stats := fake.Stats(); stats.Puts != 3 {
+		t.Errorf("puts = %d, want the 3 bodies below the part size in a single put", stats.Puts)
+	}
+}
+
+func TestS3BlobStore_Put_AbortsOnReadError(t *testing.T) {
+	fake, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 16}
+
+	_, err := store.Put(context.Background(), "images/1", &failingReader{strings.NewReader(strings.Repeat("x", 40))}, nil)
+	if err == nil {
+		t.Fatal("Put() error = nil, want read error")
+	}
+	if stats := fake.Stats(); stats.Aborted != 1 || stats.OpenUploads != 0 {
+		t.Errorf("aborted = %d, open uploads = %d, want 1 and none", stats.Aborted, stats.OpenUploads)
+	}
+	if _, ok := fake.Object("bucket", "images/1"); ok {
+		t.Error("object stored despite the failed upload")
+	}
+}
+
+func TestS3BlobStore_PutIf(t *testing.T) {
+	for _, partSize := range []int{1024, 4} {
+		_, client := s3test.New(t)
+		store := &S3BlobStore{client: client, bucket: "bucket", partSize: partSize}
+		ctx := context.Background()
+
+		etag, err := store.PutIf(ctx, "item/items.js", strings.NewReader("v1"), nil, Precondition{IfNoneMatch: true})
+		if err != nil || etag == "" {
+			t.Fatalf("PutIf() = %q, %v, want an etag", etag, err)
+		}
+		_, err = store.PutIf(ctx, "item/items.js", strings.NewReader("v2"), nil, Precondition{IfNoneMatch: true})
+		if !errors.Is(err, oops.Conflict) {
+			t.Errorf("PutIf() create-only error = %v, want %v", err, oops.Conflict)
+		}
+		_, err = store.PutIf(ctx, "item/items.js", strings.NewReader("v2"), nil, Precondition{IfMatch: `"stale"`})
+		if !errors.Is(err, oops.Conflict) {
+			t.Errorf("PutIf() with stale etag error = %v, want %v", err, oops.Conflict)
+		}
+		next, err := store.PutIf(ctx, "item/items.js", strings.NewReader("v2 with more data"), nil, Precondition{IfMatch: etag})
+		if err != nil || next == etag {
+			t.Errorf("PutIf() = %q, %v, want a new etag", next, err)
+		}
+	}
+}
+
+func TestS3BlobStore_List(t *testing.T) {
+	_, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024}
+	ctx := context.Background()
+	for _, key := range []string{"images/files/1/source.data", "images/files/1/canonical.png", "images/files/2/source.data", "images/files/readme"} {
+		if _, err := store.Put(ctx, key, strings.NewReader(key), nil); err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+
+	result, err := store.List(ctx, "images/files/", Delimiter)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := []ListResult{
+		{IsObject: false, Key: "images/files/1/"},
+		{IsObject: false, Key: "images/files/2/"},
+		{IsObject: true, Key: "images/files/readme", Size: 19},
+	}
+	if len(result) != len(want) {
+		t.Fatalf("List() = %v, want %v", result, want)
+	}
+	for i := range want {
+		if result[i] != want[i] {
+			t.Errorf("List() = %v, want %v", result, want)
+			break
+		}
+	}
+
+	page, err := store.ListPage(ctx, ListOptions{Prefix: "images/files/", Delimiter: Delimiter, MaxKeys: 2})
+	if err != nil {
+		t.Fatalf("ListPage() error = %v", err)
+	}
+	if len(page.Results) != 2 || page.NextToken == "" {
+		t.Fatalf("ListPage() = %v, want 2 results and a next token", page)
+	}
+	page, err = store.ListPage(ctx, ListOptions{Prefix: "images/files/", Delimiter: Delimiter, MaxKeys: 2, ContinuationToken: page.NextToken})
+	if err != nil {
+		t.Fatalf("ListPage() error = %v", err)
+	}
+	if len(page.Results) != 1 || page.Results[0] != want[2] || page.NextToken != "" {
+		t.Errorf("ListPage() = %v, want the last result only", page)
+	}
+}
+
+func TestS3BlobStore_GetStat(t *testing.T) {
+	_, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024}
+	ctx := context.Background()
+	etag, err := store.Put(ctx, "images/1", strings.NewReader("\x89PNG\r\n\x1a\n"), map[string]string{"extension": "png"})
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	info, err := store.Stat(ctx, "images/1")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size != 8 || info.ETag != etag || info.ContentType != "image/png" || info.Metadata["extension"] != "png" {
+		t.Errorf("Stat() = %+v, want size 8, etag %s, image/png and the metadata", info, etag)
+	}
+	if info.LastModified.IsZero() {
+		t.Error("Stat() has no last modified time")
+	}
+
+	reader, info, err := store.Get(ctx, "images/1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+	if info.ETag != etag || info.Metadata["extension"] != "png" {
+		t.Errorf("Get() info = %+v, want etag %s and the metadata", info, etag)
+	}
+
+	if _, err = store.Stat(ctx, "images/2"); err != oops.KeyNotFound {
+		t.Errorf("Stat() error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if _, _, err = store.Get(ctx, "images/2"); err != oops.KeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+func TestS3BlobStore_GetRange(t *testing.T) {
+	_, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024}
+	ctx := context.Background()
+	if _, err := store.Put(ctx, "key", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	testGetRange(t, store)
+}
+
+func TestS3BlobStore_CopyMove(t *testing.T) {
+	_, client := s3test.New(t)
+	testCopyMove(t, &S3BlobStore{client: client, bucket: "bucket", partSize: 1024})
+}
+
+func TestS3BlobStore_DeleteMany(t *testing.T) {
+	fake, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024}
+	ctx := context.Background()
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("images/files/1/%04d", i)
+		fake.PutObject("bucket", key, []byte("x"))
+	}
+	fake.PutObject("bucket", "images/files/2/source.data", []byte("x"))
+	fake.Deny("images/files/1/0042")
+
+	err := store.DeleteAll(ctx, "images/files/1")
+	var deleteErr *DeleteError
+	if !errors.As(err, &deleteErr) {
+		t.Fatalf("DeleteAll() error = %v, want a DeleteError", err)
+	}
+	if len(deleteErr.Failed) != 1 || deleteErr.Failed["images/files/1/0042"] == nil {
+		t.Errorf("DeleteAll() failed keys = %v, want images/files/1/0042 only", deleteErr.Failed)
+	}
+	if batches := fake.Stats().Batches; batches != 3 {
+		t.Errorf("DeleteObjects calls = %d, want 3", batches)
+	}
+	if keys := fake.Keys("bucket"); len(keys) != 2 {
+		t.Errorf("objects left = %v, want the denied one and the other image", keys)
+	}
+}
+
+func TestS3BlobStore_Presign(t *testing.T) {
+	_, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024}
+	ctx := context.Background()
+
+	if _, err := store.PresignPut(ctx, "images/uploads/1", 0, time.Minute); !errors.Is(err, oops.ValidationError) {
+		t.Errorf("PresignPut() without a size error = %v, want %v", err, oops.ValidationError)
+	}
+	putURL, err := store.PresignPut(ctx, "images/uploads/1", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() error = %v", err)
+	}
+	if signed, _ := url.Parse(putURL); !strings.Contains(signed.Query().Get("X-Amz-SignedHeaders"), "content-length") {
+		t.Errorf("PresignPut() = %q, want the content length signed", putURL)
+	}
+	req, _ := http.NewRequest(http.MethodPut, putURL, strings.NewReader("data"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT to the presigned url = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	getURL, err := store.PresignGet(ctx, "images/uploads/1", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignGet() error = %v", err)
+	}
+	if !strings.Contains(getURL, "/bucket/images/uploads/1?") {
+		t.Errorf("PresignGet() = %q, want the bucket and key in the url", getURL)
+	}
+	resp, err = http.Get(getURL)
+	if err != nil {
+		t.Fatalf("GET of the presigned url error = %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "data" {
+		t.Errorf("GET of the presigned url = %d %q, want %d %q", resp.StatusCode, data, http.StatusOK, "data")
+	}
+}
@@ -0,0 +1,381 @@
+// Package s3test runs an in-process fake of the S3 REST API, so code using the S3 SDK can be tested
+// without a bucket or credentials. It understands just enough for storage.S3BlobStore: GET with ranges,
+// HEAD, single PUT, copy, DELETE, DeleteObjects, the multipart flow, the If-Match/If-None-Match
+// preconditions, user metadata headers and ListObjectsV2 with prefixes, delimiters and paging.
+// Buckets do not have to be created, any path segment works as one.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Server is the fake, its URL is the endpoint to point an S3 client at with path style addressing.
+type Server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	objects  map[string]*object
+	uploads  map[string]*upload
+	denied   map[string]bool
+	stats    Stats
+	uploadID int
+}
+
+// Stats count the requests the server has handled. MaxPart is the largest multipart part received.
+type Stats struct {
+	Puts        int
+	Parts       int
+	Batches     int
+	Aborted     int
+	MaxPart     int
+	OpenUploads int
+}
+
+type object struct {
+	data     []byte
+	etag     string
+	header   http.Header
+	modified time.Time
+}
+
+type upload struct {
+	parts  [][]byte
+	header http.Header
+}
+
+// NewServer starts a fake, the caller closes it.
+func NewServer() *Server {
+	s := &Server{
+		objects: make(map[string]*object),
+		uploads: make(map[string]*upload),
+		denied:  make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// New starts a fake that is closed with the test and returns it with a client for it.
+func New(t testing.TB) (*Server, *s3.Client) {
+	s := NewServer()
+	t.Cleanup(s.Close)
+	return s, s.Client()
+}
+
+// Client returns an S3 client for the fake with static credentials, so presigning works too.
+func (s *Server) Client() *s3.Client {
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(s.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.OpenUploads = len(s.uploads)
+	return stats
+}
+
+// Object returns the stored content of key in bucket.
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// PutObject stores an object directly, without counting as a request.
+func (s *Server) PutObject(bucket string, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = &object{data: data, etag: fmt.Sprintf(`"%x"`, md5.Sum(data)), header: make(http.Header), modified: time.Now().UTC()}
+}
+
+// Keys returns the keys stored in bucket in order.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(bucket)
+}
+
+// Deny makes DeleteObjects report AccessDenied for key in every bucket.
+func (s *Server) Deny(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[key] = true
+}
+
+func (s *Server) keys(bucket string) []string {
+	keys := make([]string, 0, len(s.objects))
+	for path := range s.objects {
+		if key, ok := strings.CutPrefix(path, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	path := bucket + "/" + key
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPut && !query.Has("uploadId") || r.Method == http.MethodPost && query.Has("uploadId") {
+		current, exists := s.objects[path]
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if ifNoneMatch == "*" && exists || ifMatch != "" && (!exists || ifMatch != current.etag) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.list(w, bucket, query)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.get(w, r, path)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		s.deleteObjects(w, bucket, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.uploadID++
+		id := strconv.Itoa(s.uploadID)
+		s.uploads[id] = &upload{header: objectHeaders(r.Header)}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, id)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, path)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		upload.parts = append(upload.parts, body)
+		s.stats.Parts++
+		s.stats.MaxPart = max(s.stats.MaxPart, len(body))
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, len(upload.parts)))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		id := query.Get("uploadId")
+		upload, ok := s.uploads[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		data := bytes.Join(upload.parts, nil)
+		etag := fmt.Sprintf(`"%x-%d"`, md5.Sum(data), len(upload.parts))
+		s.objects[path] = &object{data: data, etag: etag, header: upload.header, modified: time.Now().UTC()}
+		delete(s.uploads, id)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>`, html.EscapeString(etag))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		s.stats.Aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		obj := &object{data: body, etag: fmt.Sprintf(`"%x"`, md5.Sum(body)), header: objectHeaders(r.Header), modified: time.Now().UTC()}
+		s.objects[path] = obj
+		s.stats.Puts++
+		w.Header().Set("ETag", obj.etag)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, path string) {
+	obj, ok := s.objects[path]
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	for k, v := range obj.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+	data := obj.data
+	status := http.StatusOK
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		first, last, _ := strings.Cut(strings.TrimPrefix(byteRange, "bytes="), "-")
+		start, _ := strconv.Atoi(first)
+		end := len(data) - 1
+		if last != "" {
+			end, _ = strconv.Atoi(last)
+			end = min(end, len(data)-1)
+		}
+		if start >= len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, path string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	src, ok := s.objects[strings.TrimPrefix(source, "/")]
+	if err != nil || !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	copied := &object{data: src.data, etag: src.etag, header: src.header, modified: time.Now().UTC()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		copied.header = objectHeaders(r.Header)
+	}
+	s.objects[path] = copied
+	fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, html.EscapeString(copied.etag))
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code></Error>`, code)
+}
+
+// objectHeaders keeps the request headers S3 stores with an object.
+func objectHeaders(header http.Header) http.Header {
+	stored := make(http.Header)
+	for k, v := range header {
+		if k == "Content-Type" || strings.HasPrefix(k, "X-Amz-Meta-") {
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	Contents              []listObject
+	CommonPrefixes        []listPrefix
+}
+
+type listObject struct {
+	Key          string
+	Size         int
+	ETag         string
+	LastModified string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+// list serves a page of keys and common prefixes in key order, the continuation token is the last
+// key or common prefix of the previous page.
+func (s *Server) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	marker := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		marker = max(marker, string(decoded))
+	}
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+
+	var result listResult
+	last := ""
+	for _, key := range s.keys(bucket) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry, common := key, false
+		if index := strings.Index(key[len(prefix):], delimiter); delimiter != "" && index != -1 {
+			entry, common = key[:len(prefix)+index+len(delimiter)], true
+		}
+		if entry <= marker || entry == last {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if !common {
+			obj := s.objects[bucket+"/"+key]
+			result.Contents = append(result.Contents, listObject{key, len(obj.data), obj.etag, obj.modified.Format(time.RFC3339)})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, listPrefix{entry})
+		}
+		result.KeyCount++
+		last = entry
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, bucket string, body []byte) {
+	var request struct {
+		Object []struct {
+			Key string
+		}
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	s.stats.Batches++
+	type deleteError struct {
+		Key  string
+		Code string
+	}
+	var result struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Error   []deleteError `xml:"Error"`
+	}
+	for _, object := range request.Object {
+		if s.denied[object.Key] {
+			result.Error = append(result.Error, deleteError{Key: object.Key, Code: "AccessDenied"})
+			continue
+		}
+		delete(s.objects, bucket+"/"+object.Key)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"simplicity/oops"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxPutBytes is the largest upload a URLSigner presigns unless NewURLSigner is given a limit.
+const DefaultMaxPutBytes = 64 * 1024 * 1024 // 64MB
+
+// URLSigner gives stores without native presigning (memory, disk) the same signed URL flow as S3.
+// The URLs point at baseURL, where the URLSigner itself has to be mounted as the handler,
+// and carry an HMAC of method, key and expiry, so a URL for one GET cannot be turned into a PUT.
+// PUT URLs also sign the body limit, the size they were handed out for, larger bodies fail with 413.
+type URLSigner struct {
+	BlobStore
+	baseURL     string
+	secret      []byte
+	maxPutBytes int64
+}
+
+// NewURLSigner wraps store. Without a secret a random one is used, which invalidates
+// all handed out URLs on restart. A maxPutBytes of 0 uses DefaultMaxPutBytes.
+func NewURLSigner(store BlobStore, baseURL string, secret []byte, maxPutBytes int64) *URLSigner {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+	if maxPutBytes <= 0 {
+		maxPutBytes = DefaultMaxPutBytes
+	}
+	return &URLSigner{BlobStore: store, baseURL: strings.TrimSuffix(baseURL, "/"), secret: secret, maxPutBytes: maxPutBytes}
+}
+
+func (s *URLSigner) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, 0, ttl)
+}
+
+// PresignPut fails with oops.TooLarge for a size above the limit of the signer.
+func (s *URLSigner) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	if size <= 0 {
+		return "", fmt.Errorf("%w: presigned uploads need a size, got %d", oops.ValidationError, size)
+	}
+	if size > s.maxPutBytes {
+		return "", fmt.Errorf("%w: upload of %d bytes exceeds %d", oops.TooLarge, size, s.maxPutBytes)
+	}
+	return s.presign(http.MethodPut, key, size, ttl)
+}
+
+func (s *URLSigner) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return watchStore(ctx, s.BlobStore, prefix)
+}
+
+func (s *URLSigner) presign(method string, key string, size int64, ttl time.Duration) (string, error) {
+	if key == "" {
+		return "", oops.InvalidKey
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	limit := ""
+	if method == http.MethodPut {
+		limit = strconv.FormatInt(size, 10)
+		query.Set("max_bytes", limit)
+	}
+	query.Set("signature", s.sign(method, key, expires, limit))
+	return s.baseURL + (&url.URL{Path: "/" + key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// sign covers the body limit of PUT URLs, GET URLs have none.
+func (s *URLSigner) sign(method string, key string, expires string, limit string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	io.WriteString(mac, method+"\n"+key+"\n"+expires)
+	if limit != "" {
+		io.WriteString(mac, "\n"+limit)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of r and returns the body limit it signs for PUT requests.
+func (s *URLSigner) verify(r *http.Request, key string) (int64, bool) {
+	query := r.URL.Query()
+	expires := query.Get("expires")
+	deadline, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > deadline {
+		return 0, false
+	}
+	var limit int64
+	if r.Method == http.MethodPut {
+		if limit, err = strconv.ParseInt(query.Get("max_bytes"), 10, 64); err != nil || limit <= 0 {
+			return 0, false
+		}
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return 0, false
+	}
+	expected, _ := hex.DecodeString(s.sign(r.Method, key, expires, query.Get("max_bytes")))
+	return limit, hmac.Equal(signature, expected)
+}
+
+// ServeHTTP handles the signed requests, the path below the mount point is the key.
+func (s *URLSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" || r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, ok := s.verify(r, key)
+	if !ok {
+		http.Error(w, "invalid or expired signature", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPut {
+		if r.ContentLength > limit {
+			signedError(w, r, fmt.Errorf("%w: body of %d bytes exceeds %d", oops.TooLarge, r.ContentLength, limit))
+			return
+		}
+		etag, err := s.Put(r.Context(), key, http.MaxBytesReader(w, r.Body, limit), nil)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			err = fmt.Errorf("%w: body exceeds %d bytes", oops.TooLarge, maxBytesErr.Limit)
+		}
+		if err != nil {
+			signedError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(etag))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	reader, info, err := s.Get(r.Context(), key)
+	if err != nil {
+		signedError(w, r, err)
+		return
+	}
+	defer reader.Close()
+	header := w.Header()
+	header.Set("Content-Type", info.ContentType)
+	header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if info.ETag != "" {
+		header.Set("ETag", strconv.Quote(info.ETag))
+	}
+	if _, err = io.Copy(w, reader); err != nil {
+		slog.Default().ErrorContext(r.Context(), "Error during signed response writing", "key", key, "Error:", err.Error())
+	}
+}
+
+func signedError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, oops.KeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, oops.InvalidKey):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, oops.TooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		slog.Default().ErrorContext(r.Context(), "Signed request failed", "method", r.Method, "Error:", err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"simplicity/oops"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner(NewInMemoryBlobStore(), "/signed/", []byte("secret"), 0)
+	handler := http.StripPrefix("/signed", signer)
+	ctx := context.Background()
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return resp
+	}
+
+	putURL, err := signer.PresignPut(ctx, "images/a b/1", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() error = %v", err)
+	}
+	if !strings.HasPrefix(putURL, "/signed/images/a%20b/1?") {
+		t.Errorf("PresignPut() = %q, want the escaped key below the base url", putURL)
+	}
+	if resp := do(http.MethodPut, putURL, "data"); resp.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d: %s", resp.Code, http.StatusOK, resp.Body)
+	}
+	reader, _, err := signer.Get(ctx, "images/a b/1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	if string(data) != "data" {
+		t.Errorf("Get() data = %q, want %q", data, "data")
+	}
+
+	getURL, err := signer.PresignGet(ctx, "images/a b/1", time.Minute)
+	if err != nil {
+		t.Fatalf("PresignGet() error = %v", err)
+	}
+	if resp := do(http.MethodGet, getURL, ""); resp.Code != http.StatusOK || resp.Body.String() != "data" {
+		t.Errorf("GET = %d %q, want %d %q", resp.Code, resp.Body, http.StatusOK, "data")
+	}
+
+	tampered := getURL[:len(getURL)-1] + "0"
+	if strings.HasSuffix(getURL, "0") {
+		tampered = getURL[:len(getURL)-1] + "1"
+	}
+	expiredURL, _ := signer.PresignGet(ctx, "images/a b/1", -time.Minute)
+	otherURL, _ := signer.PresignGet(ctx, "images/a b/2", time.Minute)
+	rejected := []struct {
+		name   string
+		method string
+		url    string
+	}{
+		{"get url used for put", http.MethodPut, getURL},
+		{"expired", http.MethodGet, expiredURL},
+		{"other key", http.MethodGet, strings.Replace(otherURL, "/2?", "/1?", 1)},
+		{"tampered signature", http.MethodGet, tampered},
+		{"unsigned", http.MethodGet, "/signed/images/a%20b/1"},
+	}
+	for _, tt := range rejected {
+		if resp := do(tt.method, tt.url, "evil"); resp.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.Code, http.StatusForbidden)
+		}
+	}
+
+	missingURL, _ := signer.PresignGet(ctx, "missing", time.Minute)
+	if resp := do(http.MethodGet, missingURL, ""); resp.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing key status = %d, want %d", resp.Code, http.StatusNotFound)
+	}
+}
+
+func TestURLSigner_PutLimit(t *testing.T) {
+	signer := NewURLSigner(NewInMemoryBlobStore(), "/signed", []byte("secret"), 8)
+	handler := http.StripPrefix("/signed", signer)
+	ctx := context.Background()
+	put := func(url string, body io.Reader) int {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, url, body))
+		return resp.Code
+	}
+
+	if _, err := signer.PresignPut(ctx, "upload", 9, time.Minute); !errors.Is(err, oops.TooLarge) {
+		t.Errorf("PresignPut() of 9 bytes error = %v, want %v", err, oops.TooLarge)
+	}
+	smallURL, err := signer.PresignPut(ctx, "upload", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() error = %v", err)
+	}
+	if code := put(smallURL, strings.NewReader("12345")); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of 5 bytes to a url for 4 status = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+
+	putURL, err := signer.PresignPut(ctx, "upload", 8, time.Minute)
+	if err != nil {
+		t.Fatalf("PresignPut() error = %v", err)
+	}
+	if !strings.Contains(putURL, "max_bytes=8") {
+		t.Errorf("PresignPut() = %q, want the limit in the url", putURL)
+	}
+	if code := put(putURL, strings.NewReader("12345678")); code != http.StatusOK {
+		t.Errorf("PUT of 8 bytes status = %d, want %d", code, http.StatusOK)
+	}
+	if code := put(putURL, strings.NewReader("123456789")); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of 9 bytes status = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	// without a content length the body is cut off while it is read
+	if code := put(putURL, io.MultiReader(strings.NewReader("streamed past the limit"))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("streamed PUT of 23 bytes status = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	reader, _, err := signer.Get(ctx, "upload")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "12345678" {
+		t.Errorf("Get() data = %q, want the body within the limit", data)
+	}
+
+	raised := strings.Replace(putURL, "max_bytes=8", "max_bytes=80", 1)
+	if code := put(raised, strings.NewReader("123456789")); code != http.StatusForbidden {
+		t.Errorf("PUT with a raised limit status = %d, want %d", code, http.StatusForbidden)
+	}
+}
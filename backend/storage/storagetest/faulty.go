@@ -0,0 +1,400 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"simplicity/oops"
+	"simplicity/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op names the BlobStore calls a Fault applies to. OpPut covers Put and PutIf, OpList List and ListPage,
+// OpDelete Delete, DeleteMany and the deletes of DeleteAll.
+type Op string
+
+const (
+	OpGet      Op = "get"
+	OpGetRange Op = "get_range"
+	OpStat     Op = "stat"
+	OpPut      Op = "put"
+	OpCopy     Op = "copy"
+	OpMove     Op = "move"
+	OpDelete   Op = "delete"
+	OpList     Op = "list"
+)
+
+// Action is what a Fault does to a call.
+type Action string
+
+const (
+	// Fail returns Err without calling the store.
+	Fail Action = "fail"
+	// FailAfter calls the store and returns Err anyway, like a reply lost after the write happened.
+	FailAfter Action = "fail_after"
+	// Delay waits Delay before the call, or until the context is done.
+	Delay Action = "delay"
+	// Truncate lets Bytes bytes of the body that is read or written pass and then fails with Err,
+	// io.ErrUnexpectedEOF when it is nil.
+	Truncate Action = "truncate"
+	// Corrupt flips one bit of the body that is read or written, the stored data of a Put is corrupted silently.
+	Corrupt Action = "corrupt"
+)
+
+// Fault scripts an Action for the calls of Op on keys matching Key, a path.Match pattern where the
+// empty pattern matches every key. Copy and Move match on either key, List on the prefix. The first
+// After matching calls pass, then Times calls are hit, every one if Times is 0, each with the given
+// Probability, where 0 means always. Truncate and Corrupt only apply to Get, GetRange and Put.
+type Fault struct {
+	Op          Op
+	Key         string
+	Action      Action
+	Err         error
+	Delay       time.Duration
+	Bytes       int64
+	After       int
+	Times       int
+	Probability float64
+}
+
+// Injection records a fault that hit a call.
+type Injection struct {
+	Op     Op
+	Key    string
+	Action Action
+}
+
+// FaultyBlobStore wraps a store and injects the scripted faults into its calls. Every random choice
+// is drawn from the seed, so a failing test can be replayed.
+type FaultyBlobStore struct {
+	storage.BlobStore
+	mu       sync.Mutex
+	random   *rand.Rand
+	faults   []*scriptedFault
+	injected []Injection
+}
+
+type scriptedFault struct {
+	Fault
+	matched int
+	hit     int
+}
+
+func NewFaultyBlobStore(store storage.BlobStore, seed int64) *FaultyBlobStore {
+	return &FaultyBlobStore{BlobStore: store, random: rand.New(rand.NewSource(seed))}
+}
+
+// Inject adds faults to the script, the first one that hits a call wins.
+func (s *FaultyBlobStore) Inject(faults ...Fault) *FaultyBlobStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fault := range faults {
+		if fault.Err == nil && fault.Action != Truncate {
+			fault.Err = fmt.Errorf("%w: injected %s of %s", oops.Unavailable, fault.Action, fault.Op)
+		}
+		s.faults = append(s.faults, &scriptedFault{Fault: fault})
+	}
+	return s
+}
+
+// Reset drops the script and the injections, the store passes every call on again.
+func (s *FaultyBlobStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults, s.injected = nil, nil
+}
+
+// Injected returns the faults that hit a call, in order.
+func (s *FaultyBlobStore) Injected() []Injection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Injection(nil), s.injected...)
+}
+
+// match returns the fault that hits the call of op on keys, or nil.
+func (s *FaultyBlobStore) match(op Op, keys ...string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fault := range s.faults {
+		if fault.Op != op || !matchesAny(fault.Key, keys) {
+			continue
+		}
+		fault.matched++
+		if fault.matched <= fault.After || fault.Times > 0 && fault.hit >= fault.Times {
+			continue
+		}
+		if fault.Probability > 0 && s.random.Float64() >= fault.Probability {
+			continue
+		}
+		fault.hit++
+		s.injected = append(s.injected, Injection{Op: op, Key: keys[0], Action: fault.Action})
+		hit := fault.Fault
+		return &hit
+	}
+	return nil
+}
+
+func matchesAny(pattern string, keys []string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, key := range keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// before applies the faults that act ahead of a call, a non-nil error ends it.
+func (s *FaultyBlobStore) before(ctx context.Context, fault *Fault) error {
+	if fault == nil {
+		return nil
+	}
+	switch fault.Action {
+	case Fail:
+		return fault.Err
+	case Delay:
+		select {
+		case <-time.After(fault.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// after applies FailAfter to the result of a call.
+func after(fault *Fault, err error) error {
+	if err == nil && fault != nil && fault.Action == FailAfter {
+		return fault.Err
+	}
+	return err
+}
+
+// body applies Truncate and Corrupt to a body.
+func (s *FaultyBlobStore) body(fault *Fault, reader io.Reader) io.Reader {
+	if fault == nil {
+		return reader
+	}
+	switch fault.Action {
+	case Truncate:
+		err := fault.Err
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return io.MultiReader(io.LimitReader(reader, fault.Bytes), errorReader{err})
+	case Corrupt:
+		s.mu.Lock()
+		bit := s.random.Intn(8)
+		s.mu.Unlock()
+		return &corruptingReader{reader: reader, random: s.random, mu: &s.mu, bit: byte(1) << bit}
+	}
+	return reader
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// corruptingReader flips bit of a byte of the first read that returns data.
+type corruptingReader struct {
+	reader io.Reader
+	random *rand.Rand
+	mu     *sync.Mutex
+	bit    byte
+	done   bool
+}
+
+func (r *corruptingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && !r.done {
+		r.mu.Lock()
+		i := r.random.Intn(n)
+		r.mu.Unlock()
+		p[i] ^= r.bit
+		r.done = true
+	}
+	return n, err
+}
+
+func (s *FaultyBlobStore) List(ctx context.Context, prefix string, delimiter string) ([]storage.ListResult, error) {
+	fault := s.match(OpList, prefix)
+	if err := s.before(ctx, fault); err != nil {
+		return nil, err
+	}
+	results, err := s.BlobStore.List(ctx, prefix, delimiter)
+	return results, after(fault, err)
+}
+
+func (s *FaultyBlobStore) ListPage(ctx context.Context, opts storage.ListOptions) (storage.ListPage, error) {
+	fault := s.match(OpList, opts.Prefix)
+	if err := s.before(ctx, fault); err != nil {
+		return storage.ListPage{}, err
+	}
+	page, err := s.BlobStore.ListPage(ctx, opts)
+	return page, after(fault, err)
+}
+
+func (s *FaultyBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, storage.ObjectInfo, error) {
+	fault := s.match(OpGet, key)
+	if err := s.before(ctx, fault); err != nil {
+		return nil, storage.ObjectInfo{}, err
+	}
+	reader, info, err := s.BlobStore.Get(ctx, key)
+	if err = after(fault, err); err != nil {
+		if reader != nil {
+			reader.Close()
+		}
+		return nil, storage.ObjectInfo{}, err
+	}
+	return readCloser{s.body(fault, reader), reader}, info, nil
+}
+
+func (s *FaultyBlobStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, storage.ObjectInfo, error) {
+	fault := s.match(OpGetRange, key)
+	if err := s.before(ctx, fault); err != nil {
+		return nil, storage.ObjectInfo{}, err
+	}
+	reader, info, err := s.BlobStore.GetRange(ctx, key, offset, length)
+	if err = after(fault, err); err != nil {
+		if reader != nil {
+			reader.Close()
+		}
+		return nil, storage.ObjectInfo{}, err
+	}
+	return readCloser{s.body(fault, reader), reader}, info, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *FaultyBlobStore) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	fault := s.match(OpStat, key)
+	if err := s.before(ctx, fault); err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	info, err := s.BlobStore.Stat(ctx, key)
+	return info, after(fault, err)
+}
+
+func (s *FaultyBlobStore) Put(ctx context.Context, key string, reader io.Reader, metadata map[string]string) (string, error) {
+	return s.PutIf(ctx, key, reader, metadata, storage.Precondition{})
+}
+
+func (s *FaultyBlobStore) PutIf(ctx context.Context, key string, reader io.Reader, metadata map[string]string, cond storage.Precondition) (string, error) {
+	fault := s.match(OpPut, key)
+	if err := s.before(ctx, fault); err != nil {
+		return "", err
+	}
+	etag, err := s.BlobStore.PutIf(ctx, key, s.body(fault, reader), metadata, cond)
+	return etag, after(fault, err)
+}
+
+func (s *FaultyBlobStore) Copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	fault := s.match(OpCopy, src, dst)
+	if err := s.before(ctx, fault); err != nil {
+		return err
+	}
+	return after(fault, s.BlobStore.Copy(ctx, src, dst, metadata))
+}
+
+func (s *FaultyBlobStore) Move(ctx context.Context, src string, dst string, metadata map[string]string) error {
+	fault := s.match(OpMove, src, dst)
+	if err := s.before(ctx, fault); err != nil {
+		return err
+	}
+	return after(fault, s.BlobStore.Move(ctx, src, dst, metadata))
+}
+
+func (s *FaultyBlobStore) Delete(ctx context.Context, key string) error {
+	fault := s.match(OpDelete, key)
+	if err := s.before(ctx, fault); err != nil {
+		return err
+	}
+	return after(fault, s.BlobStore.Delete(ctx, key))
+}
+
+// DeleteMany fails the keys a fault hits and deletes the others.
+func (s *FaultyBlobStore) DeleteMany(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	var deleted []string
+	for _, key := range keys {
+		fault := s.match(OpDelete, key)
+		if err := s.before(ctx, fault); err != nil {
+			failed[key] = err
+			continue
+		}
+		if fault != nil && fault.Action == FailAfter {
+			failed[key] = fault.Err
+		}
+		deleted = append(deleted, key)
+	}
+	var deleteErr *storage.DeleteError
+	err := s.BlobStore.DeleteMany(ctx, deleted)
+	if errors.As(err, &deleteErr) {
+		for key, keyErr := range deleteErr.Failed {
+			failed[key] = keyErr
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &storage.DeleteError{Failed: failed}
+	}
+	return nil
+}
+
+// DeleteAll lists the prefix and deletes through DeleteMany, so faults hit single keys.
+func (s *FaultyBlobStore) DeleteAll(ctx context.Context, prefix string) error {
+	if prefix == "" {
+		return oops.InvalidKey
+	}
+	if !strings.HasSuffix(prefix, storage.Delimiter) {
+		prefix += storage.Delimiter
+	}
+	results, err := s.List(ctx, prefix, "")
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(results))
+	for _, result := range results {
+		keys = append(keys, result.Key)
+	}
+	return s.DeleteMany(ctx, keys)
+}
+
+func (s *FaultyBlobStore) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	presigner, ok := s.BlobStore.(storage.Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignGet(ctx, key, ttl)
+}
+
+func (s *FaultyBlobStore) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	presigner, ok := s.BlobStore.(storage.Presigner)
+	if !ok {
+		return "", oops.NotSupported
+	}
+	return presigner.PresignPut(ctx, key, size, ttl)
+}
+
+func (s *FaultyBlobStore) Watch(ctx context.Context, prefix string) (<-chan storage.Event, error) {
+	watcher, ok := s.BlobStore.(storage.Watcher)
+	if !ok {
+		return nil, oops.NotSupported
+	}
+	return watcher.Watch(ctx, prefix)
+}
@@ -0,0 +1,116 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"simplicity/oops"
+	"simplicity/storage"
+	"strings"
+	"testing"
+)
+
+func TestFaultyBlobStore_Script(t *testing.T) {
+	ctx := context.Background()
+	store := NewFaultyBlobStore(storage.NewInMemoryBlobStore(), 1).Inject(
+		Fault{Op: OpPut, Key: "images/*/canonical.png", Action: Fail, After: 1, Times: 1},
+		Fault{Op: OpPut, Key: "item/*", Action: FailAfter},
+	)
+	for i, want := range []error{nil, oops.Unavailable, nil} {
+		if _, err := store.Put(ctx, "images/1/canonical.png", strings.NewReader("png"), nil); !errors.Is(err, want) {
+			t.Errorf("Put() #%d error = %v, want %v", i, err, want)
+		}
+	}
+	if _, err := store.Put(ctx, "images/1/source.data", strings.NewReader("data"), nil); err != nil {
+		t.Errorf("Put() of a key no fault matches error = %v", err)
+	}
+
+	if _, err := store.Put(ctx, "item/items.js", strings.NewReader("{}"), nil); !errors.Is(err, oops.Unavailable) {
+		t.Errorf("Put() with a lost reply error = %v, want %v", err, oops.Unavailable)
+	}
+	if _, err := store.BlobStore.Stat(ctx, "item/items.js"); err != nil {
+		t.Errorf("Put() with a lost reply did not write, Stat() error = %v", err)
+	}
+	want := []Injection{{OpPut, "images/1/canonical.png", Fail}, {OpPut, "item/items.js", FailAfter}}
+	if got := store.Injected(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Injected() = %v, want %v", got, want)
+	}
+
+	store.Reset()
+	if _, err := store.Put(ctx, "item/items.js", strings.NewReader("{}"), nil); err != nil {
+		t.Errorf("Put() after Reset() error = %v", err)
+	}
+}
+
+func TestFaultyBlobStore_Bodies(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewInMemoryBlobStore()
+	backend.Put(ctx, "key", strings.NewReader("0123456789"), nil)
+	store := NewFaultyBlobStore(backend, 1).Inject(
+		Fault{Op: OpGet, Action: Truncate, Bytes: 4, Times: 1},
+		Fault{Op: OpGet, Action: Corrupt, Times: 1},
+		Fault{Op: OpPut, Action: Truncate, Bytes: 2},
+	)
+	reader, _, err := store.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(data) != "0123" {
+		t.Errorf("truncated Get() read %q, %v, want 4 bytes and %v", data, err, io.ErrUnexpectedEOF)
+	}
+	reader, _, _ = store.Get(ctx, "key")
+	if data, _ = io.ReadAll(reader); len(data) != 10 || string(data) == "0123456789" {
+		t.Errorf("corrupted Get() read %q, want one flipped bit", data)
+	}
+
+	if _, err = store.Put(ctx, "other", strings.NewReader("0123456789"), nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated Put() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err = backend.Stat(ctx, "other"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("truncated Put() stored an object, Stat() error = %v", err)
+	}
+}
+
+func TestFaultyBlobStore_Deterministic(t *testing.T) {
+	run := func(seed int64) ([]byte, int) {
+		ctx := context.Background()
+		store := NewFaultyBlobStore(storage.NewInMemoryBlobStore(), seed).Inject(
+			Fault{Op: OpPut, Key: "corrupt", Action: Corrupt},
+			Fault{Op: OpStat, Action: Fail, Probability: 0.5},
+		)
+		store.Put(ctx, "corrupt", bytes.NewReader(make([]byte, 64)), nil)
+		for i := 0; i < 20; i++ {
+			store.Stat(ctx, "corrupt")
+		}
+		reader, _, _ := store.BlobStore.Get(ctx, "corrupt")
+		data, _ := io.ReadAll(reader)
+		return data, len(store.Injected())
+	}
+	data, injected := run(7)
+	again, injectedAgain := run(7)
+	if !bytes.Equal(data, again) || injected != injectedAgain {
+		t.Errorf("runs with the same seed differ: %d and %d injections", injected, injectedAgain)
+	}
+	if bytes.Equal(data, make([]byte, 64)) || injected <= 1 || injected >= 21 {
+		t.Errorf("run = %d injections, want the corruption and some of the stats", injected)
+	}
+}
+
+func TestFaultyBlobStore_DeleteMany(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewInMemoryBlobStore()
+	for _, key := range []string{"1/a", "1/b", "1/c"} {
+		backend.Put(ctx, key, strings.NewReader(key), nil)
+	}
+	store := NewFaultyBlobStore(backend, 1).Inject(Fault{Op: OpDelete, Key: "1/b", Action: Fail})
+	var deleteErr *storage.DeleteError
+	if err := store.DeleteAll(ctx, "1"); !errors.As(err, &deleteErr) || len(deleteErr.Failed) != 1 || deleteErr.Failed["1/b"] == nil {
+		t.Fatalf("DeleteAll() error = %v, want 1/b failed", err)
+	}
+	if results, _ := backend.List(ctx, "", ""); len(results) != 1 || results[0].Key != "1/b" {
+		t.Errorf("DeleteAll() left %v, want 1/b only", results)
+	}
+}
@@ -0,0 +1,465 @@
+// Package storagetest checks that a storage.BlobStore behaves like the others. Every store of the
+// storage package runs it, a new store or decorator only needs a test that calls Run:
+//
+//	func TestMyBlobStore(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.BlobStore {
+//			return NewMyBlobStore(t.TempDir())
+//		})
+//	}
+//
+// FaultyBlobStore wraps a store for tests of what callers leave behind when the store fails.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"simplicity/oops"
+	"simplicity/storage"
+	"strings"
+	"testing"
+)
+
+// Factory returns a new, empty store for every call. It is called once per subtest.
+type Factory func(t *testing.T) storage.BlobStore
+
+// Run runs every conformance test as a subtest of t.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store storage.BlobStore)
+	}{
+		{"PutGet", testPutGet},
+		{"Metadata", testMetadata},
+		{"ContentType", testContentType},
+		{"EmptyKey", testEmptyKey},
+		{"MissingKey", testMissingKey},
+		{"List", testList},
+		{"ListDelimiter", testListDelimiter},
+		{"ListPage", testListPage},
+		{"GetRange", testGetRange},
+		{"PutIf", testPutIf},
+		{"CopyMove", testCopyMove},
+		{"Delete", testDelete},
+		{"DeleteMany", testDeleteMany},
+		{"DeleteAll", testDeleteAll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func put(t *testing.T, store storage.BlobStore, key string, data string, metadata map[string]string) string {
+	t.Helper()
+	etag, err := store.Put(context.Background(), key, strings.NewReader(data), metadata)
+	if err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+	return etag
+}
+
+func get(t *testing.T, store storage.BlobStore, key string) (string, storage.ObjectInfo) {
+	t.Helper()
+	reader, info, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q) error = %v", key, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Get(%q) read error = %v", key, err)
+	}
+	return string(data), info
+}
+
+func list(t *testing.T, store storage.BlobStore, prefix string, delimiter string) []storage.ListResult {
+	t.Helper()
+	results, err := store.List(context.Background(), prefix, delimiter)
+	if err != nil {
+		t.Fatalf("List(%q, %q) error = %v", prefix, delimiter, err)
+	}
+	return results
+}
+
+func keys(results []storage.ListResult) []string {
+	keys := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.IsObject {
+			keys = append(keys, result.Key)
+		} else {
+			keys = append(keys, result.Key+" (prefix)")
+		}
+	}
+	return keys
+}
+
+func equalKeys(t *testing.T, call string, got []storage.ListResult, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(keys(got), want) {
+		t.Errorf("%s = %v, want %v", call, keys(got), want)
+	}
+}
+
+func testPutGet(t *testing.T, store storage.BlobStore) {
+	etag := put(t, store, "files/1/source.data", "first version", nil)
+	if etag == "" {
+		t.Errorf("Put() returned an empty ETag")
+	}
+	data, info := get(t, store, "files/1/source.data")
+	if data != "first version" || info.Size != int64(len(data)) || info.ETag != etag {
+		t.Errorf("Get() = %q, %+v, want the content, its size and ETag %s", data, info, etag)
+	}
+	if info.LastModified.IsZero() {
+		t.Errorf("Get() LastModified is zero")
+	}
+	stat, err := store.Stat(context.Background(), "files/1/source.data")
+	if err != nil || stat.Size != info.Size || stat.ETag != etag {
+		t.Errorf("Stat() = %+v, %v, want what Get() reported", stat, err)
+	}
+
+	replaced := put(t, store, "files/1/source.data", "second", nil)
+	if data, info = get(t, store, "files/1/source.data"); data != "second" || info.ETag != replaced || replaced == etag {
+		t.Errorf("Get() after overwrite = %q, %+v, want the new content under a new ETag", data, info)
+	}
+
+	put(t, store, "empty", "", nil)
+	if data, info = get(t, store, "empty"); data != "" || info.Size != 0 {
+		t.Errorf("Get() of an empty object = %q, %+v", data, info)
+	}
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	if _, err = store.Put(context.Background(), "large", bytes.NewReader(large), nil); err != nil {
+		t.Fatalf("Put() of %d bytes error = %v", len(large), err)
+	}
+	if data, _ = get(t, store, "large"); data != string(large) {
+		t.Errorf("Get() of %d bytes returned %d different bytes", len(large), len(data))
+	}
+}
+
+func testMetadata(t *testing.T, store storage.BlobStore) {
+	metadata := map[string]string{"extension": "png", "original_name": "cat picture.png"}
+	put(t, store, "with", "data", metadata)
+	if _, info := get(t, store, "with"); !reflect.DeepEqual(info.Metadata, metadata) {
+		t.Errorf("Get() metadata = %v, want %v", info.Metadata, metadata)
+	}
+	if info, err := store.Stat(context.Background(), "with"); err != nil || !reflect.DeepEqual(info.Metadata, metadata) {
+		t.Errorf("Stat() metadata = %v, %v, want %v", info.Metadata, err, metadata)
+	}
+	put(t, store, "without", "data", nil)
+	if _, info := get(t, store, "without"); len(info.Metadata) != 0 {
+		t.Errorf("Get() metadata of an object stored without = %v, want none", info.Metadata)
+	}
+	put(t, store, "with", "data", nil)
+	if _, info := get(t, store, "with"); len(info.Metadata) != 0 {
+		t.Errorf("Get() metadata after an overwrite without = %v, want none", info.Metadata)
+	}
+}
+
+func testContentType(t *testing.T, store storage.BlobStore) {
+	put(t, store, "page", "<html><body>hi</body></html>", nil)
+	if info, err := store.Stat(context.Background(), "page"); err != nil || info.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Stat() content type = %q, %v, want it sniffed from the content", info.ContentType, err)
+	}
+}
+
+func testEmptyKey(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	put(t, store, "key", "data", nil)
+	_, _, getErr := store.Get(ctx, "")
+	_, _, rangeErr := store.GetRange(ctx, "", 0, 1)
+	_, statErr := store.Stat(ctx, "")
+	_, putErr := store.Put(ctx, "", strings.NewReader("data"), nil)
+	_, putIfErr := store.PutIf(ctx, "", strings.NewReader("data"), nil, storage.Precondition{IfNoneMatch: true})
+	for call, err := range map[string]error{
+		"Get":         getErr,
+		"GetRange":    rangeErr,
+		"Stat":        statErr,
+		"Put":         putErr,
+		"PutIf":       putIfErr,
+		"Copy from":   store.Copy(ctx, "", "other", nil),
+		"Copy to":     store.Copy(ctx, "key", "", nil),
+		"Move from":   store.Move(ctx, "", "other", nil),
+		"Move to":     store.Move(ctx, "key", "", nil),
+		"Delete":      store.Delete(ctx, ""),
+		"DeleteAll":   store.DeleteAll(ctx, ""),
+		"DeleteMany":  deleteManyFailure(store.DeleteMany(ctx, []string{"", "key"}), ""),
+		"DeleteMany ": deleteManyFailure(store.DeleteMany(ctx, []string{""}), ""),
+	} {
+		if !errors.Is(err, oops.InvalidKey) {
+			t.Errorf("%s() with an empty key error = %v, want %v", call, err, oops.InvalidKey)
+		}
+	}
+	if _, err := store.Stat(ctx, "key"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of a key deleted next to an empty one error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+// deleteManyFailure returns the error DeleteMany reported for key.
+func deleteManyFailure(err error, key string) error {
+	var deleteErr *storage.DeleteError
+	if !errors.As(err, &deleteErr) {
+		return fmt.Errorf("not a *storage.DeleteError: %v", err)
+	}
+	return deleteErr.Failed[key]
+}
+
+func testMissingKey(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	_, _, getErr := store.Get(ctx, "missing")
+	_, _, rangeErr := store.GetRange(ctx, "missing", 0, 1)
+	_, statErr := store.Stat(ctx, "missing")
+	for call, err := range map[string]error{
+		"Get":      getErr,
+		"GetRange": rangeErr,
+		"Stat":     statErr,
+		"Copy":     store.Copy(ctx, "missing", "other", nil),
+		"Move":     store.Move(ctx, "missing", "other", nil),
+	} {
+		if !errors.Is(err, oops.KeyNotFound) {
+			t.Errorf("%s() of a missing key error = %v, want %v", call, err, oops.KeyNotFound)
+		}
+	}
+	if _, err := store.Stat(ctx, "other"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of the destination of a failed Copy error = %v, want %v", err, oops.KeyNotFound)
+	}
+}
+
+var listKeys = []string{"a", "b/1", "b/2", "b/c/3", "b/c/4", "ba", "c"}
+
+func putListKeys(t *testing.T, store storage.BlobStore) {
+	t.Helper()
+	for _, key := range listKeys {
+		put(t, store, key, "data of "+key, nil)
+	}
+}
+
+func testList(t *testing.T, store storage.BlobStore) {
+	equalKeys(t, `List("", "") of an empty store`, list(t, store, "", ""))
+	putListKeys(t, store)
+
+	results := list(t, store, "", "")
+	equalKeys(t, `List("", "")`, results, listKeys...)
+	for _, result := range results {
+		if want := len("data of " + result.Key); result.Size != want {
+			t.Errorf("List() size of %q = %d, want %d", result.Key, result.Size, want)
+		}
+	}
+	equalKeys(t, `List("b", "")`, list(t, store, "b", ""), "b/1", "b/2", "b/c/3", "b/c/4", "ba")
+	equalKeys(t, `List("b/c/", "")`, list(t, store, "b/c/", ""), "b/c/3", "b/c/4")
+	equalKeys(t, `List("x", "")`, list(t, store, "x", ""))
+}
+
+func testListDelimiter(t *testing.T, store storage.BlobStore) {
+	putListKeys(t, store)
+	equalKeys(t, `List("", "/")`, list(t, store, "", "/"), "a", "b/ (prefix)", "ba", "c")
+	equalKeys(t, `List("b/", "/")`, list(t, store, "b/", "/"), "b/1", "b/2", "b/c/ (prefix)")
+	equalKeys(t, `List("b/c/", "/")`, list(t, store, "b/c/", "/"), "b/c/3", "b/c/4")
+	equalKeys(t, `List("b", "/")`, list(t, store, "b", "/"), "b/ (prefix)", "ba")
+	for _, result := range list(t, store, "", "/") {
+		if !result.IsObject && result.Size != 0 {
+			t.Errorf("List() common prefix %q has size %d", result.Key, result.Size)
+		}
+	}
+}
+
+func testListPage(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	putListKeys(t, store)
+	for _, delimiter := range []string{"", "/"} {
+		want := list(t, store, "", delimiter)
+		var got []storage.ListResult
+		opts := storage.ListOptions{Delimiter: delimiter, MaxKeys: 2}
+		for pages := 0; ; pages++ {
+			page, err := store.ListPage(ctx, opts)
+			if err != nil {
+				t.Fatalf("ListPage(%+v) error = %v", opts, err)
+			}
+			if len(page.Results) > 2 || pages > len(want) {
+				t.Fatalf("ListPage(%+v) = %v, want at most 2 results and an end", opts, keys(page.Results))
+			}
+			got = append(got, page.Results...)
+			if page.NextToken == "" {
+				break
+			}
+			opts.ContinuationToken = page.NextToken
+		}
+		equalKeys(t, fmt.Sprintf("ListPage(delimiter %q) pages", delimiter), got, keys(want)...)
+	}
+
+	page, err := store.ListPage(ctx, storage.ListOptions{StartAfter: "b/2"})
+	if err != nil {
+		t.Fatalf("ListPage() error = %v", err)
+	}
+	equalKeys(t, `ListPage(StartAfter "b/2")`, page.Results, "b/c/3", "b/c/4", "ba", "c")
+	if page.NextToken != "" {
+		t.Errorf("ListPage() of the last page NextToken = %q, want none", page.NextToken)
+	}
+	page, err = store.ListPage(ctx, storage.ListOptions{Prefix: "b/", Delimiter: "/", StartAfter: "b/1"})
+	if err != nil {
+		t.Fatalf("ListPage() error = %v", err)
+	}
+	equalKeys(t, `ListPage(Prefix "b/", StartAfter "b/1")`, page.Results, "b/2", "b/c/ (prefix)")
+}
+
+func testGetRange(t *testing.T, store storage.BlobStore) {
+	put(t, store, "key", "0123456789", map[string]string{"extension": "txt"})
+	tests := []struct {
+		offset int64
+		length int64
+		want   string
+		err    error
+	}{
+		{0, 0, "0123456789", nil},
+		{0, 4, "0123", nil},
+		{3, 4, "3456", nil},
+		{7, 0, "789", nil},
+		{7, 100, "789", nil},
+		{9, 1, "9", nil},
+		{10, 1, "", oops.InvalidRange},
+		{-1, 1, "", oops.InvalidRange},
+	}
+	for _, tt := range tests {
+		reader, info, err := store.GetRange(context.Background(), "key", tt.offset, tt.length)
+		if !errors.Is(err, tt.err) || tt.err != nil && err == nil {
+			t.Errorf("GetRange(%d, %d) error = %v, want %v", tt.offset, tt.length, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != tt.want || info.Size != 10 || info.Metadata["extension"] != "txt" {
+			t.Errorf("GetRange(%d, %d) = %q, %+v, %v, want %q of the whole object", tt.offset, tt.length, data, info, err, tt.want)
+		}
+	}
+}
+
+func testPutIf(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	etag, err := store.PutIf(ctx, "key", strings.NewReader("first"), nil, storage.Precondition{IfNoneMatch: true})
+	if err != nil {
+		t.Fatalf("PutIf(IfNoneMatch) of a new key error = %v", err)
+	}
+	if _, err = store.PutIf(ctx, "key", strings.NewReader("second"), nil, storage.Precondition{IfNoneMatch: true}); !errors.Is(err, oops.Conflict) {
+		t.Errorf("PutIf(IfNoneMatch) of a taken key error = %v, want %v", err, oops.Conflict)
+	}
+	if _, err = store.PutIf(ctx, "key", strings.NewReader("second"), nil, storage.Precondition{IfMatch: "stale"}); !errors.Is(err, oops.Conflict) {
+		t.Errorf("PutIf(IfMatch) with a stale ETag error = %v, want %v", err, oops.Conflict)
+	}
+	if _, err = store.PutIf(ctx, "missing", strings.NewReader("second"), nil, storage.Precondition{IfMatch: etag}); !errors.Is(err, oops.Conflict) {
+		t.Errorf("PutIf(IfMatch) of a missing key error = %v, want %v", err, oops.Conflict)
+	}
+	if data, _ := get(t, store, "key"); data != "first" {
+		t.Errorf("Get() after failed preconditions = %q, want it unchanged", data)
+	}
+	next, err := store.PutIf(ctx, "key", strings.NewReader("second"), nil, storage.Precondition{IfMatch: etag})
+	if err != nil || next == etag {
+		t.Errorf("PutIf(IfMatch) with the current ETag = %q, %v, want a new ETag", next, err)
+	}
+	if data, _ := get(t, store, "key"); data != "second" {
+		t.Errorf("Get() after PutIf(IfMatch) = %q", data)
+	}
+}
+
+func testCopyMove(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	put(t, store, "files/1/source.data", "data", map[string]string{"extension": "png"})
+	if err := store.Copy(ctx, "files/1/source.data", "files/2/source.data", nil); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := store.Move(ctx, "files/1/source.data", "deleted-files/1/source.data", nil); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	for _, key := range []string{"files/2/source.data", "deleted-files/1/source.data"} {
+		if data, info := get(t, store, key); data != "data" || info.Metadata["extension"] != "png" {
+			t.Errorf("Get(%q) = %q, %v, want the copied data and metadata", key, data, info.Metadata)
+		}
+	}
+	if _, err := store.Stat(ctx, "files/1/source.data"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of the moved key error = %v, want %v", err, oops.KeyNotFound)
+	}
+
+	replaced := map[string]string{"deleted_at": "2025-01-01T00:00:00Z"}
+	if err := store.Move(ctx, "files/2/source.data", "deleted-files/2/source.data", replaced); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	if info, err := store.Stat(ctx, "deleted-files/2/source.data"); err != nil || !reflect.DeepEqual(info.Metadata, replaced) || info.Size != 4 {
+		t.Errorf("Stat() = %+v, %v, want the replaced metadata", info, err)
+	}
+
+	if err := store.Move(ctx, "deleted-files/2/source.data", "deleted-files/2/source.data", nil); err != nil {
+		t.Errorf("Move() onto itself error = %v", err)
+	}
+	if data, _ := get(t, store, "deleted-files/2/source.data"); data != "data" {
+		t.Errorf("Get() after a Move() onto itself = %q", data)
+	}
+
+	put(t, store, "target", "old", nil)
+	if err := store.Copy(ctx, "deleted-files/2/source.data", "target", nil); err != nil {
+		t.Fatalf("Copy() onto an existing key error = %v", err)
+	}
+	if data, _ := get(t, store, "target"); data != "data" {
+		t.Errorf("Get() after a Copy() onto an existing key = %q", data)
+	}
+}
+
+func testDelete(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	put(t, store, "key", "data", nil)
+	put(t, store, "key2", "data", nil)
+	if err := store.Delete(ctx, "key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Stat(ctx, "key"); !errors.Is(err, oops.KeyNotFound) {
+		t.Errorf("Stat() of a deleted key error = %v, want %v", err, oops.KeyNotFound)
+	}
+	if err := store.Delete(ctx, "key"); err != nil {
+		t.Errorf("Delete() of a missing key error = %v, want none", err)
+	}
+	equalKeys(t, `List("", "") after Delete()`, list(t, store, "", ""), "key2")
+}
+
+func testDeleteMany(t *testing.T, store storage.BlobStore) {
+	putListKeys(t, store)
+	if err := store.DeleteMany(context.Background(), []string{"a", "b/c/3", "missing", "c"}); err != nil {
+		t.Fatalf("DeleteMany() error = %v", err)
+	}
+	equalKeys(t, `List("", "") after DeleteMany()`, list(t, store, "", ""), "b/1", "b/2", "b/c/4", "ba")
+	if err := store.DeleteMany(context.Background(), nil); err != nil {
+		t.Errorf("DeleteMany() without keys error = %v", err)
+	}
+}
+
+func testDeleteAll(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	putListKeys(t, store)
+	if err := store.DeleteAll(ctx, "b/c/"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	equalKeys(t, `List("", "") after DeleteAll("b/c/")`, list(t, store, "", ""), "a", "b/1", "b/2", "ba", "c")
+	// the prefix is a directory, a sibling that merely starts with it stays
+	if err := store.DeleteAll(ctx, "b"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	equalKeys(t, `List("", "") after DeleteAll("b")`, list(t, store, "", ""), "a", "ba", "c")
+	if err := store.DeleteAll(ctx, "missing/"); err != nil {
+		t.Errorf("DeleteAll() of an empty prefix error = %v", err)
+	}
+
+	for i := range 25 {
+		put(t, store, fmt.Sprintf("many/%02d", i), "data", nil)
+	}
+	if err := store.DeleteAll(ctx, "many/"); err != nil {
+		t.Fatalf("DeleteAll() error = %v", err)
+	}
+	equalKeys(t, `List("many/", "") after DeleteAll("many/")`, list(t, store, "many/", ""))
+}
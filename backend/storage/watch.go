@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"simplicity/oops"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+	// EventOverflow stands for the events dropped while the reader was behind, any key under Key may have changed.
+	EventOverflow EventType = "overflow"
+)
+
+// maxQueuedEvents bounds the events a subscription holds for a slow reader.
+const maxQueuedEvents = 1024
+
+// Event reports that the object at Key was written, ETag is its new version, or deleted.
+type Event struct {
+	Type EventType
+	Key  string
+	ETag string
+}
+
+// Watcher is implemented by stores that can report changes of the keys under a prefix. The channel
+// is closed once ctx is done, events are queued until they are read. A reader that falls more than
+// maxQueuedEvents behind gets a single EventOverflow for the prefix in place of the queued events.
+// Decorators forward to the store they wrap and fail with oops.NotSupported when it cannot watch.
+type Watcher interface {
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+// watchHub hands the events of the in-process stores to their subscriptions, the zero value is ready to use.
+type watchHub struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	prefix     string
+	mu         sync.Mutex
+	queue      []Event
+	overflowed bool
+	wake       chan struct{}
+	out        chan Event
+}
+
+func (h *watchHub) watch(ctx context.Context, prefix string) <-chan Event {
+	sub := &subscription{prefix: prefix, wake: make(chan struct{}, 1), out: make(chan Event)}
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*subscription]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	go func() {
+		defer close(sub.out)
+		defer func() {
+			h.mu.Lock()
+			delete(h.subs, sub)
+			h.mu.Unlock()
+		}()
+		sub.deliver(ctx)
+	}()
+	return sub.out
+}
+
+// emit queues events for every subscription whose prefix they match, it never blocks.
+func (h *watchHub) emit(events ...Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		sub.push(events)
+	}
+}
+
+func (s *subscription) push(events []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := false
+	for _, event := range events {
+		if !strings.HasPrefix(event.Key, s.prefix) || s.overflowed {
+			continue
+		}
+		queued = true
+		if len(s.queue) >= maxQueuedEvents {
+			s.queue = []Event{{Type: EventOverflow, Key: s.prefix}}
+			s.overflowed = true
+			continue
+		}
+		s.queue = append(s.queue, event)
+	}
+	if queued {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *subscription) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+		s.mu.Lock()
+		events := s.queue
+		s.queue, s.overflowed = nil, false
+		s.mu.Unlock()
+		for _, event := range events {
+			select {
+			case <-ctx.Done():
+				return
+			case s.out <- event:
+			}
+		}
+	}
+}
+
+// objectVersion is what polling compares between two listings.
+type objectVersion struct {
+	etag         string
+	lastModified time.Time
+}
+
+// pollChanges lists the objects under a prefix every interval and reports the difference to the previous
+// listing. Objects that exist when it starts are not reported, a failed listing is tried again next time.
+func pollChanges(ctx context.Context, interval time.Duration, list func(ctx context.Context) (map[string]objectVersion, error)) (<-chan Event, error) {
+	previous, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var hub watchHub
+	events := hub.watch(ctx, "")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := list(ctx)
+			if err != nil {
+				continue
+			}
+			hub.emit(diffVersions(previous, current)...)
+			previous = current
+		}
+	}()
+	return events, nil
+}
+
+func diffVersions(previous map[string]objectVersion, current map[string]objectVersion) []Event {
+	var events []Event
+	for key, version := range current {
+		if old, ok := previous[key]; !ok || old != version {
+			events = append(events, Event{Type: EventPut, Key: key, ETag: version.etag})
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			events = append(events, Event{Type: EventDelete, Key: key})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+// versionLister is implemented by stores whose Watch polls a listing, so decorators that guard the calls
+// of a store can poll through their guard.
+type versionLister interface {
+	listVersions(ctx context.Context, prefix string) (map[string]objectVersion, error)
+	pollInterval() time.Duration
+}
+
+// watchStore is the Watch of decorators that keep the keys of the store they wrap.
+func watchStore(ctx context.Context, store BlobStore, prefix string) (<-chan Event, error) {
+	watcher, ok := store.(Watcher)
+	if !ok {
+		return nil, oops.NotSupported
+	}
+	return watcher.Watch(ctx, prefix)
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"simplicity/oops"
+	"simplicity/storage/s3test"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("events closed, want another one")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no event within 2s")
+		return Event{}
+	}
+}
+
+func expectEvents(t *testing.T, events <-chan Event, want ...Event) {
+	t.Helper()
+	for _, w := range want {
+		got := nextEvent(t, events)
+		if got.Type != w.Type || got.Key != w.Key || (w.Type == EventPut && got.ETag == "") {
+			t.Errorf("event = %+v, want %+v", got, w)
+		}
+	}
+}
+
+func TestWatch_Native(t *testing.T) {
+	disk, err := NewDiskBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskBlobStore() error = %v", err)
+	}
+	for name, store := range map[string]BlobStore{"InMemory": NewInMemoryBlobStore(), "Disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			events, err := store.(Watcher).Watch(ctx, "images/")
+			if err != nil {
+				t.Fatalf("Watch() error = %v", err)
+			}
+			store.Put(ctx, "item/items.js", strings.NewReader("{}"), nil)
+			store.Put(ctx, "images/1", strings.NewReader("1"), nil)
+			store.Copy(ctx, "images/1", "images/2", nil)
+			store.Move(ctx, "images/2", "images/3", nil)
+			store.Delete(ctx, "images/1")
+			store.Delete(ctx, "images/missing")
+			store.DeleteMany(ctx, []string{"images/3"})
+			expectEvents(t, events,
+				Event{Type: EventPut, Key: "images/1"},
+				Event{Type: EventPut, Key: "images/2"},
+				Event{Type: EventPut, Key: "images/3"},
+				Event{Type: EventDelete, Key: "images/2"},
+				Event{Type: EventDelete, Key: "images/1"},
+				Event{Type: EventDelete, Key: "images/3"},
+			)
+
+			cancel()
+			for range events {
+			}
+		})
+	}
+}
+
+func TestWatch_Decorators(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := NewInMemoryBlobStore()
+	store := NewPrefixBlobStore(NewChecksumBlobStore(backend), "images/")
+	events, err := store.Watch(ctx, "files/")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	backend.Put(ctx, "images/deleted-files/1", strings.NewReader("1"), nil)
+	store.Put(ctx, "files/1", strings.NewReader("1"), nil)
+	expectEvents(t, events, Event{Type: EventPut, Key: "files/1"})
+
+	if _, err := NewChecksumBlobStore(&countingBlobStore{BlobStore: backend}).Watch(ctx, ""); !errors.Is(err, oops.NotSupported) {
+		t.Errorf("Watch() over a store that cannot watch error = %v, want %v", err, oops.NotSupported)
+	}
+}
+
+func TestWatch_Overflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewInMemoryBlobStore()
+	events, err := store.Watch(ctx, "images/")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	for i := range 2 * maxQueuedEvents {
+		store.Put(ctx, fmt.Sprintf("images/%d", i), strings.NewReader("1"), nil)
+	}
+	// the first events may be on their way already, the overflow follows them
+	for i := 0; ; i++ {
+		event := nextEvent(t, events)
+		if event.Type == EventOverflow {
+			if event.Key != "images/" {
+				t.Errorf("overflow event = %+v, want the watched prefix", event)
+			}
+			break
+		}
+		if i > 2 {
+			t.Fatalf("event %d = %+v, want the overflow of a reader that fell behind", i, event)
+		}
+	}
+	store.Put(ctx, "images/next", strings.NewReader("1"), nil)
+	expectEvents(t, events, Event{Type: EventPut, Key: "images/next"})
+}
+
+// failingLister fails its listings while failing is set and counts them.
+type failingLister struct {
+	*S3BlobStore
+	mu      sync.Mutex
+	failing bool
+	calls   int
+}
+
+func (l *failingLister) listVersions(ctx context.Context, prefix string) (map[string]objectVersion, error) {
+	l.mu.Lock()
+	l.calls++
+	failing := l.failing
+	l.mu.Unlock()
+	if failing {
+		return nil, syscall.ECONNRESET
+	}
+	return l.S3BlobStore.listVersions(ctx, prefix)
+}
+
+func TestResilientBlobStore_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, client := s3test.New(t)
+	backend := &failingLister{S3BlobStore: &S3BlobStore{client: client, bucket: "bucket", partSize: 1024, poll: 5 * time.Millisecond}}
+	store := NewResilientBlobStore(backend, RetryOptions{MaxAttempts: 1, FailureThreshold: 2, OpenTimeout: time.Hour})
+
+	events, err := store.Watch(ctx, "images/")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	backend.Put(ctx, "images/1", strings.NewReader("1"), nil)
+	expectEvents(t, events, Event{Type: EventPut, Key: "images/1"})
+
+	backend.mu.Lock()
+	backend.failing, backend.calls = true, 0
+	backend.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.calls != 2 {
+		t.Errorf("failing polls listed %d times, want the breaker open after 2", backend.calls)
+	}
+}
+
+func TestS3BlobStore_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, client := s3test.New(t)
+	store := &S3BlobStore{client: client, bucket: "bucket", partSize: 1024, poll: 10 * time.Millisecond}
+	store.Put(ctx, "images/old", strings.NewReader("old"), nil)
+
+	events, err := store.Watch(ctx, "images/")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	store.Put(ctx, "images/1", strings.NewReader("1"), nil)
+	store.Put(ctx, "item/items.js", strings.NewReader("{}"), nil)
+	expectEvents(t, events, Event{Type: EventPut, Key: "images/1"})
+	store.Put(ctx, "images/1", strings.NewReader("changed"), nil)
+	expectEvents(t, events, Event{Type: EventPut, Key: "images/1"})
+	store.Delete(ctx, "images/old")
+	expectEvents(t, events, Event{Type: EventDelete, Key: "images/old"})
+}
+
+func TestCachingBlobStore_InvalidateOnChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := NewInMemoryBlobStore()
+	cache, err := NewCachingBlobStore(backend, CacheOptions{MaxBytes: 1024, Prefixes: []string{"key"}})
+	if err != nil {
+		t.Fatalf("NewCachingBlobStore() error = %v", err)
+	}
+	if err = cache.InvalidateOnChange(ctx); err != nil {
+		t.Fatalf("InvalidateOnChange() error = %v", err)
+	}
+	backend.Put(ctx, "key", strings.NewReader("old"), nil)
+	if got := readString(t, cache, "key"); got != "old" {
+		t.Fatalf("Get() = %q", got)
+	}
+
+	backend.Put(ctx, "key", strings.NewReader("new"), nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for readString(t, cache, "key") != "new" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Get() still serves the old content after a change of the backend")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"simplicity/config"
+	"simplicity/oops"
+	"simplicity/storage"
+	"simplicity/storage/s3test"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_setupStore_S3Endpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	fake, _ := s3test.New(t)
+	conf := &config.Config{
+		Storage: config.Storage{Backend: "s3"},
+		AWS:     config.AWS{Bucket: "bucket", Region: "us-east-1", Endpoint: fake.URL},
+	}
+	stack, err := setupStore(conf)
+	require.NoError(t, err)
+	store := stack.store
+
+	ctx := context.Background()
+	_, err = store.Put(ctx, "images/1", strings.NewReader("data"), map[string]string{"extension": "png"})
+	require.NoError(t, err)
+	stored, ok := fake.Object("bucket", "images/1")
+	assert.True(t, ok)
+	assert.Equal(t, "data", string(stored))
+
+	reader, info, err := store.Get(ctx, "images/1")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, "png", info.Metadata["extension"])
+
+	_, err = store.Stat(ctx, "images/2")
+	assert.ErrorIs(t, err, oops.KeyNotFound)
+}
+
+func Test_storeStack_close(t *testing.T) {
+	ctx := context.Background()
+	primary, replica := storage.NewInMemoryBlobStore(), storage.NewInMemoryBlobStore()
+	mirror := storage.NewMirroredBlobStore(primary, []storage.BlobStore{replica}, storage.MirrorOptions{Async: true})
+	quota, err := storage.NewQuotaBlobStore(ctx, mirror, storage.QuotaOptions{Rules: []storage.QuotaRule{{Prefix: "images/"}}})
+	require.NoError(t, err)
+	_, err = quota.Put(ctx, "images/1", strings.NewReader("data"), nil)
+	require.NoError(t, err)
+
+	storeStack{store: quota, mirror: mirror, quota: quota}.close(slog.Default())
+	_, err = replica.Stat(ctx, "images/1")
+	assert.NoError(t, err, "queued writes reach the replica")
+	_, err = replica.Stat(ctx, "storage/usage.json")
+	assert.NoError(t, err, "the counters are saved through the mirror before it closes")
+}
@@ -1,9 +1,12 @@
 package svc
 
 import (
+	"crypto/subtle"
 	"log/slog"
 	"net/http"
 	"runtime"
+	"simplicity/oops"
+	"strings"
 	"time"
 )
 
@@ -31,6 +34,19 @@ func NewLoggingMiddleware(h http.Handler, logger *slog.Logger) http.Handler {
 	})
 }
 
+// NewTokenMiddleware only lets requests through that carry the token as "Authorization: Bearer <token>".
+func NewTokenMiddleware(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			Error(w, r, oops.Unauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
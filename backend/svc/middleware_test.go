@@ -0,0 +1,35 @@
+package svc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTokenMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		token  string
+		header string
+		want   int
+	}{
+		{"secret", "Bearer secret", http.StatusNoContent},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp := httptest.NewRecorder()
+		NewTokenMiddleware(ok, tt.token).ServeHTTP(resp, req)
+		assert.Equal(t, tt.want, resp.Code, "token %q, header %q", tt.token, tt.header)
+	}
+}
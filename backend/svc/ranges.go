@@ -0,0 +1,80 @@
+package svc
+
+import (
+	"fmt"
+	"net/http"
+	"simplicity/oops"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange resolves a Range header against a resource of the given size. ok is false when the
+// whole resource should be sent: no header, a malformed one, another unit or several ranges.
+// A range that selects no byte of the resource fails with oops.InvalidRange.
+func ParseRange(header string, size int64) (ByteRange, bool, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return ByteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return ByteRange{}, false, nil
+	}
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return ByteRange{}, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return ByteRange{}, false, oops.InvalidRange
+		}
+		suffix = min(suffix, size)
+		return ByteRange{Start: size - suffix, Length: suffix}, true, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return ByteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return ByteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return ByteRange{}, false, oops.InvalidRange
+	}
+	return ByteRange{Start: start, Length: end - start + 1}, true, nil
+}
+
+// IfRangeMatches reports whether a Range header may be honoured. If-Range holds either a strong
+// entity tag or the Last-Modified date of the representation the client already has parts of.
+func IfRangeMatches(r *http.Request, etag string, lastModified time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && ifRange == etag
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return date.Equal(lastModified.Truncate(time.Second))
+}
@@ -0,0 +1,63 @@
+package svc
+
+import (
+	"net/http/httptest"
+	"simplicity/oops"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   ByteRange
+		ok     bool
+		err    error
+	}{
+		{header: "", size: 10},
+		{header: "items=0-1", size: 10},
+		{header: "bytes=0-1,3-4", size: 10},
+		{header: "bytes=5-2", size: 10},
+		{header: "bytes=x-", size: 10},
+		{header: "bytes=0-0", size: 10, want: ByteRange{0, 1}, ok: true},
+		{header: "bytes=2-5", size: 10, want: ByteRange{2, 4}, ok: true},
+		{header: "bytes=2-", size: 10, want: ByteRange{2, 8}, ok: true},
+		{header: "bytes=8-100", size: 10, want: ByteRange{8, 2}, ok: true},
+		{header: "bytes=-3", size: 10, want: ByteRange{7, 3}, ok: true},
+		{header: "bytes=-30", size: 10, want: ByteRange{0, 10}, ok: true},
+		{header: "bytes=10-", size: 10, err: oops.InvalidRange},
+		{header: "bytes=-0", size: 10, err: oops.InvalidRange},
+		{header: "bytes=0-", size: 0, err: oops.InvalidRange},
+	}
+	for _, tt := range tests {
+		got, ok, err := ParseRange(tt.header, tt.size)
+		assert.Equal(t, tt.err, err, tt.header)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.want, got, tt.header)
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modified := time.Date(2025, 1, 2, 3, 4, 5, 600, time.UTC)
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{ifRange: "", want: true},
+		{ifRange: `"abc"`, want: true},
+		{ifRange: `"other"`, want: false},
+		{ifRange: `W/"abc"`, want: false},
+		{ifRange: modified.Format("Mon, 02 Jan 2006 15:04:05 GMT"), want: true},
+		{ifRange: modified.Add(time.Hour).Format("Mon, 02 Jan 2006 15:04:05 GMT"), want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		assert.Equal(t, tt.want, IfRangeMatches(r, `"abc"`, modified), tt.ifRange)
+	}
+}
@@ -38,6 +38,30 @@ func resolveErrorCode(err error) int {
 	if errors.Is(err, oops.KeyNotFound) {
 		return http.StatusNotFound
 	}
+	if errors.Is(err, oops.Conflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, oops.InvalidRange) {
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+	if errors.Is(err, oops.TooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, oops.QuotaExceeded) {
+		return http.StatusInsufficientStorage
+	}
+	if errors.Is(err, oops.Unavailable) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, oops.NotSupported) {
+		return http.StatusNotImplemented
+	}
+	if errors.Is(err, oops.Unauthorized) {
+		return http.StatusUnauthorized
+	}
+	if errors.Is(err, oops.Corrupted) {
+		return http.StatusInternalServerError
+	}
 	//if errors.Is(err, oops.InvalidKey) || errors.Is(err, oops.ValidationError) || errors.Is(err, oops.KeyAlreadyExists) {
 	//	return http.StatusBadRequest
 	//}